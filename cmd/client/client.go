@@ -0,0 +1,2363 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+type ClientRPC struct {
+	id    string
+	nonce string
+	links *linkRegistry
+	out   *lineEditor
+	// quietJoins hides join and leave notices on this client only.
+	quietJoins atomic.Bool
+	// multiRoom is set while the client is in more than one room, so messages
+	// are shown with the room they came from.
+	multiRoom atomic.Bool
+	// seen is the newest history sequence number this client has shown.
+	seen atomic.Uint64
+	// shown is what seen can't tell: which recent entries were shown, so a
+	// replay overlapping them shows each once.
+	shown shownSet
+	// echoes carries the tokens of selftest messages the server called back with.
+	echoes chan string
+	// mentions collects the messages that @mention this client.
+	mentions *mentionLog
+	// online is the newest user list the server pushed; nil until the first.
+	usersMu sync.Mutex
+	online  *protocol.UsersUpdate
+}
+
+// shownMax bounds how many shown history entries are remembered.
+const shownMax = 1000
+
+// shownSet remembers the last shownMax history entries shown, by room and
+// sequence number. The zero value is empty and ready to use.
+type shownSet struct {
+	mu    sync.Mutex
+	in    map[shownKey]bool
+	order []shownKey // oldest first
+}
+
+type shownKey struct {
+	room string
+	seq  uint64
+}
+
+// add records that seq in room was shown and reports whether it was new.
+func (s *shownSet) add(room string, seq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := shownKey{room, seq}
+	if s.in[k] {
+		return false
+	}
+	if s.in == nil {
+		s.in = make(map[shownKey]bool)
+	}
+	if len(s.order) == shownMax {
+		delete(s.in, s.order[0])
+		s.order = append(s.order[:0], s.order[1:]...)
+	}
+	s.in[k] = true
+	s.order = append(s.order, k)
+	return true
+}
+
+// forget drops what was shown of room, whose numbering has started again.
+func (s *shownSet) forget(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.order[:0]
+	for _, k := range s.order {
+		if k.room == room {
+			delete(s.in, k)
+		} else {
+			kept = append(kept, k)
+		}
+	}
+	s.order = kept
+}
+
+// saw records that history up to seq has been shown.
+func (c *ClientRPC) saw(seq uint64) {
+	for {
+		cur := c.seen.Load()
+		if seq <= cur || c.seen.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+// Nonce lets the server confirm that it dialed back to this process.
+func (c *ClientRPC) Nonce(_ struct{}, reply *string) error {
+	*reply = c.nonce
+	return nil
+}
+
+// UpdateUsers keeps the server's latest user list for the online command.
+// Deliveries can overtake each other, so an older list never replaces a newer.
+func (c *ClientRPC) UpdateUsers(args protocol.UsersUpdate, _ *struct{}) error {
+	debugf("user list %d: %d users", args.Version, len(args.Users))
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+	if c.online == nil || args.Version > c.online.Version {
+		c.online = &args
+	}
+	return nil
+}
+
+// onlineUsers returns the last pushed user list, or nil if none came yet.
+func (c *ClientRPC) onlineUsers() []string {
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+	if c.online == nil {
+		return nil
+	}
+	return c.online.Users
+}
+
+func (c *ClientRPC) Receive(args protocol.MessageArgs, _ *struct{}) error {
+	debugf("receive from %q: %d text bytes, %d data bytes", args.Sender, len(args.Text), len(args.Data))
+	c.saw(args.Seq)
+	if args.Kind == "selftest" {
+		select {
+		case c.echoes <- args.Text:
+		default: // nobody waiting
+		}
+		return nil
+	}
+	if args.Seq != 0 {
+		c.shown.add(args.Room, args.Seq)
+	}
+	c.mentions.note(args)
+	if c.quietJoins.Load() && (args.Kind == "join" || args.Kind == "leave") {
+		return nil
+	}
+	// print incoming message (from other clients or system)
+	out := formatIncoming(args)
+	if c.multiRoom.Load() && args.Room != "" {
+		out = "[" + args.Room + "] " + out
+	}
+	if args.Data == nil {
+		out += c.links.footnotes(args.Text)
+	}
+	if args.Mentioned {
+		out = "\a" + out // @everyone or @here: ring the bell
+	}
+	c.out.print(out)
+	return nil
+}
+
+// mentionsMax bounds how many mention previews are kept between checks; the
+// count goes on past it.
+const mentionsMax = 50
+
+// mention is one message that @mentioned this client.
+type mention struct {
+	At      time.Time
+	Preview string // the line as shown, which names the sender
+}
+
+// mentionLog counts the messages that mention name since the last take.
+type mentionLog struct {
+	mu      sync.Mutex
+	pattern *regexp.Regexp
+	count   int
+	recent  []mention // oldest first, at most mentionsMax
+}
+
+func newMentionLog(name string) *mentionLog {
+	l := &mentionLog{}
+	l.setName(name)
+	return l
+}
+
+// setName changes whose mentions are counted, as after a switch of name.
+func (l *mentionLog) setName(name string) {
+	p := regexp.MustCompile(`(?i)(^|[^\pL\pN_])@` + regexp.QuoteMeta(name) + `($|[^\pL\pN_])`)
+	l.mu.Lock()
+	l.pattern = p
+	l.mu.Unlock()
+}
+
+// note records m if it is a chat or private message from someone else that
+// mentions the name, or that the server says pings everyone it reaches.
+func (l *mentionLog) note(m protocol.MessageArgs) {
+	if m.Data != nil || (m.Kind != "" && m.Kind != "private") {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !m.Mentioned && !l.pattern.MatchString(m.Text) {
+		return
+	}
+	preview := m.Text
+	if r := []rune(preview); len(r) > 80 {
+		preview = string(r[:79]) + "…"
+	}
+	l.count++
+	if len(l.recent) == mentionsMax {
+		l.recent = append(l.recent[:0], l.recent[1:]...)
+	}
+	l.recent = append(l.recent, mention{At: time.Now(), Preview: preview})
+}
+
+// take returns the count and previews since the last take and resets them.
+func (l *mentionLog) take() (int, []mention) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, recent := l.count, l.recent
+	l.count, l.recent = 0, nil
+	return n, recent
+}
+
+// urlPattern matches http(s) URLs up to whitespace or a closing bracket/quote.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>()\[\]"']+`)
+
+// extractURLs returns the URLs in text in order, without trailing punctuation
+// that usually ends the sentence rather than the link.
+func extractURLs(text string) []string {
+	var urls []string
+	for _, u := range urlPattern.FindAllString(text, -1) {
+		u = strings.TrimRight(u, ".,;:!?")
+		if len(u) > len("https://") {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// linkRegistry numbers every URL seen this session so 'open <n>' can refer to it.
+type linkRegistry struct {
+	mu    sync.Mutex
+	links []string // links[n-1] is footnote [n]
+}
+
+// footnotes registers the URLs in text and returns their numbered list,
+// one "  [n] url" line each, or "" when there are none.
+func (r *linkRegistry) footnotes(text string) string {
+	urls := extractURLs(text)
+	if len(urls) == 0 {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	for _, u := range urls {
+		r.links = append(r.links, u)
+		fmt.Fprintf(&b, "\n  [%d] %s", len(r.links), u)
+	}
+	return b.String()
+}
+
+func (r *linkRegistry) get(n int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n < 1 || n > len(r.links) {
+		return "", false
+	}
+	return r.links[n-1], true
+}
+
+// openURL launches the OS default browser on u. On Windows it goes through
+// url.dll rather than "cmd /c start": the URL comes from another user, and cmd
+// would run anything after a & or | in it.
+func openURL(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Start()
+}
+
+func formatIncoming(m protocol.MessageArgs) string {
+	if m.Data != nil {
+		return formatPayload(m)
+	}
+	if m.Kind == "table" && m.Table != nil {
+		return fmt.Sprintf("%s posted a table:\n%s", m.Sender, formatTable(*m.Table))
+	}
+	// if it's a system join/leave message it is already formatted as "User X joined"
+	// otherwise it will be "Sender: text"
+	return m.Text
+}
+
+// formatPayload renders a binary message. Plain text payloads are shown
+// inline; anything else gets a placeholder naming the content type.
+func formatPayload(m protocol.MessageArgs) string {
+	if strings.HasPrefix(m.ContentType, "text/plain") && utf8.Valid(m.Data) {
+		return fmt.Sprintf("%s sent %s:\n%s", m.Sender, m.ContentType, strings.TrimRight(string(m.Data), "\n"))
+	}
+	return fmt.Sprintf("[%s sent %s, %d bytes]", m.Sender, m.ContentType, len(m.Data))
+}
+
+// formatTable renders t as aligned columns with a rule under the headers.
+func formatTable(t protocol.Table) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(t.Headers, "\t"))
+	rule := make([]string, len(t.Headers))
+	for i, h := range t.Headers {
+		rule[i] = strings.Repeat("-", utf8.RuneCountInString(h))
+	}
+	fmt.Fprintln(w, strings.Join(rule, "\t"))
+	for _, row := range t.Rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// parseTable reads "a,b;1,2;3,4": rows split on ';', cells on ',', headers first.
+func parseTable(s string) protocol.Table {
+	var t protocol.Table
+	for i, line := range strings.Split(s, ";") {
+		cells := strings.Split(line, ",")
+		for j := range cells {
+			cells[j] = strings.TrimSpace(cells[j])
+		}
+		if i == 0 {
+			t.Headers = cells
+		} else {
+			t.Rows = append(t.Rows, cells)
+		}
+	}
+	return t
+}
+
+// debug turns on verbose tracing of RPCs, reconnects and deliveries. Trace
+// lines go to stderr so they don't interleave with chat output on stdout.
+var (
+	debug    atomic.Bool
+	debugLog = log.New(os.Stderr, "debug: ", log.Ltime|log.Lmicroseconds)
+)
+
+func debugf(format string, args ...any) {
+	if debug.Load() {
+		debugLog.Printf(format, args...)
+	}
+}
+
+// callRPC is server.Call with debug tracing of the call and its outcome.
+func callRPC(server *rpc.Client, method string, args, reply any) error {
+	start := time.Now()
+	err := server.Call(method, args, reply)
+	debugf("call %s: %v in %v", method, err, time.Since(start))
+	return err
+}
+
+// serverTLS is set by -tls: connect to the server over TLS with it.
+var serverTLS *tls.Config
+
+// startTLS is set by -starttls: reach TLS by upgrading a plain connection.
+var startTLS bool
+
+// dial connects to the server, over TLS when serverTLS is set.
+func dial(addr string) (*rpc.Client, error) {
+	if serverTLS == nil {
+		return rpc.Dial("tcp", addr)
+	}
+	tlsDial := tls.Dial
+	if startTLS {
+		tlsDial = protocol.DialStartTLS
+	}
+	conn, err := tlsDial("tcp", addr, serverTLS)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// clientTLS builds the config for talking to the server: trust caFile, or the
+// system roots when empty, and expect serverName when set.
+func clientTLS(caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// callbackCert makes a throwaway self-signed certificate for the callback
+// listener and returns it with its hex SHA-256, which the server pins when it
+// dials back.
+func callbackCert() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dschat client callback"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:]), nil
+}
+
+func dialWithRetry(addr string) (*rpc.Client, error) {
+	var client *rpc.Client
+	var err error
+	backoff := time.Second
+	for i := 0; i < 5; i++ {
+		debugf("dial %s (attempt %d)", addr, i+1)
+		client, err = dial(addr)
+		if err == nil {
+			return client, nil
+		}
+		log.Printf("dial error: %v; retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return nil, err
+}
+
+// reconnect drops the current server connection, dials again and
+// re-registers so the server dials back to our RPC listener.
+func reconnect(server *rpc.Client, addr string, reg protocol.RegisterArgs) (*rpc.Client, error) {
+	debugf("reconnecting to %s as %s", addr, reg.ID)
+	server.Close()
+	server, err := dialWithRetry(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := callRPC(server, "ChatServer.Register", reg, &struct{}{}); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("register: %w", err)
+	}
+	return server, nil
+}
+
+// isMethodNotFound reports whether err is net/rpc's answer to a call the server
+// does not implement, as happens when a newer client talks to an older server.
+func isMethodNotFound(err error) bool {
+	if _, ok := err.(rpc.ServerError); !ok {
+		return false
+	}
+	return strings.HasPrefix(err.Error(), "rpc: can't find ")
+}
+
+// chatClient holds the connection to the server and the session state the
+// input loop works with.
+type chatClient struct {
+	server        *rpc.Client
+	addr          string
+	reg           protocol.RegisterArgs
+	serverVersion string
+	disabled      map[string]bool // commands the server can't serve
+	rec           *recorder       // non-nil while recording
+	in            *lineEditor
+	recv          *ClientRPC   // this client's callback receiver
+	listener      net.Listener // where the server calls recv
+	histFile      string       // input history file, "" = none
+	restore       func()       // puts the terminal back; set once line editing starts
+	closeOnce     sync.Once
+	historyMax    int  // ask before printing more history entries than this
+	sendHistory   bool // print the history after each send rather than an acknowledgement
+	limit         *throttle
+	reminders     reminders
+	pausedUntil   time.Time // set from a SendAck's Backpressure; sends wait until then
+	autoRetry     int       // times to resend a rate-limited message after the wait the server gives; 0 = tell the user when they can send
+	retryNotice   *time.Timer
+	showReplayed  bool          // catching up shows entries already shown again (-dedup=false)
+	adminToken    string        // sent with Join, where it lets an admin create a room
+	rooms         []string      // rooms joined with addroom besides reg.Room; rejoined after a reconnect
+	cacheDir      string        // history caches go here, one per server and room; "" = none
+	cache         *historyCache // of reg.Room on addr; nil without cacheDir
+}
+
+// throttle is a token bucket that keeps the client from issuing RPCs faster
+// than rate per second, with bursts of up to rate, or of one command when rate
+// is below 1 (0.5 allows one every two seconds). A zero rate never throttles.
+type throttle struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(rate float64) *throttle {
+	burst := max(1, rate)
+	return &throttle{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes a token if one is available.
+func (t *throttle) allow() bool {
+	if t.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// throttled reports, and tells the user, when a command must be dropped to
+// stay under the client's own rate limit.
+func (cl *chatClient) throttled() bool {
+	if cl.limit.allow() {
+		return false
+	}
+	fmt.Println("(slow down: too many commands, not sent)")
+	return true
+}
+
+// call runs the RPC behind a client command. If the server does not
+// implement it, the command is disabled for the rest of the session and the
+// user gets a plain explanation instead of the raw RPC error.
+func (cl *chatClient) call(cmd, method string, args, reply any) bool {
+	if cl.disabled[cmd] {
+		fmt.Println("this server doesn't support that command")
+		return false
+	}
+	if cl.throttled() {
+		return false
+	}
+	if err := callRPC(cl.server, method, args, reply); err != nil {
+		if isMethodNotFound(err) {
+			cl.disabled[cmd] = true
+			fmt.Println("this server doesn't support that command")
+			return false
+		}
+		log.Printf("%s call error: %v", cmd, err)
+		return false
+	}
+	return true
+}
+
+// selftest asks the server to call this client's listener back with a random
+// token and reports whether the token arrived.
+func (cl *chatClient) selftest() {
+	if cl.disabled["selftest"] {
+		fmt.Println("this server doesn't support that command")
+		return
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	for len(cl.recv.echoes) > 0 {
+		<-cl.recv.echoes // left over from an earlier test that timed out
+	}
+	fmt.Printf("selftest: asking the server to call back %s ...\n", cl.reg.Addr)
+	err := callRPC(cl.server, "ChatServer.Echo", protocol.EchoArgs{ID: cl.reg.ID, Token: token}, &struct{}{})
+	if isMethodNotFound(err) {
+		cl.disabled["selftest"] = true
+		fmt.Println("this server doesn't support that command")
+		return
+	}
+	if err != nil {
+		fmt.Printf("selftest FAILED: %v\n", err)
+		fmt.Println("the server cannot reach your listener; you can send but will not receive messages")
+		return
+	}
+	select {
+	case got := <-cl.recv.echoes:
+		if got != token {
+			fmt.Println("selftest FAILED: callback arrived with the wrong token")
+			return
+		}
+		fmt.Println("selftest OK: the server reached your listener and the message arrived")
+	case <-time.After(2 * time.Second):
+		fmt.Println("selftest FAILED: the server reported success but no message arrived")
+	}
+}
+
+func (cl *chatClient) reconnect() error {
+	// messages may arrive as soon as the server has us again, before the
+	// ones missed in between: catch up from what was shown before
+	seen := cl.recv.seen.Load()
+	s, err := reconnect(cl.server, cl.addr, cl.reg)
+	if err != nil {
+		return err
+	}
+	cl.server = s
+	cl.catchUp(seen)
+	cl.rejoin()
+	return nil
+}
+
+// rejoin joins cl.rooms again after registering, which only joins reg.Room,
+// then makes reg.Room the one sent to again. A room that can't be joined, as
+// when it no longer exists, is logged and dropped from the list.
+func (cl *chatClient) rejoin() {
+	if len(cl.rooms) == 0 {
+		return
+	}
+	var kept []string
+	for _, room := range cl.rooms {
+		var h protocol.HistoryReply
+		if err := callRPC(cl.server, "ChatServer.Join", protocol.JoinArgs{ID: cl.reg.ID, Room: room, Token: cl.adminToken, Keep: true}, &h); err != nil {
+			log.Printf("rejoin %s: %v (no longer in that room)", room, err)
+			continue
+		}
+		kept = append(kept, room)
+	}
+	if len(kept) > 0 {
+		var h protocol.HistoryReply
+		if err := callRPC(cl.server, "ChatServer.Join", protocol.JoinArgs{ID: cl.reg.ID, Room: cl.reg.Room, Keep: true}, &h); err != nil {
+			log.Printf("rejoin %s: %v", cl.reg.Room, err)
+		}
+	}
+	cl.setRooms(kept)
+}
+
+// setRooms records the rooms joined besides reg.Room.
+func (cl *chatClient) setRooms(rooms []string) {
+	cl.rooms = rooms
+	cl.recv.multiRoom.Store(len(rooms) > 0)
+}
+
+// catchUp prints what was said after seen, the newest entry this client had
+// shown, e.g. while it was disconnected. Entries already shown, such as ones
+// delivered while catching up, are skipped unless showReplayed is set.
+func (cl *chatClient) catchUp(seen uint64) {
+	if seen == 0 || cl.disabled["catchup"] {
+		return // nothing shown yet to catch up from
+	}
+	var h protocol.HistoryReply
+	if err := callRPC(cl.server, "ChatServer.HistorySince", protocol.SinceArgs{Seq: seen}, &h); err != nil {
+		if isMethodNotFound(err) {
+			cl.disabled["catchup"] = true
+		} else {
+			log.Printf("catch up: %v", err)
+		}
+		return
+	}
+	if h.Last < seen {
+		cl.recv.seen.Store(h.Last) // the room was cleared and numbering started again
+		cl.recv.shown.forget(cl.reg.Room)
+	} else {
+		cl.recv.saw(h.Last)
+	}
+	var missed []string
+	for i, m := range h.Messages {
+		if i < len(h.Seqs) && !cl.recv.shown.add(cl.reg.Room, h.Seqs[i]) && !cl.showReplayed {
+			continue
+		}
+		missed = append(missed, m)
+	}
+	if len(missed) == 0 {
+		return
+	}
+	fmt.Println("--- Missed while disconnected ---")
+	for _, m := range missed {
+		fmt.Println(m)
+	}
+	fmt.Println("---------------------------------")
+}
+
+// send sends one chat message, reconnecting once if the call fails.
+func (cl *chatClient) send(text string) {
+	if cl.throttled() {
+		return
+	}
+	if wait := time.Until(cl.pausedUntil); wait > 0 {
+		// the server asked for a pause: hold this message back rather than drop it
+		fmt.Printf("(server busy, sending in %s)\n", wait.Round(10*time.Millisecond))
+		time.Sleep(wait)
+	}
+	if cl.rec != nil {
+		if err := cl.rec.record(text); err != nil {
+			log.Printf("record: %v", err)
+		}
+	}
+	// send message to server (server will broadcast to others)
+	args := protocol.MessageArgs{Sender: cl.reg.ID, Text: text} // the server adds the sender name
+	if !cl.sendHistory && !cl.disabled["sendack"] {
+		var ack protocol.SendAck
+		err := cl.sendRetrying("ChatServer.SendAck", args, &ack)
+		if !isMethodNotFound(err) {
+			if err == nil {
+				cl.recv.saw(ack.Seq)
+				if ack.Backpressure > 0 {
+					cl.pausedUntil = time.Now().Add(ack.Backpressure)
+					debugf("backpressure: pausing sends for %s", ack.Backpressure)
+				}
+				note := ""
+				if ack.Recipients == 0 {
+					note = "; no one else is here"
+				}
+				fmt.Printf("(sent #%d at %s%s)\n", ack.Seq, ack.Time.Local().Format(time.TimeOnly), note)
+			}
+			return
+		}
+		cl.disabled["sendack"] = true // older server: fall back to Send
+	}
+	var reply protocol.HistoryReply
+	if cl.sendRetrying("ChatServer.Send", args, &reply) != nil {
+		return
+	}
+	// print updated history locally (includes own message)
+	if hidden := len(reply.Messages) - cl.historyMax; cl.historyMax > 0 && hidden > 0 {
+		reply.Messages = reply.Messages[hidden:]
+		fmt.Printf("(%d earlier messages hidden; type 'history' to see them)\n", hidden)
+	}
+	cl.recv.saw(reply.Last)
+	printHistory(reply)
+	if reply.Recipients == 0 {
+		fmt.Println("(no one else is here)")
+	}
+}
+
+// retryPattern finds the wait in a rate limited error, as in
+// "rate limited, retry in 1.2s".
+var retryPattern = regexp.MustCompile(`rate limited, retry in ([0-9.]+(?:ms|s|m))`)
+
+// retryAfter reports how long the server said to wait before sending again,
+// if err is its rate limit refusal.
+func retryAfter(err error) (time.Duration, bool) {
+	if _, ok := err.(rpc.ServerError); !ok {
+		return 0, false
+	}
+	m := retryPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	d, perr := time.ParseDuration(m[1])
+	return d, perr == nil
+}
+
+// sendRetrying is sendRPC for chat messages. When the server refuses one as
+// rate limited, it waits as long as the server says and sends it again, up to
+// autoRetry times; with autoRetry 0 it tells the user once they may send.
+func (cl *chatClient) sendRetrying(method string, args, reply any) error {
+	for attempt := 0; ; attempt++ {
+		err := cl.sendRPC(method, args, reply)
+		wait, limited := retryAfter(err)
+		if !limited {
+			return err
+		}
+		if attempt < cl.autoRetry {
+			fmt.Printf("(rate limited, resending in %s)\n", wait)
+			time.Sleep(wait)
+			continue
+		}
+		if cl.retryNotice != nil {
+			cl.retryNotice.Stop()
+		}
+		cl.retryNotice = time.AfterFunc(wait, func() { cl.in.print("(you can send again)") })
+		return err
+	}
+}
+
+// sendRPC makes a send call, reconnecting and trying once more if the
+// connection failed. Errors are logged, except a missing method, which is
+// only returned so the caller can fall back.
+func (cl *chatClient) sendRPC(method string, args, reply any) error {
+	err := callRPC(cl.server, method, args, reply)
+	if err == nil || isMethodNotFound(err) {
+		return err
+	}
+	log.Printf("send error: %v", err)
+	if _, refused := err.(rpc.ServerError); refused {
+		return err // the server answered, e.g. rate limited; the connection is fine
+	}
+	// try reconnect once
+	if err := cl.reconnect(); err != nil {
+		log.Printf("reconnect failed: %v", err)
+		return err
+	}
+	if err := callRPC(cl.server, method, args, reply); err != nil {
+		log.Printf("send after reconnect failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// close ends the session, however it ends (exit, end of input, a signal), in
+// one order: unregister so the server stops calling back, stop accepting
+// callbacks, drop pending reminders, save input history, finish any
+// recording, close the server connection and restore the terminal. Only the
+// first call does anything.
+func (cl *chatClient) close() {
+	cl.closeOnce.Do(func() {
+		_ = callRPC(cl.server, "ChatServer.Unregister", cl.reg, &struct{}{})
+		cl.listener.Close()
+		if n := cl.reminders.stopAll(); n > 0 {
+			fmt.Printf("(%d pending reminders dropped)\n", n)
+		}
+		if err := cl.in.hist.save(cl.histFile); err != nil {
+			log.Printf("input history: %v", err)
+		}
+		if cl.rec != nil {
+			if err := cl.rec.stop(); err != nil {
+				log.Printf("record: %v", err)
+			}
+		}
+		cl.server.Close()
+		cl.restore()
+		fmt.Println("bye")
+	})
+}
+
+// sendFile sends the contents of path as a binary payload.
+func (cl *chatClient) sendFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("sendfile: %v", err)
+		return
+	}
+	if cl.throttled() {
+		return
+	}
+	args := protocol.MessageArgs{Sender: cl.reg.ID, Data: data, ContentType: http.DetectContentType(data)}
+	var reply protocol.HistoryReply
+	if err := callRPC(cl.server, "ChatServer.Send", args, &reply); err != nil {
+		log.Printf("sendfile: %v", err)
+		return
+	}
+	fmt.Printf("sent %s (%d bytes) to %d recipients\n", args.ContentType, len(data), reply.Recipients)
+}
+
+// sendTable sends spec (see parseTable) as a table message.
+func (cl *chatClient) sendTable(spec string) {
+	if cl.throttled() {
+		return
+	}
+	t := parseTable(spec)
+	args := protocol.MessageArgs{Sender: cl.reg.ID, Kind: "table", Table: &t}
+	var reply protocol.HistoryReply
+	if err := callRPC(cl.server, "ChatServer.Send", args, &reply); err != nil {
+		log.Printf("table: %v", err)
+		return
+	}
+	fmt.Printf("%s\nsent to %d recipients\n", formatTable(t), reply.Recipients)
+}
+
+// reminder is a note to self that the client prints when it falls due.
+type reminder struct {
+	n     int
+	text  string
+	due   time.Time
+	timer *time.Timer
+}
+
+// reminders are kept by the client only, so they survive a reconnect but not
+// a restart, and never reach the server.
+type reminders struct {
+	mu      sync.Mutex
+	next    int
+	pending []*reminder // in the order they were set
+}
+
+// add schedules text to be passed to fire after d and returns its number.
+func (r *reminders) add(d time.Duration, text string, fire func(text string)) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	rem := &reminder{n: r.next, text: text, due: time.Now().Add(d)}
+	rem.timer = time.AfterFunc(d, func() {
+		if r.remove(rem.n) {
+			fire(rem.text)
+		}
+	})
+	r.pending = append(r.pending, rem)
+	return rem.n
+}
+
+// cancel stops reminder n, reporting whether it was still pending.
+func (r *reminders) cancel(n int) bool {
+	r.mu.Lock()
+	var rem *reminder
+	for _, p := range r.pending {
+		if p.n == n {
+			rem = p
+		}
+	}
+	r.mu.Unlock()
+	return rem != nil && rem.timer.Stop() && r.remove(n)
+}
+
+func (r *reminders) remove(n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, p := range r.pending {
+		if p.n == n {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// stopAll cancels every pending reminder and returns how many there were.
+func (r *reminders) stopAll() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.pending {
+		p.timer.Stop()
+	}
+	n := len(r.pending)
+	r.pending = nil
+	return n
+}
+
+func (r *reminders) list() []reminder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]reminder, len(r.pending))
+	for i, p := range r.pending {
+		out[i] = *p
+	}
+	return out
+}
+
+// recorder captures sent messages for -replay, one "<offset>\t<text>" line
+// each, where offset is the time since recording started.
+type recorder struct {
+	f     *os.File
+	start time.Time
+}
+
+// startRecording creates path for a new recording. An existing file is never
+// overwritten: "record" starts a chat line too, and sending one must not
+// truncate whatever it happens to name.
+func startRecording(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%s already exists; record to a new file", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, start: time.Now()}, nil
+}
+
+func (r *recorder) record(text string) error {
+	_, err := fmt.Fprintf(r.f, "%s\t%s\n", time.Since(r.start), text)
+	return err
+}
+
+func (r *recorder) stop() error {
+	return r.f.Close()
+}
+
+// replay re-sends a recorded script, keeping the recorded gaps between
+// messages divided by speed.
+func (cl *chatClient) replay(path string, speed float64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var last time.Duration
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		offText, text, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected <offset>\\t<text>", path, n)
+		}
+		off, err := time.ParseDuration(offText)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if off > last {
+			time.Sleep(time.Duration(float64(off-last) / speed))
+			last = off
+		}
+		cl.send(text)
+	}
+	return scanner.Err()
+}
+
+// showHistory prints a fetched history, asking first when it is larger than
+// historyMax so a huge history doesn't flood the terminal.
+func (cl *chatClient) showHistory(h protocol.HistoryReply) {
+	n := len(h.Messages)
+	if cl.historyMax <= 0 || n <= cl.historyMax {
+		printHistory(h)
+		return
+	}
+	answer, _ := cl.in.readLine(fmt.Sprintf("history has %d messages, show all? [y/N/last %d] ", n, cl.historyMax))
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	switch {
+	case answer == "y" || answer == "yes":
+	case strings.HasPrefix(answer, "last"):
+		last := cl.historyMax
+		if arg := strings.TrimSpace(strings.TrimPrefix(answer, "last")); arg != "" {
+			v, err := strconv.Atoi(arg)
+			if err != nil || v <= 0 {
+				fmt.Println("not a number of messages; showing nothing")
+				return
+			}
+			last = v
+		}
+		if last < n {
+			h.Messages = h.Messages[n-last:]
+		}
+	default:
+		return
+	}
+	printHistory(h)
+}
+
+func printHistory(h protocol.HistoryReply) {
+	fmt.Println("--- Chat history ---")
+	for _, m := range h.Messages {
+		fmt.Println(m)
+	}
+	fmt.Println("--------------------")
+}
+
+// historyCacheMax is the most entries a history cache keeps.
+const historyCacheMax = 1000
+
+// historyCache is one room's history on one server, kept on disk across
+// sessions so 'history' shows at once (and offline) and only entries newer
+// than the cached ones are fetched.
+type historyCache struct {
+	path  string
+	last  uint64 // seq of the newest entry the server had when last synced
+	seqs  []uint64
+	texts []string
+}
+
+// historyCachePath is where the cache of room on the server at addr is kept.
+func historyCachePath(dir, addr, room string) string {
+	return filepath.Join(dir, unsafeInName.ReplaceAllString(room, "_")+"@"+unsafeInName.ReplaceAllString(addr, "_"))
+}
+
+var unsafeInName = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// loadHistoryCache reads the cache at path; a missing or unreadable file is an
+// empty cache.
+func loadHistoryCache(path string) *historyCache {
+	h := &historyCache{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("history cache: %v", err)
+		}
+		return h
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	last, err := strconv.ParseUint(strings.TrimPrefix(lines[0], "last "), 10, 64)
+	if err != nil {
+		log.Printf("history cache %s: bad header %q; starting afresh", path, lines[0])
+		return h
+	}
+	for _, line := range lines[1:] {
+		num, quoted, _ := strings.Cut(line, " ")
+		seq, err1 := strconv.ParseUint(num, 10, 64)
+		text, err2 := strconv.Unquote(quoted)
+		if err1 != nil || err2 != nil {
+			log.Printf("history cache %s: bad entry %q; starting afresh", path, line)
+			return &historyCache{path: path}
+		}
+		h.seqs, h.texts = append(h.seqs, seq), append(h.texts, text)
+	}
+	h.last = last
+	return h
+}
+
+// merge adds the entries of r, a reply to HistorySince(h.last), that aren't
+// cached yet. A Last behind h.last means the server's history was cleared
+// since, and r holds all of it: the cache is dropped in favour of r, and merge
+// reports true.
+func (h *historyCache) merge(r protocol.HistoryReply) (cleared bool) {
+	if r.Last < h.last {
+		h.seqs, h.texts, cleared = nil, nil, true
+	}
+	for i, text := range r.Messages {
+		if i >= len(r.Seqs) {
+			break // a server that doesn't number its replies: nothing to sync from
+		}
+		if n := len(h.seqs); n == 0 || r.Seqs[i] > h.seqs[n-1] {
+			h.seqs, h.texts = append(h.seqs, r.Seqs[i]), append(h.texts, text)
+		}
+	}
+	if extra := len(h.seqs) - historyCacheMax; extra > 0 {
+		h.seqs, h.texts = h.seqs[extra:], h.texts[extra:]
+	}
+	h.last = r.Last
+	return cleared
+}
+
+func (h *historyCache) save() error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "last %d\n", h.last)
+	for i, text := range h.texts {
+		fmt.Fprintf(&b, "%d %s\n", h.seqs[i], strconv.Quote(text))
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(h.path, []byte(b.String()), 0o600)
+}
+
+// reply is the cached history as the server would send it.
+func (h *historyCache) reply() protocol.HistoryReply {
+	return protocol.HistoryReply{Messages: slices.Clone(h.texts), Seqs: slices.Clone(h.seqs), Last: h.last}
+}
+
+// openCache loads the history cache of the room and server in use and brings
+// it up to date, fetching only what is newer than the cached entries.
+func (cl *chatClient) openCache() {
+	if cl.cacheDir == "" {
+		return
+	}
+	cl.cache = loadHistoryCache(historyCachePath(cl.cacheDir, cl.addr, cl.reg.Room))
+	cached := len(cl.cache.texts)
+	if _, err := cl.syncCache(); err != nil {
+		log.Printf("history cache: %v", err)
+		return
+	}
+	if cached > 0 {
+		fmt.Printf("(history of %s: %d messages cached, %d new)\n", cl.reg.Room, cached, max(0, len(cl.cache.texts)-cached))
+	}
+}
+
+// syncCache fetches the entries newer than the cache, saves it and returns
+// its contents. When the server can't be asked, the cache as it is comes back
+// with the error.
+func (cl *chatClient) syncCache() (protocol.HistoryReply, error) {
+	var h protocol.HistoryReply
+	if err := callRPC(cl.server, "ChatServer.HistorySince", protocol.SinceArgs{Seq: cl.cache.last}, &h); err != nil {
+		return cl.cache.reply(), err
+	}
+	if cl.cache.merge(h) {
+		fmt.Printf("(the server's history of %s was cleared; dropped the cached copy)\n", cl.reg.Room)
+	}
+	if err := cl.cache.save(); err != nil {
+		log.Printf("history cache: %v", err)
+	}
+	return cl.cache.reply(), nil
+}
+
+// history fetches the room's history for the history command, through the
+// cache when there is one.
+func (cl *chatClient) history() (protocol.HistoryReply, bool) {
+	if cl.cache == nil || cl.disabled["catchup"] {
+		var h protocol.HistoryReply
+		ok := cl.call("history", "ChatServer.History", struct{}{}, &h)
+		return h, ok
+	}
+	if cl.throttled() {
+		return protocol.HistoryReply{}, false
+	}
+	h, err := cl.syncCache()
+	if isMethodNotFound(err) {
+		cl.disabled["catchup"] = true // no HistorySince: fetch it all
+		return cl.history()
+	}
+	if err != nil {
+		if len(h.Messages) == 0 {
+			log.Printf("history call error: %v", err)
+			return h, false
+		}
+		fmt.Printf("(can't reach the server: %v; showing the cached history)\n", err)
+	}
+	return h, true
+}
+
+// inputHistory is the list of lines entered this session, navigable like a
+// shell history. pos == len(lines) means "past the newest entry".
+type inputHistory struct {
+	lines []string
+	pos   int
+	max   int
+}
+
+func (h *inputHistory) add(line string) {
+	if line != "" && (len(h.lines) == 0 || h.lines[len(h.lines)-1] != line) {
+		h.lines = append(h.lines, line)
+		if h.max > 0 && len(h.lines) > h.max {
+			h.lines = h.lines[len(h.lines)-h.max:]
+		}
+	}
+	h.pos = len(h.lines)
+}
+
+// prev steps back to an older entry; ok is false at the oldest one.
+func (h *inputHistory) prev() (string, bool) {
+	if h.pos == 0 {
+		return "", false
+	}
+	h.pos--
+	return h.lines[h.pos], true
+}
+
+// next steps forward; past the newest entry it returns "" (a fresh line).
+func (h *inputHistory) next() (string, bool) {
+	if h.pos >= len(h.lines) {
+		return "", false
+	}
+	h.pos++
+	if h.pos == len(h.lines) {
+		return "", true
+	}
+	return h.lines[h.pos], true
+}
+
+func loadInputHistory(path string, max int) *inputHistory {
+	h := &inputHistory{max: max}
+	if path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				h.add(line)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("input history: %v", err)
+		}
+	}
+	h.pos = len(h.lines)
+	return h
+}
+
+func (h *inputHistory) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strings.Join(h.lines, "\n")+"\n"), 0o600)
+}
+
+// lineEditor reads input lines. On a terminal it switches the tty to cbreak
+// mode (via stty) and edits the line itself, so up/down can recall earlier
+// lines and incoming messages can redraw the partly typed line. Otherwise it
+// reads plain lines.
+type lineEditor struct {
+	in   *bufio.Reader
+	tty  bool
+	hist *inputHistory
+
+	mu     sync.Mutex // guards prompt, buf, draft and next, also used for redraws from Receive
+	prompt string
+	buf    []rune
+	draft  string // text put aside with Ctrl-X or 'draft save'
+	next   string // text the next readLine starts with
+}
+
+func newLineEditor(hist *inputHistory) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(os.Stdin), hist: hist}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		e.tty = true
+	}
+	return e
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// start enters cbreak mode and returns a function restoring the terminal.
+// If stty is unavailable the editor falls back to plain line reads.
+func (e *lineEditor) start() (restore func()) {
+	if !e.tty {
+		return func() {}
+	}
+	saved, err := stty("-g")
+	if err == nil {
+		_, err = stty("-icanon", "-echo", "min", "1")
+	}
+	if err != nil {
+		debugf("stty: %v; line editing disabled", err)
+		e.tty = false
+		return func() {}
+	}
+	return func() { stty(saved) }
+}
+
+// print writes asynchronous output (an incoming message) above the line being
+// typed, then redraws the prompt and the partial input.
+func (e *lineEditor) print(text string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.tty {
+		fmt.Printf("\n%s\n%s", text, e.prompt)
+		return
+	}
+	fmt.Printf("\r\033[K%s\n%s%s", text, e.prompt, string(e.buf))
+}
+
+func (e *lineEditor) setLine(line string) {
+	e.buf = []rune(line)
+	fmt.Printf("\r\033[K%s%s", e.prompt, line)
+}
+
+// saveDraft puts text aside until takeDraft.
+func (e *lineEditor) saveDraft(text string) {
+	e.mu.Lock()
+	e.draft = text
+	e.mu.Unlock()
+}
+
+// takeDraft returns the draft and clears it. On a terminal the draft is also
+// put back on the next input line for editing.
+func (e *lineEditor) takeDraft() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	d := e.draft
+	e.draft = ""
+	if e.tty {
+		e.next = d
+	}
+	return d, d != ""
+}
+
+// readLine prints prompt and reads one line without its newline.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	e.mu.Lock()
+	e.prompt, e.buf = prompt, append(e.buf[:0], []rune(e.next)...)
+	fmt.Print(prompt + e.next)
+	e.next = ""
+	e.mu.Unlock()
+
+	if !e.tty {
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		e.mu.Lock()
+		switch {
+		case r == '\n' || r == '\r':
+			line := string(e.buf)
+			e.buf, e.prompt = e.buf[:0], ""
+			fmt.Print("\n")
+			e.mu.Unlock()
+			return line, nil
+		case r == 4 && len(e.buf) == 0: // Ctrl-D on an empty line
+			e.mu.Unlock()
+			return "", io.EOF
+		case r == 24 && len(e.buf) > 0: // Ctrl-X: put the line aside, e.g. to type a command first
+			e.draft, e.buf = string(e.buf), e.buf[:0]
+			fmt.Printf("\r\033[K(draft saved; type 'draft' to get it back)\n%s", e.prompt)
+		case r == 127 || r == '\b':
+			if len(e.buf) > 0 {
+				e.buf = e.buf[:len(e.buf)-1]
+				fmt.Print("\b \b")
+			}
+		case r == 27: // escape sequence: arrows are ESC [ A..D
+			// A terminal writes a whole sequence at once, so one that has
+			// nothing after it yet is the Esc key alone: ignore it rather
+			// than wait for the next key.
+			if e.in.Buffered() == 0 {
+				break
+			}
+			if next, _ := e.in.Peek(1); next[0] != '[' {
+				break // Esc then another key, also already typed
+			}
+			e.in.ReadRune() // the '['
+			e.mu.Unlock()
+			b2, _, _ := e.in.ReadRune()
+			e.mu.Lock()
+			var line string
+			ok := false
+			switch b2 {
+			case 'A':
+				line, ok = e.hist.prev()
+			case 'B':
+				line, ok = e.hist.next()
+			}
+			if ok {
+				e.setLine(line)
+			}
+		case unicode.IsPrint(r):
+			e.buf = append(e.buf, r)
+			fmt.Print(string(r))
+		}
+		e.mu.Unlock()
+	}
+}
+
+// lineRead is one result of a read.
+type lineRead struct {
+	line string
+	err  error
+}
+
+// readLines calls read on a goroutine of its own, so the caller can wait for
+// a line and for other events at once. Each call of the returned function
+// starts one read and returns where its result will arrive; read is never
+// called again before that, so the caller may read input itself meanwhile
+// (e.g. to ask a question).
+func readLines(read func() (string, error)) func() <-chan lineRead {
+	more := make(chan struct{})
+	lines := make(chan lineRead, 1)
+	go func() {
+		for range more {
+			line, err := read()
+			lines <- lineRead{line, err}
+		}
+	}()
+	return func() <-chan lineRead {
+		more <- struct{}{}
+		return lines
+	}
+}
+
+// setting is one "flag = value" line of ~/.dschatrc or a saved session.
+type setting struct {
+	line       int
+	key, value string
+}
+
+// readSettings parses the "flag = value" lines in path. Blank lines and lines
+// starting with # are ignored; malformed lines are reported and skipped.
+func readSettings(path string) ([]setting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings []setting
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			log.Printf("%s:%d: expected flag = value", path, n+1)
+			continue
+		}
+		key = strings.TrimPrefix(strings.TrimSpace(key), "-")
+		settings = append(settings, setting{line: n + 1, key: key, value: strings.TrimSpace(value)})
+	}
+	return settings, nil
+}
+
+// loadDotfile returns the settings in path. A missing file is fine.
+func loadDotfile(path string) []setting {
+	settings, err := readSettings(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("%s: %v (using defaults)", path, err)
+		}
+		return nil
+	}
+	return settings
+}
+
+// applyStartup fills in the flags in fs not given on the command line: first
+// from the session named by -session or by a session line in the dotfile, then
+// from the dotfile's own settings. fs must already be parsed.
+func applyStartup(fs *flag.FlagSet, dotfile string, dot []setting) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	name := fs.Lookup("session").Value.String()
+	if !given["session"] {
+		for _, s := range dot {
+			if s.key == "session" {
+				name = s.value
+			}
+		}
+	}
+	if name != "" {
+		settings, err := readSession(name)
+		if err != nil {
+			return err
+		}
+		applySettings(fs, "session "+name, settings, given)
+		for _, s := range settings {
+			given[s.key] = true
+		}
+	}
+	applySettings(fs, dotfile, dot, given)
+	return nil
+}
+
+// applySettings sets each flag in settings that is not in given, read from
+// source for error messages. The session to start is chosen before this, so a
+// session key is skipped.
+func applySettings(fs *flag.FlagSet, source string, settings []setting, given map[string]bool) {
+	for _, s := range settings {
+		if s.key == "session" || given[s.key] {
+			continue
+		}
+		if err := fs.Set(s.key, s.value); err != nil {
+			log.Printf("%s:%d: %v", source, s.line, err)
+		}
+	}
+}
+
+// sessionPath is where the session called name is saved.
+func sessionPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("bad session name %q", name)
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dschat", "sessions", name), nil
+}
+
+// readSession returns the settings saved as session name.
+func readSession(name string) ([]setting, error) {
+	path, err := sessionPath(name)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := readSettings(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no saved session %q", name)
+	}
+	return settings, err
+}
+
+// saveSession saves the server, name, room, limits and quietjoins in use as
+// session name, in the same format as ~/.dschatrc. That is all of this
+// client's per-user state: it has no aliases, mutes or filters to save.
+func (cl *chatClient) saveSession(name string) (string, error) {
+	path, err := sessionPath(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	body := fmt.Sprintf("# dschat session %q, saved %s\naddr = %s\nname = %s\nroom = %s\nhistorymax = %d\nmaxcmds = %g\nquietjoins = %t\n",
+		name, time.Now().Format(time.DateTime), cl.addr, cl.reg.ID, cl.reg.Room, cl.historyMax, cl.limit.rate, cl.recv.quietJoins.Load())
+	return path, os.WriteFile(path, []byte(body), 0o644)
+}
+
+// loadSession applies session name. Limits change at once and a different room
+// is joined; a different server or name means leaving this server and
+// registering again.
+func (cl *chatClient) loadSession(name string) error {
+	settings, err := readSession(name)
+	if err != nil {
+		return err
+	}
+	addr, id, room := cl.addr, cl.reg.ID, cl.reg.Room
+	for _, s := range settings {
+		switch s.key {
+		case "addr":
+			addr = s.value
+		case "name":
+			id = s.value
+		case "room":
+			room = s.value
+		case "historymax":
+			if n, err := strconv.Atoi(s.value); err == nil {
+				cl.historyMax = n
+			}
+		case "maxcmds":
+			if r, err := strconv.ParseFloat(s.value, 64); err == nil {
+				cl.limit = newThrottle(r)
+			}
+		case "quietjoins":
+			if on, err := strconv.ParseBool(s.value); err == nil {
+				cl.recv.quietJoins.Store(on)
+			}
+		default:
+			fmt.Printf("session %s: %s only takes effect at startup (-session %s)\n", name, s.key, name)
+		}
+	}
+	if addr == cl.addr && id == cl.reg.ID {
+		if room != cl.reg.Room {
+			return cl.join(room)
+		}
+		return nil
+	}
+	oldRoom := cl.reg.Room
+	cl.reg.Room = room
+	if err := cl.switchTo(addr, id); err != nil {
+		cl.reg.Room = oldRoom
+		return err
+	}
+	return nil
+}
+
+// addRoom joins room as well as the rooms this client is in, makes it the one
+// sent to, and shows its history.
+func (cl *chatClient) addRoom(room string) error {
+	var h protocol.HistoryReply
+	err := callRPC(cl.server, "ChatServer.Join", protocol.JoinArgs{ID: cl.reg.ID, Room: room, Token: cl.adminToken, Keep: true}, &h)
+	if err != nil {
+		return err
+	}
+	if room != cl.reg.Room {
+		rooms := slices.DeleteFunc(cl.rooms, func(r string) bool { return r == room })
+		cl.setRooms(append(rooms, cl.reg.Room))
+		cl.reg.Room = room // reconnects register in this room and rejoin the others
+	}
+	fmt.Printf("now sending to room %s; also in %s\n", room, strings.Join(cl.rooms, ", "))
+	cl.recv.seen.Store(h.Last)
+	cl.recv.shown.forget(room)
+	cl.openCache()
+	cl.showHistory(h)
+	return nil
+}
+
+// join moves this client to room and shows the room's history.
+func (cl *chatClient) join(room string) error {
+	if cl.disabled["join"] {
+		return errors.New("this server doesn't support rooms")
+	}
+	var h protocol.HistoryReply
+	err := callRPC(cl.server, "ChatServer.Join", protocol.JoinArgs{ID: cl.reg.ID, Room: room, Token: cl.adminToken}, &h)
+	if isMethodNotFound(err) {
+		cl.disabled["join"] = true
+		return errors.New("this server doesn't support rooms")
+	}
+	if err != nil {
+		return err
+	}
+	cl.reg.Room = room // reconnects rejoin this room
+	cl.setRooms(slices.DeleteFunc(cl.rooms, func(r string) bool { return r == room }))
+	fmt.Printf("now in room %s\n", room)
+	cl.recv.seen.Store(h.Last) // sequence numbers are per room
+	cl.recv.shown.forget(room) // and it may have been cleared since we were last in it
+	cl.openCache()
+	cl.showHistory(h)
+	return nil
+}
+
+// switchTo leaves the current server and registers as id at addr, going back
+// to the previous server and name if that fails.
+func (cl *chatClient) switchTo(addr, id string) error {
+	_ = callRPC(cl.server, "ChatServer.Unregister", cl.reg, &struct{}{})
+	oldAddr, oldID, oldSeen, oldRooms := cl.addr, cl.reg.ID, cl.recv.seen.Load(), cl.rooms
+	cl.addr, cl.reg.ID = addr, id
+	cl.recv.seen.Store(0) // sequence numbers are per server
+	if addr != oldAddr {
+		cl.setRooms(nil) // and so are rooms
+	}
+	if err := cl.reconnect(); err != nil {
+		cl.addr, cl.reg.ID = oldAddr, oldID
+		cl.recv.seen.Store(oldSeen)
+		cl.setRooms(oldRooms)
+		if err2 := cl.reconnect(); err2 != nil {
+			return fmt.Errorf("%w (and rejoining %s failed: %v)", err, oldAddr, err2)
+		}
+		return err
+	}
+	cl.disabled = make(map[string]bool)
+	cl.recv.mentions.setName(id)
+	cl.hello()
+	if addr != oldAddr {
+		cl.openCache()
+	}
+	return nil
+}
+
+// hello asks the server for its version.
+func (cl *chatClient) hello() {
+	// servers predating Hello simply report an unknown version
+	cl.serverVersion = "unknown"
+	var hello protocol.HelloReply
+	if err := callRPC(cl.server, "ChatServer.Hello", struct{}{}, &hello); err == nil {
+		cl.serverVersion = hello.Version
+	} else if isMethodNotFound(err) {
+		cl.serverVersion = "unknown (predates version reporting)"
+	}
+}
+
+func main() {
+	serverAddr := flag.String("addr", "127.0.0.1:1234", "server address")
+	name := flag.String("name", "anon", "your display name")
+	replayPath := flag.String("replay", "", "send the messages in a script made by 'record', then exit")
+	authToken := flag.String("token", "", "shared secret the server requires to join, if it sets -token")
+	adminToken := flag.String("admintoken", "", "admin token for admin commands such as inspect")
+	histFile := flag.String("histfile", "", "file to keep input history in across sessions (empty = this session only)")
+	debugFlag := flag.Bool("debug", false, "trace RPCs, reconnects and deliveries to stderr (toggle later with 'debug on|off')")
+	historyMax := flag.Int("historymax", 200, "ask before printing a history longer than this (0 = never ask)")
+	maxCmds := flag.Float64("maxcmds", 5, "most messages/commands sent to the server per second (0 = unlimited)")
+	speed := flag.Float64("speed", 1, "replay speed factor (2 = twice as fast)")
+	sendHistory := flag.Bool("sendhistory", false, "print the whole history after each message sent instead of a one-line acknowledgement")
+	useTLS := flag.Bool("tls", false, "connect to the server over TLS (implied by -tlsca and -tlsname)")
+	flag.BoolVar(&startTLS, "starttls", false, "connect in plain TCP and upgrade to TLS with StartTLS, for servers run with -starttls (implies -tls)")
+	tlsCA := flag.String("tlsca", "", "CA file the server's certificate must chain to (empty = system roots)")
+	tlsName := flag.String("tlsname", "", "name expected in the server's certificate (empty = the host in -addr)")
+	roomName := flag.String("room", "general", "room to join (switch later with 'join ROOM')")
+	flag.String("session", "", "start with the settings saved by 'session save NAME' (other flags still win)")
+	autoRetry := flag.Int("autoretry", 0, "resend a rate-limited message up to this many times, after the wait the server gives (0 = just say when you can send again)")
+	cacheDir, _ := os.UserCacheDir()
+	if cacheDir != "" {
+		cacheDir = filepath.Join(cacheDir, "dschat", "history")
+	}
+	historyCache := flag.String("historycache", cacheDir, "directory to cache each room's history in across sessions, so 'history' fetches only what is new (empty = no cache)")
+	dedup := flag.Bool("dedup", true, "when catching up after a reconnect, skip messages already shown")
+	quietJoins := flag.Bool("quietjoins", false, "hide join and leave notices (toggle later with 'quietjoins')")
+	var dotfile string
+	var dotSettings []setting
+	if home, err := os.UserHomeDir(); err == nil {
+		dotfile = filepath.Join(home, ".dschatrc")
+		dotSettings = loadDotfile(dotfile)
+	}
+	flag.Parse()
+	if err := applyStartup(flag.CommandLine, dotfile, dotSettings); err != nil {
+		log.Fatalf("session: %v", err)
+	}
+	if *speed <= 0 {
+		log.Fatalf("-speed must be positive")
+	}
+	debug.Store(*debugFlag)
+
+	// start a small RPC server for receiving broadcasts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("client listen: %v", err)
+	}
+	var certHash string
+	if *useTLS || startTLS || *tlsCA != "" || *tlsName != "" {
+		if serverTLS, err = clientTLS(*tlsCA, *tlsName); err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+		cert, hash, err := callbackCert()
+		if err != nil {
+			log.Fatalf("tls callback certificate: %v", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		certHash = hash
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("nonce: %v", err)
+	}
+	editor := newLineEditor(loadInputHistory(*histFile, 500))
+	clientRPC := &ClientRPC{id: *name, nonce: hex.EncodeToString(nonce), links: &linkRegistry{}, out: editor,
+		echoes: make(chan string, 1), mentions: newMentionLog(*name)}
+	clientRPC.quietJoins.Store(*quietJoins)
+	if err := rpc.RegisterName("Client", clientRPC); err != nil {
+		log.Fatalf("register client rpc: %v", err)
+	}
+	go func() { // serve callbacks until close shuts the listener
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("callback listener: %v", err)
+				}
+				return
+			}
+			go rpc.ServeConn(conn)
+		}
+	}()
+
+	localAddr := listener.Addr().String()
+
+	// connect to central server and register
+	server, err := dialWithRetry(*serverAddr)
+	if err != nil {
+		log.Fatalf("cannot connect to server: %v", err)
+	}
+	cl := &chatClient{
+		server:       server,
+		addr:         *serverAddr,
+		reg:          protocol.RegisterArgs{ID: *name, Addr: localAddr, Nonce: clientRPC.nonce, Room: *roomName, CertHash: certHash, Token: *authToken, AdminToken: *adminToken},
+		disabled:     make(map[string]bool),
+		in:           editor,
+		recv:         clientRPC,
+		listener:     listener,
+		histFile:     *histFile,
+		restore:      func() {},
+		historyMax:   *historyMax,
+		limit:        newThrottle(*maxCmds),
+		sendHistory:  *sendHistory,
+		showReplayed: !*dedup,
+		autoRetry:    *autoRetry,
+		cacheDir:     *historyCache,
+		adminToken:   *adminToken,
+	}
+	cl.hello()
+	// register (server will dial back to our local RPC)
+	for {
+		err := callRPC(cl.server, "ChatServer.Register", cl.reg, &struct{}{})
+		if err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), "already in use") {
+			log.Fatalf("register failed: %v", err)
+		}
+		answer, rerr := cl.in.readLine(fmt.Sprintf("%v; choose another name (empty to quit): ", err))
+		if answer = strings.TrimSpace(answer); rerr != nil || answer == "" {
+			os.Exit(1)
+		}
+		cl.reg.ID = answer
+	}
+	clientRPC.mentions.setName(cl.reg.ID)
+	cl.openCache()
+
+	if *replayPath != "" {
+		if err := cl.replay(*replayPath, *speed); err != nil {
+			log.Printf("replay: %v", err)
+		}
+		cl.close()
+		return
+	}
+	fmt.Printf("Connected to %s as %s in room %s. Type messages and press Enter. Type 'history' to fetch history, 'reconnect' to re-establish the connection, 'exit' to quit.\n", *serverAddr, cl.reg.ID, cl.reg.Room)
+
+	cl.restore = cl.in.start()
+	// Ctrl-C leaves the same way as exit; the terminal would otherwise stay in
+	// cbreak mode. The loop below tears down, so nothing else is using cl then.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	next := readLines(func() (string, error) { return cl.in.readLine("> ") })
+	for {
+		var line string
+		var err error
+		select {
+		case r := <-next():
+			line, err = r.line, r.err
+		case <-sigs:
+			cl.close()
+			os.Exit(130)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("read error: %v", err)
+			}
+			break
+		}
+		text := strings.TrimSpace(line)
+		cl.in.hist.add(text)
+		if text == "exit" {
+			break
+		}
+		if arg, ok := strings.CutPrefix(text, "debug"); ok && (arg == "" || arg[0] == ' ') {
+			switch strings.TrimSpace(arg) {
+			case "on":
+				debug.Store(true)
+			case "off":
+				debug.Store(false)
+			case "":
+			default:
+				fmt.Println("usage: debug on|off")
+				continue
+			}
+			if debug.Load() {
+				fmt.Println("debug output is on")
+			} else {
+				fmt.Println("debug output is off")
+			}
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "quietjoins"); ok && (arg == "" || arg[0] == ' ') {
+			switch strings.TrimSpace(arg) {
+			case "on":
+				clientRPC.quietJoins.Store(true)
+			case "off":
+				clientRPC.quietJoins.Store(false)
+			case "":
+				clientRPC.quietJoins.Store(!clientRPC.quietJoins.Load())
+			default:
+				fmt.Println("usage: quietjoins [on|off]")
+				continue
+			}
+			if clientRPC.quietJoins.Load() {
+				fmt.Println("join and leave notices are hidden")
+			} else {
+				fmt.Println("join and leave notices are shown")
+			}
+			continue
+		}
+		if text == "version" {
+			fmt.Printf("client %s, server %s\n", Version, cl.serverVersion)
+			continue
+		}
+		if text == "reconnect" {
+			fmt.Println("reconnecting...")
+			if err := cl.reconnect(); err != nil {
+				log.Printf("reconnect failed: %v", err)
+				continue
+			}
+			fmt.Printf("reconnected to %s as %s\n", cl.addr, cl.reg.ID)
+			continue
+		}
+		if text == "history" {
+			h, ok := cl.history()
+			if !ok {
+				continue
+			}
+			cl.recv.saw(h.Last)
+			cl.showHistory(h)
+			continue
+		}
+		if target, ok := strings.CutPrefix(text, "inspect "); ok {
+			var r protocol.InspectReply
+			if !cl.call("inspect", "ChatServer.Inspect", protocol.InspectArgs{Token: *adminToken, Target: strings.TrimSpace(target)}, &r) {
+				continue
+			}
+			fmt.Printf("--- %s ---\n", r.ID)
+			fmt.Printf("address:     %s\n", r.Addr)
+			fmt.Printf("connected:   %s\n", r.Connected.Local().Format(time.DateTime))
+			fmt.Printf("last active: %s\n", r.LastActive.Local().Format(time.DateTime))
+			fmt.Printf("sent:        %d messages\n", r.MessagesSent)
+			fmt.Printf("queue lag:   %d deliveries\n", r.QueueLag)
+			if r.Room != "" {
+				fmt.Printf("room:        %s\n", r.Room)
+			}
+			continue
+		}
+		if room, ok := strings.CutPrefix(text, "join "); ok {
+			if err := cl.join(strings.TrimSpace(room)); err != nil {
+				log.Printf("join: %v", err)
+			}
+			continue
+		}
+		if room, ok := strings.CutPrefix(text, "addroom "); ok {
+			if err := cl.addRoom(strings.TrimSpace(room)); err != nil {
+				log.Printf("addroom: %v", err)
+			}
+			continue
+		}
+		if room, ok := strings.CutPrefix(text, "part "); ok {
+			room = strings.TrimSpace(room)
+			if !cl.call("part", "ChatServer.Part", protocol.JoinArgs{ID: cl.reg.ID, Room: room}, &struct{}{}) {
+				continue
+			}
+			cl.setRooms(slices.DeleteFunc(cl.rooms, func(r string) bool { return r == room }))
+			fmt.Printf("left room %s\n", room)
+			continue
+		}
+		if newID, ok := strings.CutPrefix(text, "nick "); ok {
+			newID = strings.TrimSpace(newID)
+			if !cl.call("nick", "ChatServer.Rename", protocol.RenameArgs{ID: cl.reg.ID, NewID: newID}, &struct{}{}) {
+				continue
+			}
+			cl.reg.ID = newID // reconnects register under the new name
+			cl.recv.mentions.setName(newID)
+			fmt.Printf("you are now known as %s\n", newID)
+			continue
+		}
+		if text == "draft" {
+			d, ok := cl.in.takeDraft()
+			switch {
+			case !ok:
+				fmt.Println("no draft saved")
+			case !cl.in.tty:
+				fmt.Printf("draft: %s\n", d) // no line editing to put it back into
+			}
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "draft save "); ok {
+			cl.in.saveDraft(strings.TrimSpace(arg))
+			fmt.Println("draft saved; type 'draft' to get it back")
+			continue
+		}
+		if text == "mentions" {
+			n, recent := cl.recv.mentions.take()
+			if n == 0 {
+				fmt.Println("no new mentions")
+				continue
+			}
+			fmt.Printf("--- %d new mentions ---\n", n)
+			if hidden := n - len(recent); hidden > 0 {
+				fmt.Printf("(%d older ones not kept)\n", hidden)
+			}
+			for _, m := range recent {
+				fmt.Printf("%s  %s\n", m.At.Format(time.TimeOnly), m.Preview)
+			}
+			fmt.Println("----------------------")
+			continue
+		}
+		if text == "selftest" {
+			cl.selftest()
+			continue
+		}
+		if text == "forgetme" {
+			answer, _ := cl.in.readLine("delete all your messages from the server's history? [y/N] ")
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				continue
+			}
+			var r protocol.ForgetReply
+			if !cl.call("forgetme", "ChatServer.ForgetMe", protocol.ForgetArgs{ID: cl.reg.ID}, &r) {
+				continue
+			}
+			fmt.Printf("removed %d of your messages\n", r.Removed)
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "delmine "); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || n <= 0 {
+				fmt.Println("usage: delmine N (N > 0)")
+				continue
+			}
+			var r protocol.ForgetReply
+			if !cl.call("delmine", "ChatServer.DeleteMine", protocol.DeleteMineArgs{Sender: cl.reg.ID, Count: n}, &r) {
+				continue
+			}
+			fmt.Printf("deleted %d of your messages\n", r.Removed)
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "session "); ok {
+			verb, name, _ := strings.Cut(strings.TrimSpace(arg), " ")
+			name = strings.TrimSpace(name)
+			switch verb {
+			case "save":
+				path, err := cl.saveSession(name)
+				if err != nil {
+					log.Printf("session save: %v", err)
+					continue
+				}
+				fmt.Printf("saved session %s to %s\n", name, path)
+			case "load":
+				if err := cl.loadSession(name); err != nil {
+					log.Printf("session load: %v", err)
+					continue
+				}
+				fmt.Printf("loaded session %s: %s as %s\n", name, cl.addr, cl.reg.ID)
+			default:
+				fmt.Println("usage: session save|load NAME")
+			}
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "msg "); ok {
+			to, body, _ := strings.Cut(strings.TrimSpace(arg), " ")
+			if to == "" || strings.TrimSpace(body) == "" {
+				fmt.Println("usage: msg USER TEXT")
+				continue
+			}
+			args := protocol.PrivateArgs{Msg: protocol.MessageArgs{Sender: cl.reg.ID, Text: strings.TrimSpace(body)}, To: to}
+			cl.call("msg", "ChatServer.SendPrivate", args, &struct{}{})
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "roledm "); ok {
+			role, body, _ := strings.Cut(strings.TrimSpace(arg), " ")
+			if role == "" || strings.TrimSpace(body) == "" {
+				fmt.Println("usage: roledm ROLE TEXT")
+				continue
+			}
+			args := protocol.RoleDMArgs{Msg: protocol.MessageArgs{Sender: cl.reg.ID, Text: strings.TrimSpace(body)}, Role: role, Token: cl.adminToken}
+			cl.call("roledm", "ChatServer.RoleDM", args, &struct{}{})
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "role "); ok {
+			f := strings.Fields(arg)
+			if len(f) != 3 || f[0] != "add" && f[0] != "remove" {
+				fmt.Println("usage: role add|remove ROLE USER")
+				continue
+			}
+			args := protocol.RoleArgs{Token: cl.adminToken, Role: f[1], Target: f[2], Remove: f[0] == "remove"}
+			if !cl.call("role", "ChatServer.SetRole", args, &struct{}{}) {
+				continue
+			}
+			if args.Remove {
+				fmt.Printf("took role %s from %s\n", f[1], f[2])
+			} else {
+				fmt.Printf("gave role %s to %s\n", f[1], f[2])
+			}
+			continue
+		}
+		if text == "roles" {
+			var r protocol.RolesReply
+			if !cl.call("roles", "ChatServer.Roles", struct{}{}, &r) {
+				continue
+			}
+			if len(r.Roles) == 0 {
+				fmt.Println("(no roles given)")
+			}
+			names := make([]string, 0, len(r.Roles))
+			for role := range r.Roles {
+				names = append(names, role)
+			}
+			slices.Sort(names)
+			for _, role := range names {
+				fmt.Printf("%-10s %s\n", role, strings.Join(r.Roles[role], ", "))
+			}
+			continue
+		}
+		if text == "serverconfig" {
+			var r protocol.ConfigReply
+			if !cl.call("serverconfig", "ChatServer.GetConfig", struct{}{}, &r) {
+				continue
+			}
+			quota := "off"
+			if r.ByteQuota > 0 {
+				quota = fmt.Sprintf("%d bytes per %s", r.ByteQuota, r.ByteWindow)
+			}
+			emptyRoom := "retain history"
+			if r.ClearWhenEmpty {
+				emptyRoom = "clear history"
+			}
+			fmt.Println("--- Server configuration ---")
+			fmt.Printf("version:         %s\n", r.Version)
+			fmt.Printf("delivery:        %s (timeout %s)\n", r.Delivery, r.DeliverTimeout)
+			if r.Workers > 0 {
+				fmt.Printf("workers:         %d\n", r.Workers)
+			}
+			fmt.Printf("queue full wait: %s, then broadcasts are dropped\n", r.EnqueueWait)
+			if r.Backpressure > 0 {
+				fmt.Printf("backpressure:    from %.0f%% queue fill\n", r.Backpressure*100)
+			} else {
+				fmt.Println("backpressure:    off")
+			}
+			fmt.Printf("history:         %d entries max (0 = unlimited), saved to disk: %t\n", r.MaxHistory, r.Persistent)
+			fmt.Printf("timestamps:      %q\n", r.TimeFormat)
+			fmt.Printf("max message:     %d characters (0 = no limit)\n", r.MaxLen)
+			fmt.Printf("max payload:     %d bytes\n", r.MaxBlob)
+			fmt.Printf("send rate:       %g/s, bursts of %g (0 = unlimited)\n", r.SendRate, r.SendBurst)
+			if r.SendGrace > 0 {
+				fmt.Printf("burst grace:     %g more, delayed %s more each, up to %s\n", r.SendGrace, r.GraceDelay, r.GraceDelayMax)
+			}
+			if r.FloodPenalties != "" {
+				fmt.Printf("flood penalties: %s (one forgiven per %s)\n", r.FloodPenalties, r.OffenseDecay)
+			}
+			fmt.Printf("byte quota:      %s\n", quota)
+			fmt.Printf("registrations:   %d per %s per name (0 = unlimited)\n", r.RegLimit, r.RegWindow)
+			fmt.Printf("announce joins:  %t (leave grace %s)\n", r.AnnounceJoins, r.LeaveGrace)
+			fmt.Printf("empty room:      %s\n", emptyRoom)
+			if r.RoomCreate != "" {
+				fmt.Printf("room creation:   %s, at most %d rooms (0 = no limit)\n", r.RoomCreate, r.MaxRooms)
+			}
+			fmt.Printf("macros:          %t\n", r.Macros)
+			fmt.Printf("name similarity: %s\n", r.NameSimilarity)
+			fmt.Printf("dial timeout:    %s\n", r.DialTimeout)
+			fmt.Printf("slow start:      %s\n", r.SlowStart)
+			fmt.Printf("peers:           %d\n", r.Peers)
+			fmt.Printf("admin commands:  %t\n", r.AdminEnabled)
+			fmt.Printf("token required:  %t\n", r.AuthRequired)
+			fmt.Printf("tls:             %t\n", r.TLS)
+			if r.StartTLS != "" {
+				fmt.Printf("starttls:        %s\n", r.StartTLS)
+			}
+			fmt.Println("----------------------------")
+			continue
+		}
+		if text == "stats" {
+			var r protocol.StatsReply
+			if !cl.call("stats", "ChatServer.Stats", struct{}{}, &r) {
+				continue
+			}
+			fmt.Println("--- Server stats ---")
+			fmt.Printf("clients:  %d\n", r.Clients)
+			fmt.Printf("stored:   %d messages\n", r.Stored)
+			fmt.Printf("sent:     %d since start\n", r.Sent)
+			if r.PersistErrors > 0 {
+				fmt.Printf("unsaved:  %d failed writes to the history file\n", r.PersistErrors)
+			}
+			fmt.Printf("uptime:   %s\n", r.Uptime.Round(time.Second))
+			fmt.Println("--------------------")
+			continue
+		}
+		if text == "audit" {
+			var r protocol.AuditReply
+			if !cl.call("audit", "ChatServer.AuditLog", protocol.AdminArgs{Token: *adminToken}, &r) {
+				continue
+			}
+			fmt.Println("--- Audit log ---")
+			for _, e := range r.Entries {
+				line := fmt.Sprintf("%4d %s  %s %s", e.Seq, e.Time.Local().Format(time.DateTime), e.Actor, e.Action)
+				if e.Target != "" {
+					line += " " + e.Target
+				}
+				if e.Detail != "" {
+					line += ": " + e.Detail
+				}
+				fmt.Println(line)
+			}
+			if r.Intact {
+				fmt.Printf("--- %d entries, chain intact ---\n", len(r.Entries))
+			} else {
+				fmt.Printf("--- %d entries, CHAIN BROKEN: the log was edited or truncated ---\n", len(r.Entries))
+			}
+			continue
+		}
+		if text == "announcements" {
+			var r protocol.AnnouncementsReply
+			if !cl.call("announcements", "ChatServer.Announcements", struct{}{}, &r) {
+				continue
+			}
+			fmt.Println("--- Announcements ---")
+			for _, a := range r.Announcements {
+				until := ""
+				if !a.Expires.IsZero() {
+					until = " (until " + a.Expires.Local().Format(time.DateTime) + ")"
+				}
+				fmt.Printf("%s  %s%s\n", a.Posted.Local().Format(time.DateTime), a.Text, until)
+			}
+			fmt.Println("---------------------")
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "announce "); ok {
+			args := protocol.AnnouncementArgs{Token: *adminToken, Text: strings.TrimSpace(arg)}
+			if first, rest, ok := strings.Cut(args.Text, " "); ok {
+				if ttl, err := time.ParseDuration(first); err == nil && ttl > 0 {
+					args.TTL, args.Text = ttl, strings.TrimSpace(rest)
+				}
+			}
+			if cl.call("announce", "ChatServer.PostAnnouncement", args, &struct{}{}) {
+				fmt.Println("announcement posted")
+			}
+			continue
+		}
+		if text == "list" {
+			var r protocol.ListUsersReply
+			if !cl.call("list", "ChatServer.ListUsers", struct{}{}, &r) {
+				continue
+			}
+			fmt.Println("--- Online ---")
+			for _, id := range r.Users {
+				fmt.Println(id)
+			}
+			fmt.Println("--------------")
+			continue
+		}
+		if text == "online" {
+			users := clientRPC.onlineUsers()
+			if users == nil {
+				fmt.Println("no user list from the server yet; try 'list'")
+				continue
+			}
+			fmt.Printf("--- Online (%d) ---\n", len(users))
+			for _, id := range users {
+				fmt.Println(id)
+			}
+			fmt.Println("------------------")
+			continue
+		}
+		if text == "recentleft" {
+			var r protocol.RecentLeftReply
+			if !cl.call("recentleft", "ChatServer.RecentlyLeft", struct{}{}, &r) {
+				continue
+			}
+			fmt.Println("--- Recently left ---")
+			for _, u := range r.Users {
+				fmt.Printf("%s  %s\n", u.At.Local().Format("15:04:05"), u.ID)
+			}
+			fmt.Println("---------------------")
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "remind "); ok {
+			when, note, _ := strings.Cut(strings.TrimSpace(arg), " ")
+			d, err := time.ParseDuration(when)
+			if err != nil || d <= 0 || strings.TrimSpace(note) == "" {
+				fmt.Println("usage: remind DURATION TEXT (e.g. remind 10m stand up)")
+				continue
+			}
+			n := cl.reminders.add(d, strings.TrimSpace(note), func(note string) {
+				cl.in.print("\a*** reminder: " + note + " ***")
+			})
+			fmt.Printf("reminder %d set for %s\n", n, time.Now().Add(d).Format("15:04:05"))
+			continue
+		}
+		if text == "reminders" {
+			fmt.Println("--- Reminders ---")
+			for _, r := range cl.reminders.list() {
+				fmt.Printf("%d  %s  %s\n", r.n, r.due.Format("15:04:05"), r.text)
+			}
+			fmt.Println("-----------------")
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "unremind "); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || !cl.reminders.cancel(n) {
+				fmt.Printf("no pending reminder %s\n", strings.TrimSpace(arg))
+				continue
+			}
+			fmt.Printf("reminder %d cancelled\n", n)
+			continue
+		}
+		if arg, ok := strings.CutPrefix(text, "open "); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(arg))
+			u, found := clientRPC.links.get(n)
+			if err != nil || !found {
+				fmt.Printf("no link [%s]\n", strings.TrimSpace(arg))
+				continue
+			}
+			if err := openURL(u); err != nil {
+				log.Printf("open %s: %v", u, err)
+			}
+			continue
+		}
+		if spec, ok := strings.CutPrefix(text, "table "); ok {
+			cl.sendTable(spec)
+			continue
+		}
+		if path, ok := strings.CutPrefix(text, "sendfile "); ok {
+			cl.sendFile(strings.TrimSpace(path))
+			continue
+		}
+		if path, ok := strings.CutPrefix(text, "record "); ok {
+			if cl.rec != nil {
+				fmt.Println("already recording; type 'stop' first")
+				continue
+			}
+			rec, err := startRecording(strings.TrimSpace(path))
+			if err != nil {
+				log.Printf("record: %v", err)
+				continue
+			}
+			cl.rec = rec
+			fmt.Printf("recording sent messages to %s; type 'stop' to finish\n", rec.f.Name())
+			continue
+		}
+		if text == "stop" && cl.rec != nil {
+			if err := cl.rec.stop(); err != nil {
+				log.Printf("record: %v", err)
+			}
+			fmt.Printf("saved recording to %s\n", cl.rec.f.Name())
+			cl.rec = nil
+			continue
+		}
+
+		cl.send(text)
+	}
+	cl.close()
+}
@@ -0,0 +1,923 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+// fakeServer stands in for the chat server: it records Register and Send
+// calls and can be told to refuse registrations.
+type fakeServer struct {
+	mu     sync.Mutex
+	regs   []protocol.RegisterArgs
+	sent   []protocol.MessageArgs
+	unregs int
+	refuse error
+	joins  []protocol.JoinArgs
+	// limited is how many more Sends to refuse as rate limited
+	limited int
+	since   []uint64 // the Seq of each HistorySince call
+
+	entries uint64 // history entries HistorySince holds; 0 = 3
+	overlap uint64 // entries HistorySince repeats from before the given seq
+}
+
+func (s *fakeServer) Register(args protocol.RegisterArgs, _ *struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refuse != nil {
+		return s.refuse
+	}
+	s.regs = append(s.regs, args)
+	return nil
+}
+
+func (s *fakeServer) Send(args protocol.MessageArgs, reply *protocol.HistoryReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limited > 0 {
+		s.limited--
+		return errors.New("rate limited, retry in 100ms")
+	}
+	s.sent = append(s.sent, args)
+	return nil
+}
+
+func (s *fakeServer) Unregister(args protocol.RegisterArgs, _ *struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unregs++
+	return nil
+}
+
+// Join records its calls and refuses room "gone", as if it had been removed.
+func (s *fakeServer) Join(args protocol.JoinArgs, reply *protocol.HistoryReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.joins = append(s.joins, args)
+	if args.Room == "gone" {
+		return errors.New("room does not exist")
+	}
+	return nil
+}
+
+// HistorySince answers as if the server held entries 1 to 3, or to entries.
+// Like a real server, it takes a later seq to mean the room was cleared since.
+func (s *fakeServer) HistorySince(args protocol.SinceArgs, reply *protocol.HistoryReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = append(s.since, args.Seq)
+	n := s.entries
+	if n == 0 {
+		n = 3
+	}
+	from := args.Seq
+	if from > n {
+		from = 0
+	}
+	from -= min(from, s.overlap)
+	for i := from + 1; i <= n; i++ {
+		reply.Messages = append(reply.Messages, fmt.Sprint("bob: ", i))
+		reply.Seqs = append(reply.Seqs, i)
+	}
+	reply.Last = n
+	return nil
+}
+
+// ackServer is a fakeServer that also has SendAck, as newer servers do. Each
+// acknowledgement asks for a pause of backpressure.
+type ackServer struct {
+	*fakeServer
+	backpressure time.Duration
+}
+
+func (s ackServer) SendAck(args protocol.MessageArgs, reply *protocol.SendAck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, args)
+	*reply = protocol.SendAck{Seq: uint64(len(s.sent)) + 6, Time: time.Now(), Backpressure: s.backpressure}
+	return nil
+}
+
+func (s *fakeServer) registered() []protocol.RegisterArgs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.RegisterArgs(nil), s.regs...)
+}
+
+// serveFake serves s as "ChatServer" on a loopback port and returns its address.
+func serveFake(t *testing.T, s *fakeServer) string {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("ChatServer", s); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestReconnectRegistersAgain(t *testing.T) {
+	s := &fakeServer{}
+	addr := serveFake(t, s)
+	old, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := protocol.RegisterArgs{ID: "alice", Addr: "127.0.0.1:5000"}
+	server, err := reconnect(old, addr, reg)
+	if err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	defer server.Close()
+	if got := s.registered(); len(got) != 1 || got[0] != reg {
+		t.Errorf("server saw registrations %+v, want one %+v", got, reg)
+	}
+	if err := old.Call("ChatServer.Register", reg, &struct{}{}); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("old connection after reconnect: %v, want it closed", err)
+	}
+
+	s.mu.Lock()
+	s.refuse = errors.New("nope")
+	s.mu.Unlock()
+	if _, err := reconnect(server, addr, reg); err == nil {
+		t.Error("reconnect with Register refused: no error")
+	}
+}
+
+func TestReconnectRejoinsRooms(t *testing.T) {
+	s := &fakeServer{}
+	addr := serveFake(t, s)
+	server, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &chatClient{server: server, addr: addr, reg: protocol.RegisterArgs{ID: "alice", Room: "general"},
+		disabled: make(map[string]bool), recv: &ClientRPC{}, limit: newThrottle(0)}
+	cl.setRooms([]string{"dev", "gone", "ops"})
+	captureStdout(t, func() {
+		if err := cl.reconnect(); err != nil {
+			t.Fatalf("reconnect: %v", err)
+		}
+	})
+	defer cl.server.Close()
+
+	var got []string
+	s.mu.Lock()
+	for _, j := range s.joins {
+		got = append(got, fmt.Sprintf("%s keep=%t", j.Room, j.Keep))
+	}
+	s.mu.Unlock()
+	want := []string{"dev keep=true", "gone keep=true", "ops keep=true", "general keep=true"}
+	if !slices.Equal(got, want) {
+		t.Errorf("joins after reconnect %q, want %q", got, want)
+	}
+	if !slices.Equal(cl.rooms, []string{"dev", "ops"}) || cl.reg.Room != "general" {
+		t.Errorf("after rejoining, in %s and %q; want general and [dev ops]", cl.reg.Room, cl.rooms)
+	}
+	if !cl.recv.multiRoom.Load() {
+		t.Error("in three rooms, but messages aren't shown with their room")
+	}
+}
+
+func TestHistoryCache(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeServer{}
+	addr := serveFake(t, s)
+	// start returns a client as just started against s, which holds entries
+	start := func(entries uint64) *chatClient {
+		t.Helper()
+		s.mu.Lock()
+		s.entries, s.since = entries, nil
+		s.mu.Unlock()
+		server, err := rpc.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { server.Close() })
+		cl := &chatClient{server: server, addr: addr, reg: protocol.RegisterArgs{ID: "alice", Room: "general"},
+			disabled: make(map[string]bool), recv: &ClientRPC{}, limit: newThrottle(0), cacheDir: dir}
+		captureStdout(t, cl.openCache)
+		return cl
+	}
+	fetched := func() []uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return slices.Clone(s.since)
+	}
+	want := func(n uint64) []string {
+		var msgs []string
+		for i := uint64(1); i <= n; i++ {
+			msgs = append(msgs, fmt.Sprint("bob: ", i))
+		}
+		return msgs
+	}
+
+	start(3)
+	path := historyCachePath(dir, addr, "general")
+	if got := loadHistoryCache(path); !slices.Equal(got.texts, want(3)) || got.last != 3 {
+		t.Fatalf("cache after the first start holds %q up to %d, want %q", got.texts, got.last, want(3))
+	}
+
+	// restarted, the client asks only for what is newer than the cache
+	cl := start(5)
+	if got := fetched(); !slices.Equal(got, []uint64{3}) {
+		t.Errorf("on restart, HistorySince calls from %v, want one from 3", got)
+	}
+	h, ok := cl.history()
+	if !ok || !slices.Equal(h.Messages, want(5)) {
+		t.Errorf("history %q, want the cached entries and the new ones %q", h.Messages, want(5))
+	}
+	if got := fetched(); !slices.Equal(got, []uint64{3, 5}) {
+		t.Errorf("HistorySince calls from %v, want 3 then 5", got)
+	}
+
+	// offline, history shows the cache
+	cl.server.Close()
+	out := captureStdout(t, func() { h, ok = cl.history() })
+	if !ok || !slices.Equal(h.Messages, want(5)) || !strings.Contains(out, "showing the cached history") {
+		t.Errorf("offline history %q (printed %q), want the cached %q", h.Messages, out, want(5))
+	}
+
+	// the server's history was cleared: its numbering went backward
+	start(2)
+	if got := loadHistoryCache(path); !slices.Equal(got.texts, want(2)) || got.last != 2 {
+		t.Errorf("cache after the server was cleared holds %q up to %d, want %q", got.texts, got.last, want(2))
+	}
+	if other := historyCachePath(dir, addr, "dev"); other == path {
+		t.Errorf("rooms general and dev share the cache %s", path)
+	}
+}
+
+func TestUnknownMethodDisablesCommand(t *testing.T) {
+	s := &fakeServer{refuse: errors.New("nope")}
+	server, err := rpc.Dial("tcp", serveFake(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	err = server.Call("ChatServer.History", struct{}{}, &protocol.HistoryReply{})
+	if !isMethodNotFound(err) {
+		t.Fatalf("History on a server without it: %v, want method not found", err)
+	}
+	if err := server.Call("ChatServer.Register", protocol.RegisterArgs{}, &struct{}{}); isMethodNotFound(err) {
+		t.Errorf("a refused Register (%v) counted as method not found", err)
+	}
+
+	cl := &chatClient{server: server, disabled: make(map[string]bool), limit: newThrottle(0)}
+	if cl.call("history", "ChatServer.History", struct{}{}, &protocol.HistoryReply{}) {
+		t.Fatal("call for a missing method reported success")
+	}
+	if !cl.disabled["history"] {
+		t.Error("history was not disabled after method not found")
+	}
+	if cl.call("register", "ChatServer.Register", protocol.RegisterArgs{}, &struct{}{}) || cl.disabled["register"] {
+		t.Error("a refused call succeeded or disabled its command")
+	}
+}
+
+func TestRecordKeepsExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("keep me\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := startRecording(path); err == nil {
+		rec.stop()
+		t.Fatal("recording over an existing file: no error")
+	}
+	if b, _ := os.ReadFile(path); string(b) != "keep me\n" {
+		t.Errorf("existing file now holds %q", b)
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	s := &fakeServer{}
+	server, err := rpc.Dial("tcp", serveFake(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "session.txt")
+	rec, err := startRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &chatClient{server: server, reg: protocol.RegisterArgs{ID: "alice"}, disabled: make(map[string]bool), rec: rec, recv: &ClientRPC{}, limit: newThrottle(0)}
+	cl.send("first")
+	time.Sleep(50 * time.Millisecond)
+	cl.send("second")
+	if err := rec.stop(); err != nil {
+		t.Fatal(err)
+	}
+	cl.rec = nil
+
+	s.mu.Lock()
+	s.sent = nil
+	s.mu.Unlock()
+	start := time.Now()
+	if err := cl.replay(path, 2); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("replay at speed 2 took %v, want about half the recorded 50ms gap", d)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var got []string
+	for _, m := range s.sent {
+		got = append(got, m.Text)
+	}
+	if want := []string{"first", "second"}; !slices.Equal(got, want) {
+		t.Errorf("replay sent %q, want %q", got, want)
+	}
+}
+
+func TestReplayRejectsBadScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.txt")
+	if err := os.WriteFile(path, []byte("not a script line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cl := &chatClient{}
+	if err := cl.replay(path, 1); err == nil {
+		t.Error("replay of a line without an offset: no error")
+	}
+}
+
+// captureStdout returns what f prints to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestShowHistoryAsksAboveMax(t *testing.T) {
+	h := protocol.HistoryReply{Messages: []string{"m1", "m2", "m3", "m4", "m5"}}
+	for answer, want := range map[string][]string{
+		"\n":        nil,
+		"y\n":       {"m1", "m2", "m3", "m4", "m5"},
+		"last\n":    {"m3", "m4", "m5"},
+		"last 2\n":  {"m4", "m5"},
+		"last 10\n": {"m1", "m2", "m3", "m4", "m5"},
+		"last x\n":  nil,
+	} {
+		cl := &chatClient{historyMax: 3, in: &lineEditor{in: bufio.NewReader(strings.NewReader(answer)), hist: &inputHistory{}}}
+		out := captureStdout(t, func() { cl.showHistory(h) })
+		var got []string
+		for _, m := range h.Messages {
+			if strings.Contains(out, m+"\n") {
+				got = append(got, m)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("answer %q printed %q, want %q", answer, got, want)
+		}
+	}
+
+	cl := &chatClient{historyMax: 5}
+	if out := captureStdout(t, func() { cl.showHistory(h) }); strings.Contains(out, "show all?") || !strings.Contains(out, "m1\n") {
+		t.Errorf("history at the limit asked or was cut: %q", out)
+	}
+}
+
+func TestFormatPayload(t *testing.T) {
+	for _, tc := range []struct {
+		m    protocol.MessageArgs
+		want string
+	}{
+		{protocol.MessageArgs{Sender: "bob", Text: "bob: hi"}, "bob: hi"},
+		{protocol.MessageArgs{Sender: "bob", Data: []byte("notes\n"), ContentType: "text/plain; charset=utf-8"}, "bob sent text/plain; charset=utf-8:\nnotes"},
+		{protocol.MessageArgs{Sender: "bob", Data: []byte{0x89, 'P', 'N', 'G'}, ContentType: "image/png"}, "[bob sent image/png, 4 bytes]"},
+		{protocol.MessageArgs{Sender: "bob", Data: []byte{0xff}, ContentType: "text/plain"}, "[bob sent text/plain, 1 bytes]"},
+	} {
+		if got := formatIncoming(tc.m); got != tc.want {
+			t.Errorf("formatIncoming(%+v) = %q, want %q", tc.m, got, tc.want)
+		}
+	}
+}
+
+func TestLinkFootnotes(t *testing.T) {
+	got := extractURLs("see https://example.com/a, (http://x.org/b) and https://. or \"https://q.io/c?d=1\".")
+	want := []string{"https://example.com/a", "http://x.org/b", "https://q.io/c?d=1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("extractURLs = %q, want %q", got, want)
+	}
+
+	r := &linkRegistry{}
+	if s := r.footnotes("no links here"); s != "" {
+		t.Errorf("footnotes without links = %q", s)
+	}
+	if s := r.footnotes("a https://a.example b https://b.example"); s != "\n  [1] https://a.example\n  [2] https://b.example" {
+		t.Errorf("first footnotes = %q", s)
+	}
+	if s := r.footnotes("again https://a.example"); s != "\n  [3] https://a.example" {
+		t.Errorf("numbering does not continue across messages: %q", s)
+	}
+	if u, ok := r.get(2); !ok || u != "https://b.example" {
+		t.Errorf("get(2) = %q, %v", u, ok)
+	}
+	for _, n := range []int{0, 4} {
+		if _, ok := r.get(n); ok {
+			t.Errorf("get(%d) found a link", n)
+		}
+	}
+}
+
+func TestDebugTracesOnlyWhenOn(t *testing.T) {
+	var buf bytes.Buffer
+	debugLog.SetOutput(&buf)
+	defer debugLog.SetOutput(os.Stderr)
+	defer debug.Store(false)
+
+	server, err := rpc.Dial("tcp", serveFake(t, &fakeServer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	callRPC(server, "ChatServer.Register", protocol.RegisterArgs{ID: "alice"}, &struct{}{})
+	if buf.Len() != 0 {
+		t.Errorf("traced with debug off: %q", buf.String())
+	}
+	debug.Store(true)
+	callRPC(server, "ChatServer.Register", protocol.RegisterArgs{ID: "alice"}, &struct{}{})
+	if !strings.Contains(buf.String(), "call ChatServer.Register: <nil>") {
+		t.Errorf("debug trace %q does not show the call", buf.String())
+	}
+}
+
+func TestLoadDotfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".dschatrc")
+	rc := "# defaults\n\nmax = lots\nname = Alice\nno equals sign\n-max=100\nnosuchflag = 1\n"
+	if err := os.WriteFile(path, []byte(rc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	name := fs.String("name", "anon", "")
+	max := fs.Int("max", 200, "")
+	applySettings(fs, path, loadDotfile(path), map[string]bool{})
+	if *name != "Alice" || *max != 100 {
+		t.Errorf("after loading: name %q, max %d, want Alice and 100 (bad lines skipped)", *name, *max)
+	}
+	if got := loadDotfile(filepath.Join(t.TempDir(), "missing")); got != nil {
+		t.Errorf("a missing file gave settings %+v", got)
+	}
+}
+
+func TestQuietJoinsHidesPresence(t *testing.T) {
+	c := &ClientRPC{links: &linkRegistry{}, out: &lineEditor{}, mentions: newMentionLog("alice")}
+	receive := func() string {
+		return captureStdout(t, func() {
+			for _, m := range []protocol.MessageArgs{
+				{Sender: "bob", Text: "User bob joined", Kind: "join"},
+				{Sender: "bob", Text: "bob: hi"},
+				{Sender: "bob", Text: "User bob left", Kind: "leave"},
+			} {
+				c.Receive(m, &struct{}{})
+			}
+		})
+	}
+	if out := receive(); !strings.Contains(out, "joined") || !strings.Contains(out, "left") {
+		t.Errorf("notices hidden by default: %q", out)
+	}
+	c.quietJoins.Store(true)
+	out := receive()
+	if strings.Contains(out, "joined") || strings.Contains(out, "left") {
+		t.Errorf("quietjoins on still printed notices: %q", out)
+	}
+	if !strings.Contains(out, "bob: hi") {
+		t.Errorf("quietjoins on hid a chat message: %q", out)
+	}
+}
+
+func TestReminders(t *testing.T) {
+	var r reminders
+	fired := make(chan string, 2)
+	fire := func(text string) { fired <- text }
+	soon := r.add(20*time.Millisecond, "tea", fire)
+	later := r.add(time.Hour, "stand up", fire)
+	if got := r.list(); len(got) != 2 || got[0].n != soon || got[1].text != "stand up" {
+		t.Fatalf("pending reminders %+v, want tea then stand up", got)
+	}
+	select {
+	case got := <-fired:
+		if got != "tea" {
+			t.Errorf("fired %q, want tea", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reminder did not fire")
+	}
+	if got := r.list(); len(got) != 1 || got[0].n != later {
+		t.Errorf("after firing, pending %+v, want only stand up", got)
+	}
+	if r.cancel(soon) {
+		t.Error("cancelled a reminder that already fired")
+	}
+	if !r.cancel(later) || len(r.list()) != 0 {
+		t.Error("cancel of a pending reminder failed")
+	}
+	if r.cancel(later) {
+		t.Error("cancelled the same reminder twice")
+	}
+}
+
+func TestTableMessages(t *testing.T) {
+	tbl := parseTable("name, age; bob,42;alice , 7")
+	want := protocol.Table{Headers: []string{"name", "age"}, Rows: [][]string{{"bob", "42"}, {"alice", "7"}}}
+	if !slices.Equal(tbl.Headers, want.Headers) || len(tbl.Rows) != 2 || !slices.Equal(tbl.Rows[1], want.Rows[1]) {
+		t.Fatalf("parseTable = %+v, want %+v", tbl, want)
+	}
+	got := formatIncoming(protocol.MessageArgs{Sender: "bob", Text: "bob: [name | age; bob | 42; alice | 7]", Kind: "table", Table: &tbl})
+	if want := "bob posted a table:\nname   age\n----   ---\nbob    42\nalice  7"; got != want {
+		t.Errorf("formatIncoming(table) =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSessionSaveLoad(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	cl := &chatClient{addr: "chat.example:1234", reg: protocol.RegisterArgs{ID: "alice"}, historyMax: 50, limit: newThrottle(2), recv: &ClientRPC{}}
+	cl.recv.quietJoins.Store(true)
+	path, err := cl.saveSession("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(path, filepath.Join("dschat", "sessions", "work")) {
+		t.Errorf("saved to %s, want under dschat/sessions", path)
+	}
+
+	cl.historyMax, cl.limit = 200, newThrottle(5)
+	cl.recv.quietJoins.Store(false)
+	if err := cl.loadSession("work"); err != nil {
+		t.Fatal(err)
+	}
+	if cl.historyMax != 50 || cl.limit.rate != 2 || !cl.recv.quietJoins.Load() {
+		t.Errorf("after load: historymax %d, maxcmds %g, quietjoins %t; want 50, 2 and true", cl.historyMax, cl.limit.rate, cl.recv.quietJoins.Load())
+	}
+	if cl.addr != "chat.example:1234" || cl.reg.ID != "alice" {
+		t.Errorf("loading a session for the same server changed it to %s as %s", cl.addr, cl.reg.ID)
+	}
+
+	if err := cl.loadSession("nosuch"); err == nil {
+		t.Error("load of a session never saved: no error")
+	}
+	for _, name := range []string{"", "..", "a/b"} {
+		if _, err := cl.saveSession(name); err == nil {
+			t.Errorf("save as %q: no error", name)
+		}
+	}
+}
+
+func TestCatchUpAfterReconnect(t *testing.T) {
+	server, err := rpc.Dial("tcp", serveFake(t, &fakeServer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	cl := &chatClient{server: server, disabled: make(map[string]bool), recv: &ClientRPC{}, limit: newThrottle(0)}
+	catchUp := func() { cl.catchUp(cl.recv.seen.Load()) }
+	if out := captureStdout(t, catchUp); out != "" {
+		t.Errorf("catch up before anything was shown printed %q", out)
+	}
+	cl.recv.saw(1)
+	out := captureStdout(t, catchUp)
+	if !strings.Contains(out, "bob: 2\nbob: 3\n") || strings.Contains(out, "bob: 1") {
+		t.Errorf("catch up from 1 printed %q, want entries 2 and 3", out)
+	}
+	if got := cl.recv.seen.Load(); got != 3 {
+		t.Errorf("after catching up, seen = %d, want 3", got)
+	}
+	if out := captureStdout(t, catchUp); out != "" {
+		t.Errorf("a second catch up printed %q", out)
+	}
+
+	cl.recv.saw(9) // the room has been cleared and renumbered since
+	out = captureStdout(t, catchUp)
+	if !strings.Contains(out, "bob: 1\nbob: 2\nbob: 3\n") {
+		t.Errorf("catch up past the room's end printed %q, want all of it", out)
+	}
+	if got := cl.recv.seen.Load(); got != 3 {
+		t.Errorf("after catching up on a cleared room, seen = %d, want 3", got)
+	}
+}
+
+// TestCatchUpShowsEachOnce replays ranges that overlap each other and the
+// messages delivered live: every message is shown once.
+func TestCatchUpShowsEachOnce(t *testing.T) {
+	fake := &fakeServer{entries: 6, overlap: 2}
+	server, err := rpc.Dial("tcp", serveFake(t, fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	cl := &chatClient{server: server, reg: protocol.RegisterArgs{Room: "general"}, disabled: make(map[string]bool),
+		recv: &ClientRPC{out: &lineEditor{}, links: &linkRegistry{}, mentions: newMentionLog("alice")}, limit: newThrottle(0)}
+	out := captureStdout(t, func() {
+		for i := uint64(1); i <= 3; i++ {
+			cl.recv.Receive(protocol.MessageArgs{Sender: "bob", Text: fmt.Sprint("bob: ", i), Seq: i, Room: "general"}, &struct{}{})
+		}
+		cl.catchUp(2) // as if 3 arrived while reconnecting: the server sends 1 to 6
+		cl.catchUp(4) // and again, overlapping the last catch up
+	})
+	for i := 1; i <= 6; i++ {
+		if n := strings.Count(out, fmt.Sprint("bob: ", i, "\n")); n != 1 {
+			t.Errorf("bob: %d shown %d times, want once; output:\n%s", i, n, out)
+		}
+	}
+
+	cl.showReplayed = true
+	out = captureStdout(t, func() { cl.catchUp(5) })
+	if !strings.Contains(out, "bob: 4\nbob: 5\nbob: 6\n") {
+		t.Errorf("with -dedup=false, catching up from 5 printed %q, want 4 to 6 again", out)
+	}
+}
+
+func TestCloseTearsDownOnce(t *testing.T) {
+	s := &fakeServer{}
+	server, err := rpc.Dial("tcp", serveFake(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	rec, err := startRecording(filepath.Join(dir, "rec.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := 0
+	cl := &chatClient{
+		server: server, reg: protocol.RegisterArgs{ID: "alice"}, disabled: make(map[string]bool),
+		in: &lineEditor{hist: &inputHistory{}}, recv: &ClientRPC{}, listener: ln, rec: rec,
+		histFile: filepath.Join(dir, "hist"), restore: func() { restored++ }, limit: newThrottle(0),
+	}
+	cl.in.hist.add("hello")
+	cl.reminders.add(time.Hour, "later", func(string) { t.Error("a reminder fired after close") })
+
+	out := captureStdout(t, func() { cl.close(); cl.close() })
+	if strings.Count(out, "bye") != 1 || !strings.Contains(out, "1 pending reminders dropped") {
+		t.Errorf("close printed %q, want one bye and the dropped reminder", out)
+	}
+	s.mu.Lock()
+	unregs := s.unregs
+	s.mu.Unlock()
+	if unregs != 1 || restored != 1 {
+		t.Errorf("close unregistered %d times and restored the terminal %d times, want once each", unregs, restored)
+	}
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("callback listener after close: %v, want closed", err)
+	}
+	if data, err := os.ReadFile(cl.histFile); err != nil || !strings.Contains(string(data), "hello") {
+		t.Errorf("input history not saved: %q, %v", data, err)
+	}
+	if err := server.Call("ChatServer.Register", protocol.RegisterArgs{}, &struct{}{}); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("server connection after close: %v, want closed", err)
+	}
+}
+
+func TestSendAckFallsBackToSend(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rcvr any
+		ack  bool
+	}{
+		{"newer server", ackServer{fakeServer: &fakeServer{}}, true},
+		{"older server", &fakeServer{}, false},
+	} {
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("ChatServer", tc.rcvr); err != nil {
+			t.Fatal(err)
+		}
+		client, conn := net.Pipe()
+		go srv.ServeConn(conn)
+		server := rpc.NewClient(client)
+		cl := &chatClient{server: server, reg: protocol.RegisterArgs{ID: "alice"}, disabled: make(map[string]bool), recv: &ClientRPC{}, limit: newThrottle(0)}
+		out := captureStdout(t, func() { cl.send("hi") })
+		if got := strings.Contains(out, "(sent #7 at "); got != tc.ack {
+			t.Errorf("%s: printed %q, acknowledgement shown %v, want %v", tc.name, out, got, tc.ack)
+		}
+		if cl.disabled["sendack"] == tc.ack {
+			t.Errorf("%s: sendack disabled = %v", tc.name, cl.disabled["sendack"])
+		}
+		server.Close()
+	}
+}
+
+func TestRateLimitedSend(t *testing.T) {
+	s := &fakeServer{}
+	server, err := rpc.Dial("tcp", serveFake(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	cl := &chatClient{server: server, reg: protocol.RegisterArgs{ID: "alice"}, disabled: map[string]bool{"sendack": true},
+		in: &lineEditor{}, recv: &ClientRPC{}, limit: newThrottle(0), sendHistory: true}
+	sent := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.sent)
+	}
+
+	// auto-retry waits as told, and gives up after its retries
+	cl.autoRetry = 2
+	s.limited = 2
+	start := time.Now()
+	out := captureStdout(t, func() { cl.send("hi") })
+	if sent() != 1 || strings.Count(out, "(rate limited, resending in 100ms)") != 2 {
+		t.Errorf("sent %d after two refusals, printed %q; want it sent after two retries", sent(), out)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("sent after %s, want at least the 200ms the server asked for", waited)
+	}
+	s.limited = 3
+	captureStdout(t, func() { cl.send("hi") })
+	if sent() != 1 {
+		t.Errorf("sent %d messages, want the one refused three times dropped after two retries", sent())
+	}
+
+	// without it, the user hears when they can send again
+	cl.autoRetry = 0
+	s.limited = 1
+	out = captureStdout(t, func() {
+		cl.send("hi")
+		time.Sleep(300 * time.Millisecond)
+	})
+	if sent() != 1 || !strings.Contains(out, "(you can send again)") {
+		t.Errorf("sent %d, printed %q; want the message refused and a notice once the wait is over", sent(), out)
+	}
+
+	if _, ok := retryAfter(errors.New("rate limited, retry in 1s")); ok {
+		t.Error("a local error counted as the server's rate limit")
+	}
+	if d, ok := retryAfter(rpc.ServerError("rate limited, retry in 1.2s (warning: keep flooding and you will have to wait)")); !ok || d != 1200*time.Millisecond {
+		t.Errorf("retryAfter of a warning = %s, %v; want 1.2s", d, ok)
+	}
+}
+
+func TestCallbackCertMatchesHash(t *testing.T) {
+	cert, hash, err := callbackCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sum := sha256.Sum256(conn.ConnectionState().PeerCertificates[0].Raw)
+	if got := hex.EncodeToString(sum[:]); got != hash {
+		t.Errorf("listener serves a certificate hashing to %s, registered hash is %s", got, hash)
+	}
+
+	if _, err := clientTLS(filepath.Join(t.TempDir(), "missing.pem"), ""); err == nil {
+		t.Error("clientTLS with a missing CA file: no error")
+	}
+}
+
+func TestMentions(t *testing.T) {
+	l := newMentionLog("alice")
+	for text, counted := range map[string]bool{
+		"bob: @alice can you look?": true,
+		"bob: thanks @ALICE!":       true,
+		"bob: (@alice)":             true,
+		"bob: @alicex is new":       false,
+		"bob: mail bob@alice.com":   false,
+		"bob: alice without an at":  false,
+	} {
+		l.note(protocol.MessageArgs{Sender: "bob", Text: text})
+		if n, _ := l.take(); (n == 1) != counted {
+			t.Errorf("%q: counted %d times, want mention %v", text, n, counted)
+		}
+	}
+	l.note(protocol.MessageArgs{Sender: "bob", Text: "bob: @here standup", Mentioned: true})
+	if n, _ := l.take(); n != 1 {
+		t.Errorf("a message the server marked Mentioned: counted %d times, want once", n)
+	}
+	l.note(protocol.MessageArgs{Sender: "bob", Text: "User @alice joined", Kind: "join"})
+	l.note(protocol.MessageArgs{Sender: "bob", Text: "bob -> alice (private): @alice psst", Kind: "private"})
+	if n, recent := l.take(); n != 1 || recent[0].Preview != "bob -> alice (private): @alice psst" {
+		t.Errorf("after a join and a private mention: %d, %+v, want only the private one", n, recent)
+	}
+
+	for i := 0; i < mentionsMax+5; i++ {
+		l.note(protocol.MessageArgs{Sender: "bob", Text: fmt.Sprint("@alice ", i)})
+	}
+	n, recent := l.take()
+	if n != mentionsMax+5 || len(recent) != mentionsMax || recent[0].Preview != "@alice 5" {
+		t.Errorf("%d mentions kept %d previews from %q, want all counted and the newest %d kept", n, len(recent), recent[0].Preview, mentionsMax)
+	}
+	if n, _ := l.take(); n != 0 {
+		t.Errorf("take right after take: %d, want the count reset", n)
+	}
+
+	l.setName("bob")
+	l.note(protocol.MessageArgs{Sender: "carol", Text: "@alice @bob"})
+	if n, _ := l.take(); n != 1 {
+		t.Errorf("after setName: %d mentions, want the new name counted once", n)
+	}
+}
+
+func TestSendHonorsBackpressure(t *testing.T) {
+	srv := rpc.NewServer()
+	s := &fakeServer{}
+	if err := srv.RegisterName("ChatServer", ackServer{fakeServer: s, backpressure: 150 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	go srv.ServeConn(conn)
+	server := rpc.NewClient(client)
+	defer server.Close()
+	cl := &chatClient{server: server, reg: protocol.RegisterArgs{ID: "alice"}, disabled: make(map[string]bool), recv: &ClientRPC{}, limit: newThrottle(0)}
+	var second time.Duration
+	out := captureStdout(t, func() {
+		cl.send("first")
+		start := time.Now()
+		cl.send("second")
+		second = time.Since(start)
+	})
+	if second < 100*time.Millisecond {
+		t.Errorf("the send after a 150ms backpressure ack took %v, want it held back", second)
+	}
+	if !strings.Contains(out, "server busy, sending in") {
+		t.Errorf("printed %q, want the pause explained", out)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sent) != 2 {
+		t.Errorf("server got %d messages, want both, the second delayed rather than dropped", len(s.sent))
+	}
+}
+
+func TestUpdateUsersKeepsNewest(t *testing.T) {
+	c := &ClientRPC{}
+	if got := c.onlineUsers(); got != nil {
+		t.Fatalf("before any push: %q, want nil", got)
+	}
+	for _, u := range []protocol.UsersUpdate{
+		{Users: []string{"alice"}, Version: 1},
+		{Users: []string{"alice", "bob", "carol"}, Version: 3},
+		{Users: []string{"alice", "bob"}, Version: 2}, // overtaken by 3
+	} {
+		if err := c.UpdateUsers(u, &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := c.onlineUsers(), []string{"alice", "bob", "carol"}; !slices.Equal(got, want) {
+		t.Errorf("online = %q, want %q", got, want)
+	}
+}
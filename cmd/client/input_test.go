@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInputHistoryNavigation(t *testing.T) {
+	h := &inputHistory{max: 3}
+	for _, line := range []string{"one", "two", "two", "", "three", "four"} {
+		h.add(line)
+	}
+	if want := []string{"two", "three", "four"}; !slices.Equal(h.lines, want) {
+		t.Fatalf("lines = %q, want %q (duplicates and blanks dropped, capped at 3)", h.lines, want)
+	}
+	var got []string
+	for {
+		line, ok := h.prev()
+		if !ok {
+			break
+		}
+		got = append(got, line)
+	}
+	if want := []string{"four", "three", "two"}; !slices.Equal(got, want) {
+		t.Errorf("up, up, up = %q, want %q", got, want)
+	}
+	if line, ok := h.next(); !ok || line != "three" {
+		t.Errorf("down = %q, %v, want three", line, ok)
+	}
+	h.next()
+	if line, ok := h.next(); !ok || line != "" {
+		t.Errorf("down past the newest = %q, %v, want a fresh line", line, ok)
+	}
+	if _, ok := h.next(); ok {
+		t.Error("down on a fresh line moved")
+	}
+}
+
+func TestInputHistorySaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hist")
+	h := loadInputHistory(path, 10)
+	if len(h.lines) != 0 {
+		t.Fatalf("history from a missing file = %q", h.lines)
+	}
+	h.add("hello")
+	h.add("history")
+	if err := h.save(path); err != nil {
+		t.Fatal(err)
+	}
+	h = loadInputHistory(path, 10)
+	if line, _ := h.prev(); line != "history" {
+		t.Errorf("up after reload = %q, want the last saved line", line)
+	}
+}
+
+// editor returns a terminal-mode lineEditor reading input.
+func editor(input string, hist *inputHistory) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(strings.NewReader(input)), tty: true, hist: hist}
+}
+
+func TestLineEditorRecall(t *testing.T) {
+	hist := &inputHistory{}
+	hist.add("first")
+	hist.add("second")
+	for input, want := range map[string]string{
+		"abc\n":                "abc",
+		"abx\x7fc\n":           "abc",
+		"\x1b[A\n":             "second",
+		"\x1b[A\x1b[A\n":       "first",
+		"\x1b[A\x1b[A\x1b[B\n": "second",
+		"typed\x1b[A\x1b[B!\n": "!",
+		"\x1b[A more\n":        "second more",
+		"\x1b[Cx\n":            "x",
+		"\x1bhi\n":             "hi",
+	} {
+		hist.pos = len(hist.lines)
+		var line string
+		captureStdout(t, func() {
+			var err error
+			if line, err = editor(input, hist).readLine("> "); err != nil {
+				t.Errorf("%q: %v", input, err)
+			}
+		})
+		if line != want {
+			t.Errorf("input %q read %q, want %q", input, line, want)
+		}
+	}
+}
+
+// TestLineEditorLoneEscape presses Esc, waits, then types a line: the Esc must
+// not swallow the keys after it.
+func TestLineEditorLoneEscape(t *testing.T) {
+	r, w := io.Pipe()
+	e := &lineEditor{in: bufio.NewReader(r), tty: true, hist: &inputHistory{}}
+	go func() {
+		w.Write([]byte("\x1b"))
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok\n"))
+	}()
+	var line string
+	captureStdout(t, func() {
+		var err error
+		if line, err = e.readLine("> "); err != nil {
+			t.Error(err)
+		}
+	})
+	if line != "ok" {
+		t.Errorf("read %q after a lone Esc, want ok", line)
+	}
+}
+
+func TestDraftPutAsideAndBack(t *testing.T) {
+	e := editor("half a thought\x18draft\n more\n", &inputHistory{})
+	var lines []string
+	captureStdout(t, func() {
+		for i := 0; i < 2; i++ {
+			line, err := e.readLine("> ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+			if line == "draft" {
+				if d, ok := e.takeDraft(); !ok || d != "half a thought" {
+					t.Errorf("takeDraft = %q, %v, want the line put aside with Ctrl-X", d, ok)
+				}
+			}
+		}
+	})
+	if want := []string{"draft", "half a thought more"}; !slices.Equal(lines, want) {
+		t.Errorf("read %q, want %q: the draft back on the line being edited", lines, want)
+	}
+	if _, ok := e.takeDraft(); ok {
+		t.Error("a second takeDraft found a draft")
+	}
+
+	// without a terminal the draft is only handed back, not put on the next line
+	e = &lineEditor{in: bufio.NewReader(strings.NewReader("next\n")), hist: &inputHistory{}}
+	e.saveDraft("later")
+	if d, ok := e.takeDraft(); !ok || d != "later" {
+		t.Errorf("takeDraft = %q, %v, want the saved draft", d, ok)
+	}
+	var line string
+	captureStdout(t, func() { line, _ = e.readLine("> ") })
+	if line != "next" {
+		t.Errorf("read %q after takeDraft without a terminal, want the input alone", line)
+	}
+}
+
+func TestReadLinesOneAtATime(t *testing.T) {
+	var calls atomic.Int32
+	block := make(chan struct{})
+	next := readLines(func() (string, error) {
+		n := calls.Add(1)
+		if n > 1 {
+			<-block // like a user who hasn't typed yet
+		}
+		return fmt.Sprint("line ", n), nil
+	})
+	if r := <-next(); r.line != "line 1" || r.err != nil {
+		t.Fatalf("first read = %q, %v", r.line, r.err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("read called %d times before the next line was asked for, want 1", n)
+	}
+	lines := next()
+	select {
+	case r := <-lines:
+		t.Fatalf("got %q while the read was blocked", r.line)
+	case <-time.After(20 * time.Millisecond): // the caller is free to handle a signal instead
+	}
+	close(block)
+	if r := <-lines; r.line != "line 2" {
+		t.Errorf("second read = %q, want line 2", r.line)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func startupFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	for _, name := range []string{"addr", "name", "room"} {
+		fs.String(name, "default", "")
+	}
+	fs.String("session", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func saveTestSession(t *testing.T, name, body string) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	path, err := sessionPath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func value(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.String()
+}
+
+func TestStartupPrecedence(t *testing.T) {
+	saveTestSession(t, "work", "addr = session:1\nname = session\n")
+	dot := []setting{
+		{line: 1, key: "addr", value: "dotfile:1"},
+		{line: 2, key: "name", value: "dotfile"},
+		{line: 3, key: "room", value: "dotfile"},
+	}
+	fs := startupFlags(t, "-session", "work", "-name", "cli")
+	if err := applyStartup(fs, ".dschatrc", dot); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"name": "cli", "addr": "session:1", "room": "dotfile"} {
+		if got := value(fs, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStartupSessionFromDotfile(t *testing.T) {
+	saveTestSession(t, "work", "addr = session:1\n")
+	dot := []setting{
+		{line: 1, key: "session", value: "work"},
+		{line: 2, key: "addr", value: "dotfile:1"},
+	}
+	fs := startupFlags(t)
+	if err := applyStartup(fs, ".dschatrc", dot); err != nil {
+		t.Fatal(err)
+	}
+	if got := value(fs, "addr"); got != "session:1" {
+		t.Errorf("addr = %q, want the session's session:1", got)
+	}
+
+	// -session on the command line replaces the dotfile's choice
+	saveTestSession(t, "home", "addr = home:1\n")
+	fs = startupFlags(t, "-session", "home")
+	if err := applyStartup(fs, ".dschatrc", dot); err != nil {
+		t.Fatal(err)
+	}
+	if got := value(fs, "addr"); got != "home:1" {
+		t.Errorf("addr = %q, want the command-line session's home:1", got)
+	}
+}
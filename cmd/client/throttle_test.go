@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestThrottleBurst(t *testing.T) {
+	th := newThrottle(3)
+	for i := 0; i < 3; i++ {
+		if !th.allow() {
+			t.Fatalf("command %d of a burst of 3 refused", i+1)
+		}
+	}
+	if th.allow() {
+		t.Fatal("fourth command of a burst of 3 allowed")
+	}
+	th.last = th.last.Add(-time.Second)
+	if !th.allow() {
+		t.Fatal("command refused a second after the burst")
+	}
+}
+
+func TestThrottleZeroRateUnlimited(t *testing.T) {
+	th := newThrottle(0)
+	for i := 0; i < 100; i++ {
+		if !th.allow() {
+			t.Fatalf("command %d refused with no limit", i+1)
+		}
+	}
+}
+
+func TestThrottledSendNotSent(t *testing.T) {
+	s := &fakeServer{}
+	server, err := rpc.Dial("tcp", serveFake(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	cl := &chatClient{server: server, reg: protocol.RegisterArgs{ID: "alice"}, disabled: make(map[string]bool), recv: &ClientRPC{}, limit: newThrottle(2)}
+	captureStdout(t, func() {
+		for i := 0; i < 5; i++ {
+			cl.send("hi")
+		}
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sent) != 2 {
+		t.Errorf("server got %d of 5 sends at -maxcmds 2, want 2", len(s.sent))
+	}
+}
+
+func TestThrottleFractionalRate(t *testing.T) {
+	th := newThrottle(0.5)
+	if !th.allow() {
+		t.Fatal("first command refused at rate 0.5")
+	}
+	if th.allow() {
+		t.Fatal("second command allowed straight away at rate 0.5")
+	}
+	th.last = th.last.Add(-2 * time.Second)
+	if !th.allow() {
+		t.Fatal("command refused two seconds later at rate 0.5")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestInspect(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	for i := 0; i < 2; i++ {
+		if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var r protocol.InspectReply
+	if err := c.Inspect(protocol.InspectArgs{Target: "bob"}, &r); err == nil {
+		t.Error("Inspect with admin RPCs disabled: allowed")
+	}
+	c.adminToken = "secret"
+	if err := c.Inspect(protocol.InspectArgs{Token: "wrong", Target: "bob"}, &r); err == nil {
+		t.Error("Inspect with the wrong token: allowed")
+	}
+	if err := c.Inspect(protocol.InspectArgs{Token: "secret", Target: "carol"}, &r); err == nil {
+		t.Error("Inspect of a user who is not online: no error")
+	}
+	if err := c.Inspect(protocol.InspectArgs{Token: "secret", Target: "bob"}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "bob" || r.Addr != bob.addr || r.MessagesSent != 2 {
+		t.Errorf("Inspect = %+v, want bob at %s with 2 messages sent", r, bob.addr)
+	}
+	if r.LastActive.Before(r.Connected) {
+		t.Errorf("last active %v is before connected %v", r.LastActive, r.Connected)
+	}
+}
+
+func TestGetConfigLeavesOutSecrets(t *testing.T) {
+	c := newTestServer(t)
+	c.delivery = newOrderedDelivery(c)
+	c.adminToken, c.peerToken = "hunter2", "s3cret"
+	c.maxHistory, c.byteQuota, c.byteWindow = 50, 1<<20, time.Minute
+	var r protocol.ConfigReply
+	if err := dial(t, listen(t, c)).Call("ChatServer.GetConfig", struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Delivery != "ordered" || r.MaxHistory != 50 || r.ByteQuota != 1<<20 || r.ByteWindow != time.Minute || !r.AdminEnabled {
+		t.Errorf("GetConfig = %+v, want the settings in use", r)
+	}
+	if s := fmt.Sprintf("%+v", r); strings.Contains(s, "hunter2") || strings.Contains(s, "s3cret") {
+		t.Errorf("GetConfig reports a token: %s", s)
+	}
+}
+
+func TestAnnouncements(t *testing.T) {
+	c := newTestServer(t)
+	c.adminToken = "hunter2"
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	announced := func(m protocol.MessageArgs) bool { return m.Kind == "announcement" }
+
+	if err := c.PostAnnouncement(protocol.AnnouncementArgs{Token: "guess", Text: "free pizza"}, &struct{}{}); err == nil {
+		t.Error("announcement with the wrong token: accepted")
+	}
+	if err := c.PostAnnouncement(protocol.AnnouncementArgs{Token: "hunter2", Text: "maintenance at 5"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PostAnnouncement(protocol.AnnouncementArgs{Token: "hunter2", Text: "brief", TTL: 50 * time.Millisecond}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	got := texts(bob.waitFor(t, 2, announced))
+	slices.Sort(got) // fast delivery doesn't keep order
+	if want := []string{"[announcement] brief", "[announcement] maintenance at 5"}; !slices.Equal(got, want) {
+		t.Errorf("bob received %q, want %q", got, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var r protocol.AnnouncementsReply
+	if err := c.Announcements(struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Announcements) != 1 || r.Announcements[0].Text != "maintenance at 5" {
+		t.Errorf("active announcements %+v, want only the one without a TTL", r.Announcements)
+	}
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	if got := texts(alice.waitFor(t, 1, announced)); got[0] != "[announcement] maintenance at 5" {
+		t.Errorf("alice was greeted with %q", got)
+	}
+	var h protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &h)
+	for _, m := range h.Messages {
+		if strings.Contains(m, "[announcement]") {
+			t.Errorf("announcement went into history: %q", h.Messages)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	c := newTestServer(t)
+	c.adminToken = "secret"
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.audit = a
+	newMockClient(t, "bob").register(t, c)
+	conn := dial(t, listen(t, c))
+	if err := conn.Call("ChatServer.PostAnnouncement", protocol.AnnouncementArgs{Token: "secret", Text: "maintenance"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Call("ChatServer.Inspect", protocol.InspectArgs{Token: "secret", Target: "bob"}, &protocol.InspectReply{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Call("ChatServer.Inspect", protocol.InspectArgs{Token: "wrong", Target: "bob"}, &protocol.InspectReply{})
+
+	var r protocol.AuditReply
+	if err := conn.Call("ChatServer.AuditLog", protocol.AdminArgs{Token: "wrong"}, &r); err == nil {
+		t.Error("AuditLog with the wrong token: allowed")
+	}
+	if err := conn.Call("ChatServer.AuditLog", protocol.AdminArgs{Token: "secret"}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Entries) != 2 || r.Entries[0].Action != "announce" || r.Entries[1].Action != "inspect" || r.Entries[1].Target != "bob" {
+		t.Errorf("audit log %+v, want the announcement and the inspection only", r.Entries)
+	}
+	if !r.Intact {
+		t.Error("untouched audit log: chain reported broken")
+	}
+	a.close()
+
+	// the file reloads intact, and fails once an entry is edited or dropped
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	for name, content := range map[string]string{
+		"untouched": string(data),
+		"edited":    strings.Replace(string(data), "maintenance", "all is well", 1),
+		"dropped":   lines[1],
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		b, err := openAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := verifyAudit(b.snapshot()); got != (name == "untouched") {
+			t.Errorf("%s audit log: intact = %v", name, got)
+		}
+		b.close()
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := newTestServer(t)
+	c.started = time.Now().Add(-time.Minute)
+	newMockClient(t, "alice").register(t, c)
+	newMockClient(t, "bob").register(t, c)
+	for i := 0; i < 3; i++ {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SendPrivate(protocol.PrivateArgs{Msg: protocol.MessageArgs{Sender: "alice", Text: "psst"}, To: "bob"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	c.Send(protocol.MessageArgs{Sender: "alice", Data: make([]byte, c.maxBlob+1)}, &protocol.HistoryReply{}) // refused: not counted
+
+	var r protocol.StatsReply
+	if err := c.Stats(struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	// two joins and three messages are stored; the private message is sent but not kept
+	if r.Clients != 2 || r.Stored != 5 || r.Sent != 4 || r.Uptime < time.Minute {
+		t.Errorf("Stats = %+v, want 2 clients, 5 stored, 4 sent and at least a minute up", r)
+	}
+}
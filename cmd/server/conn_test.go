@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// quotaPipe returns a quotaConn over one end of a pipe whose other end is
+// drained, so writes go through.
+func quotaPipe(t *testing.T, quota int64, window time.Duration) *quotaConn {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	go io.Copy(io.Discard, b)
+	return &quotaConn{Conn: a, quota: quota, window: window, start: time.Now()}
+}
+
+func TestByteQuota(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 60)
+
+	q := quotaPipe(t, 100, time.Hour)
+	if _, err := q.Write(chunk); err != nil {
+		t.Fatalf("first 60 of 100 bytes: %v", err)
+	}
+	if _, err := q.Write(chunk); !errors.Is(err, errByteQuota) {
+		t.Fatalf("120 of 100 bytes: %v, want the quota error", err)
+	}
+	if _, err := q.Conn.Write([]byte("x")); err == nil {
+		t.Error("connection still open after the quota was exceeded")
+	}
+	if _, err := q.Write([]byte("x")); !errors.Is(err, errByteQuota) {
+		t.Errorf("write after the quota was exceeded: %v", err)
+	}
+
+	q = quotaPipe(t, 100, 50*time.Millisecond)
+	if _, err := q.Write(chunk); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := q.Write(chunk); err != nil {
+		t.Errorf("60 bytes after the window rolled over: %v", err)
+	}
+}
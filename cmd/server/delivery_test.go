@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestOrderedDeliveryKeepsOrder(t *testing.T) {
+	c := newTestServer(t)
+	c.delivery = newOrderedDelivery(c)
+	m := newMockClient(t, "bob")
+	m.register(t, c)
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, msg := range m.waitFor(t, n, chat) {
+		if want := fmt.Sprint("alice: msg", i); msg.Text != want {
+			t.Fatalf("message %d is %q, want %q", i, msg.Text, want)
+		}
+	}
+}
+
+// TestFastDeliveryOutpacesOrdered sends to a client whose every Receive is
+// slow: ordered mode makes the calls one after another, fast mode at once.
+func TestFastDeliveryOutpacesOrdered(t *testing.T) {
+	const n, delay = 10, 50 * time.Millisecond
+	elapsed := make(map[string]time.Duration)
+	for mode, newDelivery := range map[string]func(*ChatServer) delivery{
+		"fast":    func(c *ChatServer) delivery { return newFastDelivery(c, defaultWorkers) },
+		"ordered": func(c *ChatServer) delivery { return newOrderedDelivery(c) },
+	} {
+		c := newTestServer(t)
+		c.delivery = newDelivery(c)
+		m := newMockClient(t, "bob")
+		m.register(t, c)
+		m.mu.Lock()
+		m.delay = delay
+		m.mu.Unlock()
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m.waitFor(t, n, chat)
+		elapsed[mode] = time.Since(start)
+	}
+	if elapsed["ordered"] < n*delay {
+		t.Errorf("ordered mode took %v for %d calls of %v each, want them one after another", elapsed["ordered"], n, delay)
+	}
+	if elapsed["fast"]*2 > elapsed["ordered"] {
+		t.Errorf("fast mode took %v, ordered %v; want fast well ahead", elapsed["fast"], elapsed["ordered"])
+	}
+}
+
+func TestShutdownDrainsDeliveries(t *testing.T) {
+	for mode, newDelivery := range map[string]func(*ChatServer) delivery{
+		"fast":    func(c *ChatServer) delivery { return newFastDelivery(c, defaultWorkers) },
+		"ordered": func(c *ChatServer) delivery { return newOrderedDelivery(c) },
+	} {
+		t.Run(mode, func(t *testing.T) {
+			c := newTestServer(t)
+			c.delivery = newDelivery(c)
+			m := newMockClient(t, "bob")
+			m.register(t, c)
+			m.mu.Lock()
+			m.delay = 100 * time.Millisecond
+			m.mu.Unlock()
+			const n = 5
+			for i := 0; i < n; i++ {
+				if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.shutdown(5 * time.Second); err != nil {
+				t.Fatalf("shutdown: %v", err)
+			}
+			got := texts(m.received())
+			if len(got) != n+1 {
+				t.Errorf("after shutdown bob has %q, want %d messages and the shutdown notice", got, n)
+			}
+			if !slices.Contains(got, "Server shutting down") {
+				t.Errorf("bob was not told the server is shutting down: %q", got)
+			}
+			c.mu.Lock()
+			if h := formatHistory(c.history.All(defaultRoom), ""); slices.Contains(h, "Server shutting down") {
+				t.Errorf("the shutdown notice went into history: %q", h)
+			}
+			c.mu.Unlock()
+			if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "late"}, &protocol.HistoryReply{}); err == nil {
+				t.Error("Send after shutdown: accepted")
+			}
+		})
+	}
+}
+
+func TestShutdownGivesUpAfterTimeout(t *testing.T) {
+	c := newTestServer(t)
+	m := newMockClient(t, "bob")
+	m.register(t, c)
+	m.mu.Lock()
+	m.delay = 2 * time.Second
+	m.mu.Unlock()
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "slow"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := c.shutdown(100 * time.Millisecond); err == nil {
+		t.Error("shutdown with a delivery stuck: no error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %v, want about its 100ms timeout", d)
+	}
+}
+
+func TestSlowStartPause(t *testing.T) {
+	c := newTestServer(t)
+	if p := c.slowStartPause(time.Now()); p != 0 {
+		t.Errorf("pause with -slowstart off: %v", p)
+	}
+	c.slowStart, c.slowStartGap = time.Minute, 200*time.Millisecond
+	if p := c.slowStartPause(time.Now()); p < 190*time.Millisecond || p > c.slowStartGap {
+		t.Errorf("pause right after joining: %v, want about %v", p, c.slowStartGap)
+	}
+	if p := c.slowStartPause(time.Now().Add(-30 * time.Second)); p < 90*time.Millisecond || p > 110*time.Millisecond {
+		t.Errorf("pause halfway through -slowstart: %v, want about half the gap", p)
+	}
+	if p := c.slowStartPause(time.Now().Add(-time.Minute)); p != 0 {
+		t.Errorf("pause after -slowstart: %v", p)
+	}
+}
+
+func TestSlowStartPacesNewClient(t *testing.T) {
+	for mode, newDelivery := range map[string]func(*ChatServer) delivery{
+		"fast":    func(c *ChatServer) delivery { return newFastDelivery(c, defaultWorkers) },
+		"ordered": func(c *ChatServer) delivery { return newOrderedDelivery(c) },
+	} {
+		t.Run(mode, func(t *testing.T) {
+			c := newTestServer(t)
+			c.delivery = newDelivery(c)
+			c.slowStart, c.slowStartGap = time.Minute, 50*time.Millisecond
+			m := newMockClient(t, "bob")
+			m.register(t, c)
+			const n = 5
+			start := time.Now()
+			for i := 0; i < n; i++ {
+				if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m.waitFor(t, n, chat)
+			if d := time.Since(start); d < (n-1)*40*time.Millisecond {
+				t.Errorf("%d messages reached a new client in %v, want them paced about %v apart", n, d, c.slowStartGap)
+			}
+		})
+	}
+}
+
+func TestDeliverTimeoutDropsStuckClient(t *testing.T) {
+	c := newTestServer(t)
+	c.deliverTimeout = 100 * time.Millisecond
+	stuck := newMockClient(t, "stuck")
+	stuck.delay = time.Hour
+	stuck.register(t, c)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob.waitFor(t, 3, chat)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		_, online := c.clients["stuck"]
+		c.mu.Unlock()
+		if !online {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a client that never answers Receive was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "after"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 4, chat)[3].Text; got != "alice: after" {
+		t.Errorf("bob received %q after the drop, want alice: after", got)
+	}
+}
+
+func TestEchoCallsBack(t *testing.T) {
+	c := newTestServer(t)
+	c.deliverTimeout = 100 * time.Millisecond
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	if err := c.Echo(protocol.EchoArgs{ID: "bob", Token: "t0k3n"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.received(); len(got) != 1 || got[0].Kind != "selftest" || got[0].Text != "t0k3n" {
+		t.Errorf("bob received %+v, want the selftest token", got)
+	}
+
+	bob.mu.Lock()
+	bob.delay = time.Second
+	bob.mu.Unlock()
+	if err := c.Echo(protocol.EchoArgs{ID: "bob", Token: "slow"}, &struct{}{}); err == nil {
+		t.Error("Echo to a client slower than -delivertimeout: no error")
+	}
+	c.mu.Lock()
+	_, online := c.clients["bob"]
+	c.mu.Unlock()
+	if !online {
+		t.Error("a failed Echo removed the client")
+	}
+	if err := c.Echo(protocol.EchoArgs{ID: "nobody"}, &struct{}{}); err == nil {
+		t.Error("Echo for an unregistered ID: no error")
+	}
+}
+
+func TestEnqueueGivesUpOnFullQueue(t *testing.T) {
+	// no broadcaster reads from this queue, so it stays full after one message
+	c := &ChatServer{broadcast: make(chan broadcastMsg, 1), enqueueWait: 100 * time.Millisecond}
+	enqueue := func(text string) time.Duration {
+		t.Helper()
+		c.sending.Add(1)
+		start := time.Now()
+		c.enqueue(broadcastMsg{MessageArgs: protocol.MessageArgs{Sender: "alice", Text: text}})
+		return time.Since(start)
+	}
+	if d := enqueue("fits"); d > 50*time.Millisecond {
+		t.Errorf("enqueue with room took %v", d)
+	}
+	if d := enqueue("waits"); d < c.enqueueWait || d > c.enqueueWait+time.Second {
+		t.Errorf("enqueue on a full queue took %v, want about -enqueuewait (%v)", d, c.enqueueWait)
+	}
+	c.enqueueWait = 0
+	if d := enqueue("dropped"); d > 50*time.Millisecond {
+		t.Errorf("enqueue with -enqueuewait 0 took %v, want an immediate drop", d)
+	}
+	c.sending.Wait() // every enqueue finished its handoff
+	if b := <-c.broadcast; b.Text != "fits" || len(c.broadcast) != 0 {
+		t.Errorf("queue holds %q and %d more, want only the first message", b.Text, len(c.broadcast))
+	}
+
+	// a reader freeing room within the wait lets the message through
+	c.enqueueWait = time.Second
+	c.broadcast <- broadcastMsg{}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-c.broadcast
+	}()
+	enqueue("in time")
+	if b := <-c.broadcast; b.Text != "in time" {
+		t.Errorf("queue holds %q, want the message that waited", b.Text)
+	}
+}
+
+func TestBackpressureRisesWithQueueFill(t *testing.T) {
+	c := &ChatServer{broadcast: make(chan broadcastMsg, 100), pressureAt: 0.5}
+	fillTo := func(n int) {
+		for len(c.broadcast) < n {
+			c.broadcast <- broadcastMsg{}
+		}
+	}
+	for _, tc := range []struct {
+		queued int
+		want   time.Duration
+	}{
+		{0, 0},
+		{49, 0},
+		{50, pressureMinPause},
+		{75, (pressureMinPause + pressureMaxPause) / 2},
+		{100, pressureMaxPause},
+	} {
+		fillTo(tc.queued)
+		if got := c.backpressure(); got != tc.want {
+			t.Errorf("%d of 100 queued: pause %v, want %v", tc.queued, got, tc.want)
+		}
+	}
+	c.pressureAt = 0
+	if got := c.backpressure(); got != 0 {
+		t.Errorf("with -backpressure 0 and a full queue: pause %v, want none", got)
+	}
+}
+
+func TestFastDeliveryBoundsCalls(t *testing.T) {
+	c := newTestServer(t)
+	c.delivery = newFastDelivery(c, 2)
+	c.silentJoins = true
+	clients := make([]*mockClient, 6)
+	for i := range clients {
+		clients[i] = newMockClient(t, fmt.Sprintf("u%d", i))
+		clients[i].delay = 100 * time.Millisecond
+		clients[i].register(t, c)
+	}
+	start := time.Now()
+	if err := c.Send(protocol.MessageArgs{Sender: "sender", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range clients {
+		m.waitFor(t, 1, chat)
+	}
+	// two workers, six 100ms calls: at least three rounds
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Errorf("6 slow clients with 2 workers were all reached in %v; more than 2 calls ran at once", took)
+	}
+	var r protocol.ConfigReply
+	if err := c.GetConfig(struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Workers != 2 {
+		t.Errorf("GetConfig Workers = %d, want 2", r.Workers)
+	}
+}
+
+// spawnDelivery is fast delivery as it was before the worker pool: one
+// goroutine per client per message. BenchmarkFanOut runs it as the baseline.
+type spawnDelivery struct{ c *ChatServer }
+
+func (d spawnDelivery) deliver(cl *client, m protocol.MessageArgs) {
+	d.c.inflight.Add(1)
+	cl.pending.Add(1)
+	go func() {
+		defer d.c.inflight.Done()
+		defer cl.pending.Add(-1)
+		d.c.deliverTo(cl, m)
+	}()
+}
+
+func (d spawnDelivery) forget(*client)           {}
+func (d spawnDelivery) migrate(from, to *client) {}
+func (d spawnDelivery) close()                   {}
+
+// BenchmarkFanOut measures one message reaching a few hundred clients, with a
+// goroutine per call as the baseline and then through worker pools.
+func BenchmarkFanOut(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		new  func(*ChatServer) delivery
+	}{
+		{"goroutines", func(c *ChatServer) delivery { return spawnDelivery{c} }},
+		{"workers=8", func(c *ChatServer) delivery { return newFastDelivery(c, 8) }},
+		{fmt.Sprintf("workers=%d", defaultWorkers), func(c *ChatServer) delivery { return newFastDelivery(c, defaultWorkers) }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			c := newTestServer(b)
+			c.delivery = tc.new(c)
+			c.silentJoins = true
+			clients := make([]*mockClient, 300)
+			for i := range clients {
+				clients[i] = newMockClient(b, fmt.Sprintf("u%d", i))
+				clients[i].register(b, c)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.SendAck(protocol.MessageArgs{Sender: "sender", Text: fmt.Sprint("msg", i)}, &protocol.SendAck{}); err != nil {
+					b.Fatal(err)
+				}
+				for _, m := range clients {
+					m.waitFor(b, i+1, chat)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+// TestMain keeps the server's log lines out of the test output unless -v is given.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// mockClient is the callback side of a chat client: it answers Client.Nonce
+// and keeps what arrives through Client.Receive and Client.UpdateUsers.
+type mockClient struct {
+	id, addr, nonce string
+	certHash        string // of the listener's TLS certificate; empty = plain TCP
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	msgs   []protocol.MessageArgs
+	users  []protocol.UsersUpdate // pushed user lists, in arrival order
+	delay  time.Duration          // each Receive takes this long before returning
+	ln     net.Listener
+	closed bool
+}
+
+// mockRPC is what a mockClient serves as "Client".
+type mockRPC struct{ m *mockClient }
+
+func (r *mockRPC) Nonce(_ struct{}, reply *string) error {
+	*reply = r.m.nonce
+	return nil
+}
+
+func (r *mockRPC) Receive(args protocol.MessageArgs, _ *struct{}) error {
+	r.m.mu.Lock()
+	delay := r.m.delay
+	r.m.mu.Unlock()
+	time.Sleep(delay)
+	r.m.mu.Lock()
+	r.m.msgs = append(r.m.msgs, args)
+	r.m.cond.Broadcast()
+	r.m.mu.Unlock()
+	return nil
+}
+
+func (r *mockRPC) UpdateUsers(args protocol.UsersUpdate, _ *struct{}) error {
+	r.m.mu.Lock()
+	r.m.users = append(r.m.users, args)
+	r.m.cond.Broadcast()
+	r.m.mu.Unlock()
+	return nil
+}
+
+// newMockClient starts a callback listener for id.
+func newMockClient(tb testing.TB, id string) *mockClient {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return serveMockClient(tb, id, ln)
+}
+
+// serveMockClient serves the callback side of id on ln.
+func serveMockClient(tb testing.TB, id string, ln net.Listener) *mockClient {
+	tb.Helper()
+	m := &mockClient{id: id, addr: ln.Addr().String(), nonce: id + "-nonce", ln: ln}
+	m.cond = sync.NewCond(&m.mu)
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Client", &mockRPC{m}); err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // closed at the end of the test
+			}
+			go srv.ServeConn(conn)
+		}
+	}()
+	tb.Cleanup(m.close)
+	return m
+}
+
+func (m *mockClient) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		m.ln.Close()
+	}
+}
+
+func (m *mockClient) registerArgs() protocol.RegisterArgs {
+	return protocol.RegisterArgs{ID: m.id, Addr: m.addr, Nonce: m.nonce, CertHash: m.certHash}
+}
+
+// register registers m with c directly, without a connection to the server.
+func (m *mockClient) register(tb testing.TB, c *ChatServer) {
+	tb.Helper()
+	if err := c.Register(m.registerArgs(), &struct{}{}); err != nil {
+		tb.Fatalf("register %s: %v", m.id, err)
+	}
+}
+
+// received returns the messages m has received so far.
+func (m *mockClient) received() []protocol.MessageArgs {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]protocol.MessageArgs(nil), m.msgs...)
+}
+
+// waitFor waits until m has received n messages matching keep, and returns them.
+func (m *mockClient) waitFor(tb testing.TB, n int, keep func(protocol.MessageArgs) bool) []protocol.MessageArgs {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	timer := time.AfterFunc(5*time.Second, func() {
+		m.mu.Lock()
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	})
+	defer timer.Stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		var got []protocol.MessageArgs
+		for _, msg := range m.msgs {
+			if keep(msg) {
+				got = append(got, msg)
+			}
+		}
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("%s got %d matching messages, want %d", m.id, len(got), n)
+		}
+		m.cond.Wait()
+	}
+}
+
+// chat keeps chat messages, not join or leave notices.
+func chat(m protocol.MessageArgs) bool {
+	return m.Kind == ""
+}
+
+// newTestServer returns a ChatServer that is shut down when the test ends.
+// History entries come without timestamps so tests can compare them.
+func newTestServer(tb testing.TB) *ChatServer {
+	tb.Helper()
+	c := NewChatServer()
+	c.timeFormat = ""
+	tb.Cleanup(func() { c.shutdown(5 * time.Second) })
+	return c
+}
+
+// listen serves c on a loopback port the way main does, and returns its address.
+func listen(tb testing.TB, c *ChatServer) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serveConn(conn)
+		}
+	}()
+	tb.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// dial connects to a server started by listen.
+func dial(tb testing.TB, addr string) *rpc.Client {
+	tb.Helper()
+	conn, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestEmptyRoomPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		clear  bool
+		kept   int    // entries left after everyone leaves
+		next   uint64 // Seq of the next message once someone is back
+	}{
+		{"retain", false, 5, 7}, // two joins, the message, two leaves; then a join
+		{"clear", true, 0, 2},   // numbering starts again with the new join
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history.jsonl")
+			c := newTestServer(t)
+			c.history, _ = openStore(path, 0)
+			c.clearWhenEmpty = tc.clear
+			alice, bob := newMockClient(t, "alice"), newMockClient(t, "bob")
+			alice.register(t, c)
+			bob.register(t, c)
+			if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range []*mockClient{alice, bob} {
+				if err := c.Unregister(m.registerArgs(), &struct{}{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var h protocol.HistoryReply
+			if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+				t.Fatal(err)
+			}
+			if len(h.Messages) != tc.kept {
+				t.Errorf("history after everyone left = %q, want %d entries", h.Messages, tc.kept)
+			}
+			if err := c.history.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if saved, err := loadHistory(path, 0); err != nil || len(saved) != tc.kept {
+				t.Errorf("file after everyone left holds %d entries (%v), want %d", len(saved), err, tc.kept)
+			}
+
+			alice = newMockClient(t, "alice")
+			alice.register(t, c)
+			var ack protocol.SendAck
+			if err := c.SendAck(protocol.MessageArgs{Sender: "alice", Text: "back"}, &ack); err != nil {
+				t.Fatal(err)
+			}
+			if ack.Seq != tc.next {
+				t.Errorf("next message got seq %d, want %d", ack.Seq, tc.next)
+			}
+		})
+	}
+}
+
+// TestEmptyRoomRejoin drains a room under -emptyroom clear while one member
+// comes back within the leave grace period: the room never emptied, so its
+// history stays.
+func TestEmptyRoomRejoin(t *testing.T) {
+	c := newTestServer(t)
+	c.clearWhenEmpty = true
+	c.leaveGrace = 100 * time.Millisecond
+	alice, bob := newMockClient(t, "alice"), newMockClient(t, "bob")
+	alice.register(t, c)
+	bob.register(t, c)
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*mockClient{bob, alice} {
+		if err := c.Unregister(m.registerArgs(), &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newMockClient(t, "alice").register(t, c)
+	time.Sleep(2 * c.leaveGrace) // bob's leave lands with alice back in the room
+
+	var h protocol.HistoryReply
+	if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"User alice joined", "User bob joined", "alice: hi", "User bob left"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("history = %q, want %q", h.Messages, want)
+	}
+}
+
+func TestForgetMe(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	for _, m := range []protocol.MessageArgs{
+		{Sender: "alice", Text: "one"},
+		{Sender: "bob", Text: "two"},
+		{Sender: "alice", Text: "three"},
+	} {
+		if err := c.Send(m, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var r protocol.ForgetReply
+	if err := c.ForgetMe(protocol.ForgetArgs{ID: "alice"}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Removed != 2 {
+		t.Errorf("removed %d messages, want 2", r.Removed)
+	}
+	var h protocol.HistoryReply
+	if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"User bob joined", "bob: two"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("history after ForgetMe = %q, want %q", h.Messages, want)
+	}
+	notice := bob.waitFor(t, 1, func(m protocol.MessageArgs) bool { return strings.Contains(m.Text, "removed from history") })
+	if notice[0].Text != "User alice's messages were removed from history (2)" {
+		t.Errorf("bob was told %q", notice[0].Text)
+	}
+
+	r = protocol.ForgetReply{}
+	if err := c.ForgetMe(protocol.ForgetArgs{ID: "alice"}, &r); err != nil || r.Removed != 0 {
+		t.Errorf("second ForgetMe: removed %d, %v", r.Removed, err)
+	}
+}
+
+func TestHistoryTimestamps(t *testing.T) {
+	c := newTestServer(t)
+	c.timeFormat = "2006-01-02"
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	var h protocol.HistoryReply
+	if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[" + time.Now().Format("2006-01-02") + "] alice: hi"; len(h.Messages) != 1 || h.Messages[0] != want {
+		t.Errorf("history %q, want [%q]", h.Messages, want)
+	}
+}
+
+func TestHistoryCap(t *testing.T) {
+	c := newTestServer(t)
+	c.history = newMemoryStore(3)
+	var before protocol.HistoryReply
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			c.roomHistory(defaultRoom, 0, &before)
+		}
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: strconv.Itoa(i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var h protocol.HistoryReply
+	if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice: 2", "alice: 3", "alice: 4"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("history %q, want the newest %q", h.Messages, want)
+	}
+	if want := []string{"alice: 0", "alice: 1"}; !slices.Equal(before.Messages, want) {
+		t.Errorf("an earlier History reply changed to %q", before.Messages)
+	}
+}
+
+func TestHistoryStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	c := newTestServer(t)
+	hf, err := openHistoryFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.history = &fileStore{memoryStore: newMemoryStore(0), file: hf}
+	for _, m := range []protocol.MessageArgs{
+		{Sender: "alice", Text: "one"},
+		{Sender: "bob", Text: "two"},
+		{Sender: "alice", Text: "three"},
+		{Sender: "bob", Text: "four"},
+	} {
+		if err := c.Send(m, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.ForgetMe(protocol.ForgetArgs{ID: "alice"}, &protocol.ForgetReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "five"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.history.Close()
+	c.history = newMemoryStore(0) // so shutdown doesn't close the file again
+	c.mu.Unlock()
+
+	// a restart reads back what was kept, skipping lines it can't parse
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+	msgs, err := loadHistory(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := formatHistory(msgs, ""), []string{"bob: two", "bob: four", "bob: five"}; !slices.Equal(got, want) {
+		t.Errorf("reloaded %q, want %q", got, want)
+	}
+	if msgs, _ := loadHistory(path, 2); len(msgs) != 2 || msgs[1].Text != "five" {
+		t.Errorf("reload capped at 2 = %v, want the newest two", msgs)
+	}
+	if msgs, err := loadHistory(filepath.Join(t.TempDir(), "missing"), 0); err != nil || msgs != nil {
+		t.Errorf("reload of a missing file = %v, %v; want empty", msgs, err)
+	}
+}
+
+func TestForgetMeReportsFailedRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	c := newTestServer(t)
+	c.history, _ = openStore(path, 0)
+	for _, m := range []protocol.MessageArgs{{Sender: "alice", Text: "secret"}, {Sender: "bob", Text: "hi"}} {
+		if err := c.Send(m, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.history.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() []string {
+		t.Helper()
+		msgs, err := loadHistory(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgTexts(msgs)
+	}
+
+	// a directory where the rewrite's temporary file goes makes it fail
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := c.ForgetMe(protocol.ForgetArgs{ID: "alice"}, &protocol.ForgetReply{})
+	if err == nil || !strings.Contains(err.Error(), "still holds them") {
+		t.Errorf("ForgetMe with the rewrite failing: %v, want the failure reported", err)
+	}
+	if got := stored(); !slices.Contains(got, "secret") {
+		t.Fatalf("file holds %q; the failed rewrite should have left it alone", got)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "still failing"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.history.Sync(); err == nil {
+		t.Error("Sync while the rewrite still fails: no error")
+	}
+
+	// once the rewrite can work, the next change makes it
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "fixed"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.history.Sync(); err != nil {
+		t.Errorf("Sync after the rewrite worked: %v", err)
+	}
+	if got, want := stored(), []string{"hi", "still failing", "fixed"}; !slices.Equal(got, want) {
+		t.Errorf("file holds %q, want %q", got, want)
+	}
+}
+
+func TestHistorySince(t *testing.T) {
+	c := newTestServer(t)
+	c.history = newMemoryStore(3)
+	for i := 1; i <= 5; i++ {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: strconv.Itoa(i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// entries 1 and 2 have been dropped; 3, 4 and 5 are kept
+	for _, tc := range []struct {
+		name string
+		seq  uint64
+		want []string
+		last uint64
+	}{
+		{"from the start", 0, []string{"alice: 3", "alice: 4", "alice: 5"}, 5},
+		{"mid-stream", 3, []string{"alice: 4", "alice: 5"}, 5},
+		{"up to date", 5, nil, 5},
+		{"newer than Last: the room was cleared since", 9, []string{"alice: 3", "alice: 4", "alice: 5"}, 5},
+		{"older than the kept window", 1, []string{"alice: 3", "alice: 4", "alice: 5"}, 5},
+	} {
+		var h protocol.HistoryReply
+		if err := c.roomHistory(defaultRoom, tc.seq, &h); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(h.Messages, tc.want) || h.Last != tc.last {
+			t.Errorf("%s: HistorySince(%d) = %q, Last %d; want %q, Last %d", tc.name, tc.seq, h.Messages, h.Last, tc.want, tc.last)
+		}
+		if n := len(h.Seqs); n != len(h.Messages) || n > 0 && h.Seqs[n-1] != tc.last {
+			t.Errorf("%s: Seqs %v do not match the entries", tc.name, h.Seqs)
+		}
+	}
+}
+
+// storeKinds opens an empty store of each HistoryStore implementation, keeping
+// the last max entries of each room; path is where a fileStore's file is.
+var storeKinds = map[string]func(t *testing.T, max int) (HistoryStore, string){
+	"memory": func(t *testing.T, max int) (HistoryStore, string) {
+		return newMemoryStore(max), ""
+	},
+	"file": func(t *testing.T, max int) (HistoryStore, string) {
+		path := filepath.Join(t.TempDir(), "history.jsonl")
+		f, err := openHistoryFile(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &fileStore{memoryStore: newMemoryStore(max), file: f}, path
+	},
+}
+
+// testStores runs check against every HistoryStore implementation. For a
+// fileStore it then checks that the file holds what the store does.
+func testStores(t *testing.T, max int, check func(t *testing.T, s HistoryStore)) {
+	for kind, open := range storeKinds {
+		t.Run(kind, func(t *testing.T) {
+			s, path := open(t, max)
+			check(t, s)
+			var want []Message
+			for _, r := range s.Rooms() {
+				want = append(want, s.All(r)...)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if path == "" {
+				return
+			}
+			got, err := loadHistory(path, max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sortSeq(got)
+			sortSeq(want)
+			if !slices.Equal(msgTexts(got), msgTexts(want)) {
+				t.Errorf("file holds %q, want %q", msgTexts(got), msgTexts(want))
+			}
+		})
+	}
+}
+
+func sortSeq(msgs []Message) {
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+}
+
+func msgTexts(msgs []Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Text
+	}
+	return out
+}
+
+// fill appends n entries to room with Seq and Text counting on from first.
+func fill(s HistoryStore, room string, first, n int) {
+	for i := first; i < first+n; i++ {
+		s.Append(Message{Seq: uint64(i), Text: strconv.Itoa(i), Room: room})
+	}
+}
+
+// TestFileStoreNeverWaitsOnDisk appends to a store whose writer has not
+// started, as if the disk had stalled, then lets it catch up and restarts.
+func TestFileStoreNeverWaitsOnDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	hf := &historyFile{path: path, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	s := &fileStore{memoryStore: newMemoryStore(0), file: hf}
+	const n = 3 * storeBacklog
+	appended := make(chan struct{})
+	go func() {
+		for i := 1; i <= n; i++ {
+			s.Append(Message{Seq: uint64(i), Sender: "alice", Text: strconv.Itoa(i), Room: defaultRoom})
+		}
+		close(appended)
+	}()
+	select {
+	case <-appended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Append blocked on a writer that isn't writing")
+	}
+	if q := hf.backlog(); q > storeBacklog {
+		t.Errorf("%d ops queued for the stalled writer, want at most %d", q, storeBacklog)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hf.run(f)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restarted, seq := openStore(path, 0)
+	defer restarted.Close()
+	if got := restarted.All(defaultRoom); seq[defaultRoom] != n || len(got) != n || got[0].Text != "1" || got[n-1].Text != strconv.Itoa(n) {
+		t.Errorf("after a restart: seq %d and %d entries, want all %d in order", seq[defaultRoom], len(got), n)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	c := newTestServer(t)
+	c.history, c.seqs = openStore(path, 0)
+	newMockClient(t, "alice").register(t, c)
+	for _, text := range []string{"keep", "oops 1", "oops 2", "oops 3"} {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: text}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func() []string {
+		t.Helper()
+		c.history.Sync() // only to wait for the writer: it fails while the removal is stuck
+		msgs, err := loadHistory(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgTexts(msgs)
+	}
+
+	if err := c.history.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the removal can't rewrite the file, so the deleted entries stay in it
+	if err := os.Mkdir(path+".tmp", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteMine(protocol.DeleteMineArgs{Sender: "alice", Count: 3}, &protocol.ForgetReply{}); err == nil {
+		t.Fatal("delmine with the file stuck: no error")
+	}
+	if got := strings.Join(stored(), " "); !strings.Contains(got, "oops") {
+		t.Fatalf("file holds %q; want the removal stuck for this test", got)
+	}
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	go c.compactEvery(10*time.Millisecond, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Contains(strings.Join(stored(), " "), "oops") {
+		if time.Now().After(deadline) {
+			t.Fatalf("file still holds %q after scheduled compaction", stored())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := stored(); !slices.Contains(got, "keep") {
+		t.Errorf("compaction left %q, want the entry that wasn't deleted kept", got)
+	}
+
+	// retention drops old entries from memory and the file alike
+	c.mu.Lock()
+	c.retention = 50 * time.Millisecond
+	c.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "new"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	c.compact() // the scheduled one may have got there first
+	if got := stored(); !slices.Equal(got, []string{"new"}) {
+		t.Errorf("after retention, file holds %q, want [new]", got)
+	}
+	var h protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &h)
+	if want := []string{"alice: new"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("after retention, history %q, want %q", h.Messages, want)
+	}
+}
+
+func TestCompactAfterTrimmed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	s, _ := openStore(path, 2)
+	defer s.Close()
+	s.(*fileStore).compactAfter = 3
+	fill(s, defaultRoom, 1, 6)
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := loadHistory(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3, 4 and 5 each trimmed one; the rewrite at 5 left 4, 5, and 6 came after
+	if got := msgTexts(msgs); !slices.Equal(got, []string{"4", "5", "6"}) {
+		t.Errorf("file holds %q, want [4 5 6]", got)
+	}
+}
+
+func TestMigrateHistory(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name, old, format string
+		want              []Message
+	}{
+		{"plain text", "User alice joined\nalice: hi: there, ünïcode\r\n\nbob: {not json}\nalice is now known as al\n", "text", []Message{
+			{Seq: 1, Text: "User alice joined", Room: defaultRoom},
+			{Seq: 2, Sender: "alice", Text: "hi: there, ünïcode", Room: defaultRoom},
+			{Seq: 3, Sender: "bob", Text: "{not json}", Room: defaultRoom},
+			{Seq: 4, Text: "alice is now known as al", Room: defaultRoom},
+		}},
+		// saved before rooms, and before each room numbered its own entries
+		{"old json", `{"Seq":7,"Sender":"alice","Text":"before rooms","Time":"2024-03-01T12:00:00Z"}
+{"Seq":8,"Sender":"bob","Text":"in dev","Time":"2024-03-01T12:00:00Z","Room":"dev"}
+{"Seq":9,"Sender":"alice","Text":"again","Time":"2024-03-01T12:00:00Z","Room":"general"}
+`, "jsonl", []Message{
+			{Seq: 1, Sender: "alice", Text: "before rooms", Time: at, Room: defaultRoom},
+			{Seq: 1, Sender: "bob", Text: "in dev", Time: at, Room: "dev"},
+			{Seq: 2, Sender: "alice", Text: "again", Time: at, Room: defaultRoom},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			from, to := filepath.Join(dir, "old"), filepath.Join(dir, "new.jsonl")
+			if err := os.WriteFile(from, []byte(tc.old), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			n, format, err := migrateHistory(from, to)
+			if err != nil || n != len(tc.want) || format != tc.format {
+				t.Fatalf("migrate: %d records as %s, %v; want %d as %s", n, format, err, len(tc.want), tc.format)
+			}
+			got, err := loadHistory(to, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("migrated file holds %+v, want %+v", got, tc.want)
+			}
+			for i, m := range got {
+				if w := tc.want[i]; m.Seq != w.Seq || m.Sender != w.Sender || m.Text != w.Text || m.Room != w.Room || !m.Time.Equal(w.Time) {
+					t.Errorf("record %d: %+v, want %+v", i+1, m, w)
+				}
+			}
+			if _, _, err := migrateHistory(from, to); err == nil || !strings.Contains(err.Error(), "already exists") {
+				t.Errorf("migrating over the new file: %v, want refused", err)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad")
+	os.WriteFile(bad, []byte(`{"Seq":1,"Text":"ok"}`+"\n{broken\n"), 0o644)
+	if _, _, err := migrateHistory(bad, filepath.Join(dir, "out")); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("a bad line: %v, want an error naming line 2", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a failed migration left its output behind: %v", err)
+	}
+}
+
+// failingWriter is a history file on a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("no space left on device") }
+func (failingWriter) Close() error              { return nil }
+
+func TestPersistErrorPolicy(t *testing.T) {
+	for _, policy := range []string{"warn", "fail"} {
+		t.Run(policy, func(t *testing.T) {
+			c := newTestServer(t)
+			c.adminToken, c.onPersistError = "s3cret", policy
+			// rewrites fail too: the file's directory doesn't exist
+			hf := &historyFile{path: filepath.Join(t.TempDir(), "gone", "history.jsonl"), wake: make(chan struct{}, 1), done: make(chan struct{})}
+			hf.notify(c.persistFailed)
+			go hf.run(failingWriter{})
+			c.history = &fileStore{memoryStore: newMemoryStore(0), file: hf}
+			alice := newMockClient(t, "alice")
+			args := alice.registerArgs()
+			args.AdminToken = "s3cret"
+			if err := c.Register(args, &struct{}{}); err != nil {
+				t.Fatal(err)
+			}
+			bob := newMockClient(t, "bob")
+			bob.register(t, c)
+
+			err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "hi"}, &protocol.HistoryReply{})
+			if want := policy == "fail"; (err != nil) != want || err != nil && !strings.Contains(err.Error(), "not saved") {
+				t.Errorf("send with the disk full: %v, want an error only under fail", err)
+			}
+			alice.waitFor(t, 1, func(m protocol.MessageArgs) bool { return m.Text == "bob: hi" }) // delivered anyway
+			c.history.Sync()
+			var stats protocol.StatsReply
+			if err := c.Stats(struct{}{}, &stats); err != nil || stats.PersistErrors == 0 {
+				t.Errorf("stats %+v (%v), want the failed writes counted", stats, err)
+			}
+			isAlert := func(m protocol.MessageArgs) bool { return strings.HasPrefix(m.Text, "[admin alert]") }
+			if got := alice.waitFor(t, 1, isAlert)[0].Text; !strings.Contains(got, "no space left") {
+				t.Errorf("alert %q, want the write error in it", got)
+			}
+			for _, m := range bob.received() {
+				if isAlert(m) {
+					t.Errorf("bob, not an admin, was alerted: %q", m.Text)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreAppendAll(t *testing.T) {
+	testStores(t, 0, func(t *testing.T, s HistoryStore) {
+		fill(s, "general", 1, 3)
+		fill(s, "dev", 4, 2)
+		if got := msgTexts(s.All("general")); !slices.Equal(got, []string{"1", "2", "3"}) {
+			t.Errorf("All(general) = %q", got)
+		}
+		if got := msgTexts(s.All("dev")); !slices.Equal(got, []string{"4", "5"}) {
+			t.Errorf("All(dev) = %q", got)
+		}
+		if got := s.All("empty"); len(got) != 0 {
+			t.Errorf("All(empty) = %q, want nothing", msgTexts(got))
+		}
+		if got := s.Rooms(); !slices.Equal(got, []string{"dev", "general"}) {
+			t.Errorf("Rooms() = %q, want both, sorted", got)
+		}
+	})
+}
+
+func TestStoreSince(t *testing.T) {
+	testStores(t, 0, func(t *testing.T, s HistoryStore) {
+		fill(s, "general", 1, 5)
+		for seq, want := range map[uint64][]string{0: {"1", "2", "3", "4", "5"}, 3: {"4", "5"}, 5: {}, 9: {}} {
+			if got := msgTexts(s.Since("general", seq)); !slices.Equal(got, want) {
+				t.Errorf("Since(%d) = %q, want %q", seq, got, want)
+			}
+		}
+	})
+}
+
+func TestStoreTrimsToMax(t *testing.T) {
+	testStores(t, 3, func(t *testing.T, s HistoryStore) {
+		fill(s, "general", 1, 2)
+		held := s.All("general")
+		fill(s, "general", 3, 3)
+		if got := msgTexts(s.All("general")); !slices.Equal(got, []string{"3", "4", "5"}) {
+			t.Errorf("All = %q, want the newest 3", got)
+		}
+		if got := msgTexts(held); !slices.Equal(got, []string{"1", "2"}) {
+			t.Errorf("a slice from All changed to %q after later appends", got)
+		}
+	})
+}
+
+func TestStoreReplace(t *testing.T) {
+	testStores(t, 0, func(t *testing.T, s HistoryStore) {
+		fill(s, "general", 1, 3)
+		fill(s, "dev", 4, 1)
+		held := s.All("general")
+		s.Replace("general", []Message{held[0], held[2]})
+		if got := msgTexts(s.All("general")); !slices.Equal(got, []string{"1", "3"}) {
+			t.Errorf("after Replace: %q", got)
+		}
+		if got := msgTexts(held); !slices.Equal(got, []string{"1", "2", "3"}) {
+			t.Errorf("a slice from All changed to %q after Replace", got)
+		}
+		s.Replace("dev", nil)
+		if got := s.Rooms(); !slices.Equal(got, []string{"general"}) || len(s.All("dev")) != 0 {
+			t.Errorf("after clearing dev: Rooms() = %q, dev holds %q", got, msgTexts(s.All("dev")))
+		}
+		fill(s, "general", 5, 1) // appends after a Replace reach the file too
+	})
+}
+
+func TestStoreAllUnchangedByLaterWrites(t *testing.T) {
+	testStores(t, 3, func(t *testing.T, s HistoryStore) {
+		fill(s, "general", 1, 3)
+		before := s.All("general")
+		want := msgTexts(before)
+		fill(s, "general", 4, 2) // appends past the cap
+		if got := msgTexts(before); !slices.Equal(got, want) {
+			t.Errorf("slice from All became %v after Append, want %v", got, want)
+		}
+		s.Replace("general", []Message{{Seq: 9, Text: "9", Room: "general"}})
+		if got := msgTexts(before); !slices.Equal(got, want) {
+			t.Errorf("slice from All became %v after Replace, want %v", got, want)
+		}
+	})
+}
+
+func TestDeleteMine(t *testing.T) {
+	c := newTestServer(t)
+	newMockClient(t, "alice").register(t, c)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	send := func(sender, text string) {
+		t.Helper()
+		if err := c.Send(protocol.MessageArgs{Sender: sender, Text: text}, &protocol.HistoryReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("alice", "a1")
+	send("bob", "b1")
+	send("alice", "a2")
+	if err := c.Join(protocol.JoinArgs{ID: "alice", Room: "dev"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	send("alice", "a3")
+
+	// the newest two are in different rooms
+	var r protocol.ForgetReply
+	if err := c.DeleteMine(protocol.DeleteMineArgs{Sender: "alice", Count: 2}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Removed != 2 {
+		t.Errorf("removed %d, want 2", r.Removed)
+	}
+	if got := sentBy(c, "alice"); !slices.Equal(got, []string{"a1"}) {
+		t.Errorf("alice's entries left %q, want the oldest", got)
+	}
+	if got := sentBy(c, "bob"); !slices.Equal(got, []string{"b1"}) {
+		t.Errorf("bob's entries %q, want them untouched", got)
+	}
+	notice := func(m protocol.MessageArgs) bool { return strings.Contains(m.Text, "deleted their last") }
+	if got := bob.waitFor(t, 1, notice)[0].Text; got != "User alice deleted their last 2 messages" {
+		t.Errorf("bob was told %q", got)
+	}
+
+	r = protocol.ForgetReply{}
+	if err := c.DeleteMine(protocol.DeleteMineArgs{Sender: "alice", Count: 10}, &r); err != nil || r.Removed != 1 {
+		t.Errorf("deleting more than are left: removed %d, %v; want the 1 left", r.Removed, err)
+	}
+	if err := c.DeleteMine(protocol.DeleteMineArgs{Sender: "alice", Count: 0}, &r); err == nil {
+		t.Error("count 0: accepted")
+	}
+}
+
+func storeLine(t *testing.T, m Message) string {
+	t.Helper()
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b) + "\n"
+}
+
+func TestReadHistoryLongLine(t *testing.T) {
+	long := strings.Repeat("x", 2<<20) // over bufio.Scanner's old 1 MiB limit
+	in := storeLine(t, Message{Seq: 1, Sender: "alice", Text: "hi"}) + storeLine(t, Message{Seq: 2, Sender: "bob", Text: long})
+	msgs, err := readHistory(strings.NewReader(in), "test", 0)
+	if err != nil {
+		t.Fatalf("readHistory: %v", err)
+	}
+	if len(msgs) != 2 || msgs[1].Text != long {
+		t.Fatalf("got %d entries, want both with the long text intact", len(msgs))
+	}
+}
+
+func TestReadHistoryKeepsEntriesBeforeError(t *testing.T) {
+	boom := errors.New("disk on fire")
+	r := io.MultiReader(strings.NewReader(storeLine(t, Message{Seq: 1, Sender: "alice", Text: "hi"})+`{"Seq":2,"Sen`), iotest.ErrReader(boom))
+	msgs, err := readHistory(r, "test", 0)
+	if !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want %v", err, boom)
+	}
+	if len(msgs) != 1 || msgs[0].Text != "hi" {
+		t.Fatalf("got %+v, want the one complete entry", msgs)
+	}
+}
+
+func TestOpenStoreMovesUnreadableFileAside(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.jsonl")
+	// a directory in place of the file: it opens but every read fails
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "keep"), []byte("precious"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := openStore(path, 0)
+	store.Append(Message{Seq: 1, Sender: "alice", Text: "after", Room: defaultRoom})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _ := filepath.Glob(path + ".unreadable-*")
+	if len(matches) != 1 {
+		t.Fatalf("moved-aside copies: %v, want one", matches)
+	}
+	if b, err := os.ReadFile(filepath.Join(matches[0], "keep")); err != nil || string(b) != "precious" {
+		t.Fatalf("the unreadable store was not kept: %q, %v", b, err)
+	}
+	msgs, err := loadHistory(path, 0)
+	if err != nil || len(msgs) != 1 || msgs[0].Text != "after" {
+		t.Fatalf("new store holds %+v, %v; want the entry written after startup", msgs, err)
+	}
+}
+
+func TestOpenStoreKeepsGoodFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := os.WriteFile(path, []byte(storeLine(t, Message{Seq: 3, Sender: "alice", Text: "hi", Room: defaultRoom})), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, seq := openStore(path, 0)
+	defer store.Close()
+	if seq[defaultRoom] != 3 || len(store.All(defaultRoom)) != 1 {
+		t.Fatalf("seq %d, %d entries; want 3 and 1", seq[defaultRoom], len(store.All(defaultRoom)))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+// peered starts two servers relaying to each other.
+func peered(t *testing.T) (a, b *ChatServer) {
+	a, b = newTestServer(t), newTestServer(t)
+	a.peerToken, b.peerToken = "s3cret", "s3cret"
+	addrA, addrB := listen(t, a), listen(t, b)
+	a.peers = []*peerLink{newPeerLink(addrB, "s3cret", nil, false)}
+	b.peers = []*peerLink{newPeerLink(addrA, "s3cret", nil, false)}
+	return a, b
+}
+
+// sentBy returns the texts of sender's entries in c's history.
+func sentBy(c *ChatServer, sender string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for _, r := range c.history.Rooms() {
+		for _, m := range c.history.All(r) {
+			if m.Sender == sender {
+				out = append(out, m.Text)
+			}
+		}
+	}
+	return out
+}
+
+func TestPeersExchangeMessages(t *testing.T) {
+	a, b := peered(t)
+	alice := newMockClient(t, "alice")
+	alice.register(t, a)
+	bob := newMockClient(t, "bob")
+	bob.register(t, b)
+
+	if err := a.Send(protocol.MessageArgs{Sender: "alice", Text: "hi from a"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0].Text; got != "alice: hi from a" {
+		t.Errorf("bob on b received %q", got)
+	}
+	if err := b.Send(protocol.MessageArgs{Sender: "bob", Text: "hi from b"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := alice.waitFor(t, 1, chat)[0].Text; got != "bob: hi from b" {
+		t.Errorf("alice on a received %q", got)
+	}
+	// neither message came back to its own server as a relay
+	if got := sentBy(a, "alice"); len(got) != 1 {
+		t.Errorf("a holds alice's entries %q, want one", got)
+	}
+	if got := sentBy(b, "bob"); len(got) != 1 {
+		t.Errorf("b holds bob's entries %q, want one", got)
+	}
+	if got := sentBy(b, "alice"); len(got) != 1 || got[0] != "hi from a" {
+		t.Errorf("b holds alice's entries %q, want the relayed message", got)
+	}
+}
+
+func TestRelayNeedsPeer(t *testing.T) {
+	c := newTestServer(t)
+	c.peerToken = "s3cret"
+	conn := dial(t, listen(t, c))
+	relay := RelayArgs{Msg: protocol.MessageArgs{Sender: "mallory", Text: "forged"}}
+
+	if err := conn.Call("ChatServer.Relay", relay, &struct{}{}); err == nil {
+		t.Error("Relay without Peer: no error")
+	}
+	if err := conn.Call("ChatServer.Peer", PeerArgs{Token: "guess"}, &struct{}{}); err == nil {
+		t.Error("Peer with the wrong token: no error")
+	}
+	if err := conn.Call("ChatServer.Relay", relay, &struct{}{}); err == nil {
+		t.Error("Relay after a refused Peer: no error")
+	}
+	if got := sentBy(c, "mallory"); len(got) != 0 {
+		t.Errorf("history holds refused relays %q", got)
+	}
+
+	if err := conn.Call("ChatServer.Peer", PeerArgs{Token: "s3cret"}, &struct{}{}); err != nil {
+		t.Fatalf("Peer with the right token: %v", err)
+	}
+	if err := conn.Call("ChatServer.Relay", relay, &struct{}{}); err != nil {
+		t.Errorf("Relay after Peer: %v", err)
+	}
+}
+
+func TestPeersForget(t *testing.T) {
+	a, b := peered(t)
+	alice := newMockClient(t, "alice")
+	alice.register(t, a)
+	bob := newMockClient(t, "bob")
+	bob.register(t, b)
+	for _, text := range []string{"one", "two", "three"} {
+		if err := a.SendAck(protocol.MessageArgs{Sender: "alice", Text: text}, &protocol.SendAck{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob.waitFor(t, 3, chat)
+
+	notice := func(m protocol.MessageArgs) bool { return m.Kind == "" && m.Sender == "alice" && m.Seq == 0 }
+	var deleted protocol.ForgetReply
+	if err := a.DeleteMine(protocol.DeleteMineArgs{Sender: "alice", Count: 2}, &deleted); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitFor(t, 1, notice)
+	if got := sentBy(b, "alice"); len(got) != 1 || got[0] != "one" {
+		t.Errorf("after delmine 2, b holds alice's entries %q, want [one]", got)
+	}
+
+	var forgot protocol.ForgetReply
+	if err := a.ForgetMe(protocol.ForgetArgs{ID: "alice"}, &forgot); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitFor(t, 2, notice)
+	if got := sentBy(b, "alice"); len(got) != 0 {
+		t.Errorf("after forgetme, b still holds alice's entries %q", got)
+	}
+	if got := sentBy(a, "alice"); len(got) != 0 {
+		t.Errorf("after forgetme, a still holds alice's entries %q", got)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+// texts returns the text of each message.
+func texts(msgs []protocol.MessageArgs) []string {
+	var out []string
+	for _, m := range msgs {
+		out = append(out, m.Text)
+	}
+	return out
+}
+
+func TestLeaveGraceHidesQuickRejoin(t *testing.T) {
+	c := newTestServer(t)
+	c.leaveGrace = 200 * time.Millisecond
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	bob.waitFor(t, 1, func(protocol.MessageArgs) bool { return true })
+
+	if err := c.Unregister(alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	alice.register(t, c) // back within the grace period
+	time.Sleep(2 * c.leaveGrace)
+	if got := texts(bob.received()); !slices.Equal(got, []string{"User alice joined"}) {
+		t.Errorf("after a quick rejoin bob saw %q, want only the first join", got)
+	}
+
+	if err := c.Unregister(alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	left := bob.waitFor(t, 2, func(protocol.MessageArgs) bool { return true })[1]
+	if left.Text != "User alice left" {
+		t.Errorf("bob then saw %q, want the leave", left.Text)
+	}
+	if d := time.Since(start); d < c.leaveGrace/2 {
+		t.Errorf("leave announced after %v, want it held back for about %v", d, c.leaveGrace)
+	}
+}
+
+func TestRecentlyLeftKeepsLatest(t *testing.T) {
+	c := newTestServer(t)
+	for i := 0; i < recentLeftMax+5; i++ {
+		m := newMockClient(t, fmt.Sprint("u", i))
+		m.register(t, c)
+		if err := c.Unregister(m.registerArgs(), &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var r protocol.RecentLeftReply
+	if err := c.RecentlyLeft(struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Users) != recentLeftMax {
+		t.Fatalf("RecentlyLeft returned %d users, want %d", len(r.Users), recentLeftMax)
+	}
+	for i, u := range r.Users {
+		if want := fmt.Sprint("u", i+5); u.ID != want {
+			t.Errorf("entry %d is %s, want %s", i, u.ID, want)
+		}
+		if i > 0 && u.At.Before(r.Users[i-1].At) {
+			t.Errorf("entry %d left before entry %d", i, i-1)
+		}
+	}
+}
+
+func TestSilentJoins(t *testing.T) {
+	c := newTestServer(t)
+	c.silentJoins = true
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unregister(alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "bye"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitFor(t, 1, chat)
+	if got := texts(bob.received()); !slices.Equal(got, []string{"alice: hi"}) {
+		t.Errorf("bob received %q, want only the chat message", got)
+	}
+	var h protocol.HistoryReply
+	if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice: hi", "bob: bye"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("history %q, want %q", h.Messages, want)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	c := newTestServer(t)
+	for _, id := range []string{"carol", "alice", "bob"} {
+		newMockClient(t, id).register(t, c)
+	}
+	if err := c.Unregister(protocol.RegisterArgs{ID: "bob"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	var r protocol.ListUsersReply
+	if err := c.ListUsers(struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "carol"}; !slices.Equal(r.Users, want) {
+		t.Errorf("ListUsers = %q, want %q", r.Users, want)
+	}
+}
+
+// latestUsers waits until the newest user list m was pushed is want.
+func (m *mockClient) latestUsers(tb testing.TB, want []string) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var got protocol.UsersUpdate
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		for _, u := range m.users {
+			if u.Version > got.Version {
+				got = u
+			}
+		}
+		m.mu.Unlock()
+		if slices.Equal(got.Users, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatalf("%s's newest user list is %q (version %d), want %q", m.id, got.Users, got.Version, want)
+}
+
+func TestPushUsers(t *testing.T) {
+	c := newTestServer(t)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	alice.latestUsers(t, []string{"alice"})
+
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	alice.latestUsers(t, []string{"alice", "bob"})
+	bob.latestUsers(t, []string{"alice", "bob"})
+
+	if err := c.Rename(protocol.RenameArgs{ID: "bob", NewID: "rob"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	alice.latestUsers(t, []string{"alice", "rob"})
+
+	if err := c.Unregister(protocol.RegisterArgs{ID: "rob"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	alice.latestUsers(t, []string{"alice"})
+}
+
+func TestSendRejectsUserLists(t *testing.T) {
+	c := newTestServer(t)
+	newMockClient(t, "alice").register(t, c)
+	forged := protocol.MessageArgs{Sender: "alice", Kind: "users", Users: &protocol.UsersUpdate{Users: []string{"alice", "admin"}, Version: 1 << 40}}
+	if err := c.Send(forged, &protocol.HistoryReply{}); err == nil || !strings.Contains(err.Error(), "server only") {
+		t.Errorf("Send of a user list: %v, want it refused", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestRoomsScopeMessages(t *testing.T) {
+	c := newTestServer(t)
+	addr := listen(t, c)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	carol := newMockClient(t, "carol")
+	cc := dial(t, addr)
+	args := carol.registerArgs()
+	args.Room = "dev"
+	if err := cc.Call("ChatServer.Register", args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "in general"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "carol", Text: "in dev"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0]; got.Text != "alice: in general" || got.Room != defaultRoom {
+		t.Errorf("bob received %+v, want alice's message in %s", got, defaultRoom)
+	}
+	var h protocol.HistoryReply
+	if err := cc.Call("ChatServer.History", struct{}{}, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"User carol joined", "carol: in dev"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("carol's history %q, want only the dev room's %q", h.Messages, want)
+	}
+
+	// bob moves to dev: general hears him leave, dev hears him join
+	if err := c.Join(protocol.JoinArgs{ID: "bob", Room: "dev"}, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"User carol joined", "carol: in dev", "User bob joined"}; !slices.Equal(h.Messages, want) {
+		t.Errorf("Join returned %q, want dev's history %q", h.Messages, want)
+	}
+	isNotice := func(m protocol.MessageArgs) bool { return m.Sender == "bob" }
+	if got := alice.waitFor(t, 2, isNotice)[1]; got.Kind != "leave" || got.Room != defaultRoom {
+		t.Errorf("alice saw %+v, want bob leaving %s", got, defaultRoom)
+	}
+	if got := carol.waitFor(t, 1, isNotice)[0]; got.Kind != "join" || got.Room != "dev" {
+		t.Errorf("carol saw %+v, want bob joining dev", got)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "anyone?"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "carol", Text: "hi bob"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range bob.waitFor(t, 2, chat)[1:] {
+		if m.Text != "carol: hi bob" {
+			t.Errorf("bob in dev received %q, want only dev's messages", m.Text)
+		}
+	}
+
+	for _, bad := range []string{"", "two words", "a-very-long-room-name-that-goes-on-and-on"} {
+		if err := c.Join(protocol.JoinArgs{ID: "bob", Room: bad}, &h); err == nil {
+			t.Errorf("join %q: accepted", bad)
+		}
+	}
+	if err := c.Join(protocol.JoinArgs{ID: "nobody", Room: "dev"}, &h); err == nil {
+		t.Error("join for an unregistered ID: accepted")
+	}
+}
+
+func TestRoomCreatePolicy(t *testing.T) {
+	for _, policy := range []string{"open", "admin"} {
+		t.Run(policy, func(t *testing.T) {
+			c := newTestServer(t)
+			c.adminToken = "s3cret"
+			c.roomCreate = policy
+			newMockClient(t, "alice").register(t, c)
+			newMockClient(t, "bob").register(t, c)
+			var h protocol.HistoryReply
+
+			err := c.Join(protocol.JoinArgs{ID: "bob", Room: "dev"}, &h)
+			carol := newMockClient(t, "carol")
+			args := carol.registerArgs()
+			args.Room = "ops"
+			regErr := c.Register(args, &struct{}{})
+			if policy == "open" {
+				if err != nil || regErr != nil {
+					t.Fatalf("creating rooms by joining: %v; by registering: %v", err, regErr)
+				}
+				return
+			}
+			if err == nil || err.Error() != "room does not exist" {
+				t.Errorf("bob joining a missing room: %v, want room does not exist", err)
+			}
+			if regErr == nil || regErr.Error() != "room does not exist" {
+				t.Errorf("carol registering into a missing room: %v, want room does not exist", regErr)
+			}
+			if err := c.Join(protocol.JoinArgs{ID: "alice", Room: "dev", Token: "s3cret"}, &h); err != nil {
+				t.Fatalf("an admin creating dev: %v", err)
+			}
+			if err := c.Join(protocol.JoinArgs{ID: "bob", Room: "dev"}, &h); err != nil {
+				t.Errorf("bob joining dev once it exists: %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxRooms(t *testing.T) {
+	c := newTestServer(t)
+	c.maxRooms = 2 // general and one more
+	for _, id := range []string{"alice", "bob", "carol"} {
+		newMockClient(t, id).register(t, c)
+	}
+	var h protocol.HistoryReply
+	if err := c.Join(protocol.JoinArgs{ID: "alice", Room: "dev"}, &h); err != nil {
+		t.Fatalf("creating the second room: %v", err)
+	}
+	if err := c.Join(protocol.JoinArgs{ID: "bob", Room: "ops"}, &h); err == nil {
+		t.Error("creating a third room past -maxrooms 2: accepted")
+	}
+	if err := c.Join(protocol.JoinArgs{ID: "carol", Room: "dev"}, &h); err != nil {
+		t.Errorf("joining a room that exists at the cap: %v", err)
+	}
+	c.mu.Lock()
+	room := c.roomOfLocked("bob")
+	c.mu.Unlock()
+	if room != defaultRoom {
+		t.Errorf("refused bob is in %s, want still in %s", room, defaultRoom)
+	}
+}
+
+func TestSeveralRooms(t *testing.T) {
+	c := newTestServer(t)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	if err := c.Join(protocol.JoinArgs{ID: "bob", Room: "dev"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice adds dev and keeps general: she hears both, and sends to dev
+	if err := c.Join(protocol.JoinArgs{ID: "alice", Room: "dev", Keep: true}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "to dev"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0]; got.Text != "alice: to dev" || got.Room != "dev" {
+		t.Errorf("bob received %+v, want alice's message in dev", got)
+	}
+	if err := c.Join(protocol.JoinArgs{ID: "bob", Room: defaultRoom}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "to general"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	fromBob := func(m protocol.MessageArgs) bool { return chat(m) && m.Sender == "bob" }
+	if got := alice.waitFor(t, 1, fromBob)[0]; got.Room != defaultRoom {
+		t.Errorf("alice received %+v, want bob's message in %s", got, defaultRoom)
+	}
+
+	for _, tc := range []struct{ room, want string }{
+		{"dev", "dev is the room you send to; join another room first"},
+		{"ops", "you are not in room ops"},
+	} {
+		if err := c.Part(protocol.JoinArgs{ID: "alice", Room: tc.room}, &struct{}{}); err == nil || err.Error() != tc.want {
+			t.Errorf("part %s: %v, want %q", tc.room, err, tc.want)
+		}
+	}
+	if err := c.Part(protocol.JoinArgs{ID: "alice", Room: defaultRoom}, &struct{}{}); err != nil {
+		t.Fatalf("part %s: %v", defaultRoom, err)
+	}
+	isLeave := func(m protocol.MessageArgs) bool { return m.Kind == "leave" && m.Sender == "alice" }
+	if got := bob.waitFor(t, 1, isLeave)[0]; got.Room != defaultRoom {
+		t.Errorf("bob saw %+v, want alice leaving %s", got, defaultRoom)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "gone?"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join(protocol.JoinArgs{ID: "bob", Room: "dev", Keep: true}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "still in dev"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	alice.waitFor(t, 1, func(m protocol.MessageArgs) bool { return m.Text == "bob: still in dev" })
+	for _, m := range alice.received() {
+		if m.Text == "bob: gone?" {
+			t.Errorf("alice received %+v after parting %s", m, defaultRoom)
+		}
+	}
+
+	// leaving the server announces the leave in every room
+	if err := c.Join(protocol.JoinArgs{ID: "alice", Room: defaultRoom, Keep: true}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unregister(alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	var rooms []string
+	for _, m := range bob.waitFor(t, 3, isLeave)[1:] {
+		rooms = append(rooms, m.Room)
+	}
+	slices.Sort(rooms)
+	if want := []string{"dev", defaultRoom}; !slices.Equal(rooms, want) {
+		t.Errorf("alice's leave announced in %q, want %q", rooms, want)
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestSendReportsRecipients(t *testing.T) {
+	c := newTestServer(t)
+	send := func(sender string) int {
+		t.Helper()
+		var reply protocol.HistoryReply
+		if err := c.Send(protocol.MessageArgs{Sender: sender, Text: "hi"}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Recipients
+	}
+	if n := send("alice"); n != 0 {
+		t.Errorf("empty room: %d recipients, want 0", n)
+	}
+	newMockClient(t, "bob").register(t, c)
+	if n := send("alice"); n != 1 {
+		t.Errorf("alice with bob online: %d recipients, want 1", n)
+	}
+	if n := send("bob"); n != 0 {
+		t.Errorf("bob alone: %d recipients, want 0 since senders are not echoed", n)
+	}
+}
+
+func TestSendExpandsMacros(t *testing.T) {
+	c := newTestServer(t)
+	newMockClient(t, "bob").register(t, c)
+	send := func(text string) string {
+		t.Helper()
+		var reply protocol.HistoryReply
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: text}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Messages[len(reply.Messages)-1]
+	}
+	if got := send("!users online, !nope"); got != "alice: !users online, !nope" {
+		t.Errorf("without -macros: %q", got)
+	}
+	c.macros = true
+	if got := send("!users online, !nope"); got != "alice: 1 online, !nope" {
+		t.Errorf("with -macros: %q, want !users expanded and !nope kept", got)
+	}
+	if got := send("up !uptime"); got == "alice: up !uptime" {
+		t.Errorf("!uptime was not expanded: %q", got)
+	}
+}
+
+func TestSendAddsSenderName(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	var reply protocol.HistoryReply
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := reply.Messages[len(reply.Messages)-1]; got != "alice: hi" {
+		t.Errorf("history entry %q, want %q", got, "alice: hi")
+	}
+	if got := bob.waitFor(t, 1, chat)[0]; got.Text != "alice: hi" || got.Sender != "alice" {
+		t.Errorf("bob received %+v, want the line as history shows it", got)
+	}
+}
+
+func TestSenderNamedOnce(t *testing.T) {
+	c := newTestServer(t)
+	addr := listen(t, c)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	alice := newMockClient(t, "alice")
+	ac := dial(t, addr)
+	if err := ac.Call("ChatServer.Register", alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent protocol.HistoryReply
+	if err := ac.Call("ChatServer.Send", protocol.MessageArgs{Sender: "alice", Text: "hello"}, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if got := sent.Messages[len(sent.Messages)-1]; got != "alice: hello" {
+		t.Errorf("Send reply ends with %q, want %q", got, "alice: hello")
+	}
+	var h protocol.HistoryReply
+	if err := ac.Call("ChatServer.History", struct{}{}, &h); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Messages[len(h.Messages)-1]; got != "alice: hello" {
+		t.Errorf("History ends with %q, want %q", got, "alice: hello")
+	}
+	if got := bob.waitFor(t, 1, chat)[0].Text; got != "alice: hello" {
+		t.Errorf("bob received %q, want %q", got, "alice: hello")
+	}
+}
+
+func TestSendBinaryPayload(t *testing.T) {
+	c := newTestServer(t)
+	c.maxBlob = 8
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	data := []byte{0, 0xff, 0xfe, '\n', 0}
+	var reply protocol.HistoryReply
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "ignored", Data: data}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply.Messages[len(reply.Messages)-1], "alice: [sent application/octet-stream, 5 bytes]"; got != want {
+		t.Errorf("history entry %q, want %q", got, want)
+	}
+	got := bob.waitFor(t, 1, chat)[0]
+	if !bytes.Equal(got.Data, data) || got.ContentType != "application/octet-stream" || got.Text != "" {
+		t.Errorf("bob received %+v, want the payload unchanged with the default content type", got)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Data: make([]byte, 9)}, &reply); err == nil {
+		t.Error("payload over -maxblob: accepted")
+	}
+}
+
+// TestHistoryDuringSends reads history while several senders write. Each
+// snapshot must hold an unbroken run of every sender's messages from the first.
+func TestHistoryDuringSends(t *testing.T) {
+	c := newTestServer(t)
+	const senders, each = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < senders; w++ {
+		wg.Add(1)
+		go func(sender string) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if err := c.Send(protocol.MessageArgs{Sender: sender, Text: strconv.Itoa(i)}, &protocol.HistoryReply{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(fmt.Sprint("w", w))
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			if reads == 0 {
+				t.Log("sends finished before the first read")
+			}
+			return
+		default:
+		}
+		var h protocol.HistoryReply
+		if err := c.roomHistory(defaultRoom, 0, &h); err != nil {
+			t.Fatal(err)
+		}
+		next := make(map[string]int)
+		for _, line := range h.Messages {
+			sender, text, _ := strings.Cut(line, ": ")
+			if text != strconv.Itoa(next[sender]) {
+				t.Fatalf("snapshot has %q where %s's message %d belongs", line, sender, next[sender])
+			}
+			next[sender]++
+		}
+	}
+}
+
+// BenchmarkHistoryDuringSends times Send while two goroutines keep reading
+// history, starting from 1000 entries. "locked" has the readers format history
+// with c.mu held, as History did before snapshots, so each Send waits behind a
+// whole read; "snapshot" is History as it is now.
+func BenchmarkHistoryDuringSends(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		history func(*ChatServer, *protocol.HistoryReply)
+	}{
+		{"locked", func(c *ChatServer, reply *protocol.HistoryReply) {
+			c.mu.Lock()
+			reply.Messages = formatHistory(c.history.All(defaultRoom), "")
+			c.mu.Unlock()
+		}},
+		{"snapshot", func(c *ChatServer, reply *protocol.HistoryReply) { c.roomHistory(defaultRoom, 0, reply) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			c := newTestServer(b)
+			for i := 0; i < 1000; i++ {
+				c.Send(protocol.MessageArgs{Sender: "alice", Text: strconv.Itoa(i)}, &protocol.HistoryReply{})
+			}
+			stop := make(chan struct{})
+			var readers sync.WaitGroup
+			for r := 0; r < 2; r++ {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						var h protocol.HistoryReply
+						bm.history(c, &h)
+					}
+				}()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Send(protocol.MessageArgs{Sender: "bob", Text: strconv.Itoa(i)}, &protocol.HistoryReply{})
+			}
+			b.StopTimer()
+			close(stop)
+			readers.Wait()
+		})
+	}
+}
+
+func TestSendTable(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	tbl := &protocol.Table{Headers: []string{"name", "age"}, Rows: [][]string{{"bob", "42"}}}
+	var reply protocol.HistoryReply
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Kind: "table", Table: tbl}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply.Messages[len(reply.Messages)-1], "alice: [name | age; bob | 42]"; got != want {
+		t.Errorf("history entry %q, want %q", got, want)
+	}
+	got := bob.waitFor(t, 1, func(m protocol.MessageArgs) bool { return m.Kind == "table" })[0]
+	if got.Table == nil || !slices.Equal(got.Table.Rows[0], tbl.Rows[0]) {
+		t.Errorf("bob received %+v, want the table", got)
+	}
+
+	for _, bad := range []*protocol.Table{nil, {}, {Headers: []string{"a", "b"}, Rows: [][]string{{"1"}}}} {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Kind: "table", Table: bad}, &reply); err == nil {
+			t.Errorf("table %+v: accepted", bad)
+		}
+	}
+}
+
+func TestHereAndEveryone(t *testing.T) {
+	c := newTestServer(t)
+	c.adminToken = "s3cret"
+	alice := newMockClient(t, "alice")
+	args := alice.registerArgs()
+	args.AdminToken = "s3cret"
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	bob, carol := newMockClient(t, "bob"), newMockClient(t, "carol")
+	bob.register(t, c)
+	carol.register(t, c)
+	dave := newMockClient(t, "dave")
+	args = dave.registerArgs()
+	args.Room = "dev"
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.clients["carol"].lastActive = time.Now().Add(-time.Hour) // connected, but away
+	c.mu.Unlock()
+	pinged := func(m *mockClient, text string) bool {
+		t.Helper()
+		return m.waitFor(t, 1, func(got protocol.MessageArgs) bool { return strings.HasSuffix(got.Text, text) })[0].Mentioned
+	}
+
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "@here standup"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if !pinged(alice, "@here standup") || pinged(carol, "@here standup") {
+		t.Error("@here: want alice, who is active, pinged and carol, who is idle, not")
+	}
+
+	err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "@everyone lunch"}, &protocol.HistoryReply{})
+	if err == nil || !strings.Contains(err.Error(), "only admins") {
+		t.Errorf("@everyone from bob, not an admin: %v, want refused", err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "@everyone lunch"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatalf("@everyone from alice, an admin: %v", err)
+	}
+	if !pinged(bob, "@everyone lunch") || !pinged(carol, "@everyone lunch") {
+		t.Error("@everyone: want bob and carol pinged")
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "mail me at alice@here.example"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if pinged(bob, "alice@here.example") {
+		t.Error("an address containing @here pinged bob")
+	}
+
+	c.mu.Lock()
+	c.everyone = "anyone"
+	c.mu.Unlock()
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "@EVERYONE cake"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatalf("@everyone from bob under -everyone anyone: %v", err)
+	}
+	if !pinged(alice, "@EVERYONE cake") {
+		t.Error("@EVERYONE from bob didn't ping alice")
+	}
+	for _, m := range dave.received() {
+		if m.Sender != "dave" && m.Mentioned {
+			t.Errorf("dave in another room was pinged by %q", m.Text)
+		}
+	}
+}
+
+func TestSendPrivate(t *testing.T) {
+	c := newTestServer(t)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	carol := newMockClient(t, "carol")
+	carol.register(t, c)
+	var before protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &before)
+
+	private := func(m protocol.MessageArgs) bool { return m.Kind == "private" }
+	args := protocol.PrivateArgs{Msg: protocol.MessageArgs{Sender: "alice", Text: "psst"}, To: "bob"}
+	if err := c.SendPrivate(args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "alice -> bob (private): psst"
+	if got := bob.waitFor(t, 1, private)[0].Text; got != want {
+		t.Errorf("bob received %q, want %q", got, want)
+	}
+	if got := alice.waitFor(t, 1, private)[0].Text; got != want {
+		t.Errorf("alice's own copy is %q, want %q", got, want)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "public"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	carol.waitFor(t, 1, chat)
+	for _, m := range carol.received() {
+		if private(m) {
+			t.Errorf("carol received the private message %q", m.Text)
+		}
+	}
+	var after protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &after)
+	if len(after.Messages) != len(before.Messages)+1 {
+		t.Errorf("history went from %q to %q, want only the public message added", before.Messages, after.Messages)
+	}
+
+	args.To = "dave"
+	if err := c.SendPrivate(args, &struct{}{}); err == nil {
+		t.Error("private message to someone offline: no error")
+	}
+}
+
+func TestRoleDM(t *testing.T) {
+	c := newTestServer(t)
+	c.adminToken = "s3cret"
+	alice := newMockClient(t, "alice")
+	args := alice.registerArgs()
+	args.AdminToken = "s3cret"
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	bob, carol, dave := newMockClient(t, "bob"), newMockClient(t, "carol"), newMockClient(t, "dave")
+	for _, m := range []*mockClient{bob, carol, dave} {
+		m.register(t, c)
+	}
+	if err := c.SetRole(protocol.RoleArgs{Token: "guess", Target: "dave", Role: "mod"}, &struct{}{}); err == nil {
+		t.Error("SetRole without the admin token: no error")
+	}
+	for _, id := range []string{"bob", "carol"} {
+		if err := c.SetRole(protocol.RoleArgs{Token: "s3cret", Target: id, Role: "mod"}, &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roleDM := func(sender, role, token, text string) error {
+		return c.RoleDM(protocol.RoleDMArgs{Msg: protocol.MessageArgs{Sender: sender, Text: text}, Role: role, Token: token}, &struct{}{})
+	}
+
+	if err := roleDM("alice", "mod", "s3cret", "please review"); err != nil {
+		t.Fatal(err)
+	}
+	isDM := func(m protocol.MessageArgs) bool { return strings.HasSuffix(m.Text, "please review") }
+	for _, m := range []*mockClient{bob, carol, alice} {
+		if got := m.waitFor(t, 1, isDM)[0]; got.Kind != "private" || got.Text != "alice -> @mod (private, 2 online): please review" {
+			t.Errorf("%s received %+v, want the role DM", m.id, got)
+		}
+	}
+	if err := roleDM("bob", "mod", "", "mods only"); err != nil {
+		t.Errorf("a mod messaging mods: %v", err)
+	}
+	carol.waitFor(t, 1, func(m protocol.MessageArgs) bool { return strings.HasSuffix(m.Text, "mods only") })
+	if err := roleDM("dave", "mod", "", "let me in"); err == nil {
+		t.Error("dave, not a mod, messaged the mods")
+	}
+	if err := roleDM("bob", "admin", "", "hello boss"); err == nil {
+		t.Error("bob, not an admin, messaged the admins")
+	}
+	err := roleDM("alice", "ops", "s3cret", "anyone?")
+	if err == nil || err.Error() != "no one else online holds role ops" {
+		t.Errorf("role DM to an empty role: %v", err)
+	}
+
+	for _, m := range dave.received() {
+		if strings.Contains(m.Text, "@mod") {
+			t.Errorf("dave, not a mod, received %q", m.Text)
+		}
+	}
+	if got := len(bob.waitFor(t, 1, isDM)); got != 1 {
+		t.Errorf("bob received the role DM %d times, want once", got)
+	}
+	var h protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &h)
+	for _, line := range h.Messages {
+		if strings.Contains(line, "please review") || strings.Contains(line, "mods only") {
+			t.Errorf("role DM %q kept in the public history", line)
+		}
+	}
+
+	var roles protocol.RolesReply
+	if err := c.Roles(struct{}{}, &roles); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(roles.Roles["mod"], []string{"bob", "carol"}) || !slices.Equal(roles.Roles["admin"], []string{"alice"}) {
+		t.Errorf("roles %v, want mod: bob, carol and admin: alice", roles.Roles)
+	}
+	if err := c.SetRole(protocol.RoleArgs{Token: "s3cret", Target: "carol", Role: "mod", Remove: true}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleDM("alice", "mod", "s3cret", "just bob"); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitFor(t, 1, func(m protocol.MessageArgs) bool { return strings.HasSuffix(m.Text, "just bob") })
+	for _, m := range carol.received() {
+		if strings.HasSuffix(m.Text, "just bob") {
+			t.Error("carol received a role DM after losing the role")
+		}
+	}
+}
+
+func TestSendRateLimit(t *testing.T) {
+	c := newTestServer(t)
+	c.sendRate, c.sendBurst = 10, 5
+	newMockClient(t, "alice").register(t, c)
+	for i := 0; i < 5; i++ {
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: strconv.Itoa(i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatalf("send %d of a burst of 5: %v", i+1, err)
+		}
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "one too many"}, &protocol.HistoryReply{}); !errors.Is(err, errRateLimited) {
+		t.Errorf("send 6 of a burst of 5: %v, want %v", err, errRateLimited)
+	}
+	time.Sleep(150 * time.Millisecond) // one token back at 10/s
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "later"}, &protocol.HistoryReply{}); err != nil {
+		t.Errorf("send after the allowance refilled: %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		tokens, rate float64
+		want         time.Duration
+	}{
+		{0.4, 0.5, 1200 * time.Millisecond},
+		{0, 10, 100 * time.Millisecond},
+		{0.99, 10, 100 * time.Millisecond}, // 1ms rounds up
+		{0.75, 0.1, 2500 * time.Millisecond},
+		{-1, 1, 2 * time.Second},
+	} {
+		if got := retryAfter(tc.tokens, tc.rate); got != tc.want {
+			t.Errorf("retryAfter(%g tokens, %g/s) = %s, want %s", tc.tokens, tc.rate, got, tc.want)
+		}
+	}
+
+	// the sender hears it: 0.4 tokens at 0.5/s are 1.2s from the next message
+	c := newTestServer(t)
+	c.sendRate, c.sendBurst = 0.5, 1
+	newMockClient(t, "alice").register(t, c)
+	c.mu.Lock()
+	c.clients["alice"].tokens, c.clients["alice"].refilled = 0.4, time.Now()
+	c.mu.Unlock()
+	err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "too soon"}, &protocol.HistoryReply{})
+	if want := "rate limited, retry in 1.2s"; err == nil || err.Error() != want {
+		t.Errorf("send with 0.4 tokens: %v, want %q", err, want)
+	}
+}
+
+func TestSendGraceDelays(t *testing.T) {
+	c := newTestServer(t)
+	c.sendRate, c.sendBurst = 0.01, 2 // no refill to speak of during the test
+	c.sendGrace, c.graceDelay, c.graceDelayMax = 3, 50*time.Millisecond, 120*time.Millisecond
+	newMockClient(t, "alice").register(t, c)
+	for i, want := range []time.Duration{0, 0, 50 * time.Millisecond, 100 * time.Millisecond, 120 * time.Millisecond} {
+		start := time.Now()
+		if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: strconv.Itoa(i)}, &protocol.HistoryReply{}); err != nil {
+			t.Fatalf("send %d, within burst and grace: %v", i+1, err)
+		}
+		took := time.Since(start)
+		if took < want || want == 0 && took >= c.graceDelay {
+			t.Errorf("send %d took %s, want a delay of %s", i+1, took, want)
+		}
+	}
+	err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "past the grace"}, &protocol.HistoryReply{})
+	// 3 messages in debt, the limit of the grace: one token back is 100s at 0.01/s
+	if want := "rate limited, retry in 1m39."; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("send past burst and grace: %v, want %q...", err, want)
+	}
+}
+
+func TestSendLengthLimitCountsRunes(t *testing.T) {
+	c := newTestServer(t)
+	c.maxLen = 5
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "héllö"}, &protocol.HistoryReply{}); err != nil {
+		t.Errorf("5 characters in 7 bytes: %v", err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "héllö!"}, &protocol.HistoryReply{}); err == nil {
+		t.Error("6 characters over a limit of 5: accepted")
+	}
+	newMockClient(t, "bob").register(t, c)
+	long := protocol.PrivateArgs{Msg: protocol.MessageArgs{Sender: "alice", Text: strings.Repeat("x", 6)}, To: "bob"}
+	if err := c.SendPrivate(long, &struct{}{}); err == nil {
+		t.Error("private message over the limit: accepted")
+	}
+	var h protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &h)
+	if last := h.Messages[len(h.Messages)-1]; last != "User bob joined" || len(h.Messages) != 2 {
+		t.Errorf("history %q, want the refused messages left out", h.Messages)
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	before := time.Now()
+	var ack protocol.SendAck
+	if err := c.SendAck(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	var h protocol.HistoryReply
+	c.roomHistory(defaultRoom, 0, &h)
+	if ack.Seq != h.Last || ack.Recipients != 1 || ack.Time.Before(before) {
+		t.Errorf("ack %+v, want seq %d, 1 recipient and a time after %v", ack, h.Last, before)
+	}
+	if got := bob.waitFor(t, 1, chat)[0]; got.Text != "alice: hi" || got.Seq != ack.Seq {
+		t.Errorf("bob received %+v, want the acknowledged message", got)
+	}
+	if err := c.SendAck(protocol.MessageArgs{Sender: "alice", Data: make([]byte, c.maxBlob+1)}, &ack); err == nil {
+		t.Error("SendAck of an oversized payload: accepted")
+	}
+}
+
+func TestFloodPenaltiesEscalateAndDecay(t *testing.T) {
+	c := newTestServer(t)
+	c.sendRate, c.sendBurst = 0.01, 1 // no refill to speak of during the test
+	steps, err := parsePenalties("warn,100ms,mute=200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.penalties, c.offenseDecay = steps, 300*time.Millisecond
+	newMockClient(t, "alice").register(t, c)
+	send := func() error {
+		return c.Send(protocol.MessageArgs{Sender: "alice", Text: "spam"}, &protocol.HistoryReply{})
+	}
+	expect := func(what, want string) {
+		t.Helper()
+		if err := send(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want an error containing %q", what, err, want)
+		}
+	}
+	if err := send(); err != nil {
+		t.Fatalf("within the burst: %v", err)
+	}
+	expect("1st offense", "warning")
+	expect("2nd offense", "can't send for 100ms")
+	expect("during the cooldown", "cooling down")
+	time.Sleep(110 * time.Millisecond)
+	expect("3rd offense", "muted for flooding for 200ms")
+	expect("during the mute", "muted for flooding, 1s left")
+	time.Sleep(210 * time.Millisecond)
+	expect("4th offense, the last step repeating", "muted for flooding for 200ms")
+
+	// three decay periods without offending forgive three of the four offenses
+	time.Sleep(3*c.offenseDecay + 50*time.Millisecond)
+	expect("after the decay", "can't send for 100ms")
+
+	if got := formatPenalties(steps); got != "warn,100ms,mute=200ms" {
+		t.Errorf("formatPenalties = %q, want the schedule back", got)
+	}
+	for _, bad := range []string{"warn,soon", "mute=", "0s"} {
+		if _, err := parsePenalties(bad); err == nil {
+			t.Errorf("parsePenalties(%q): no error", bad)
+		}
+	}
+	if steps, err := parsePenalties("off"); err != nil || steps != nil {
+		t.Errorf("parsePenalties(off) = %v, %v; want no schedule", steps, err)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that log handlers on several goroutines can share.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestJSONLogMessageSent(t *testing.T) {
+	var out lockedBuffer
+	defer func(l *slog.Logger) { jsonLog = l }(jsonLog)
+	jsonLog = slog.New(slog.NewJSONHandler(&out, nil))
+
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+	var reply protocol.HistoryReply
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "hi"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitFor(t, 1, chat)
+
+	events := make(map[string]map[string]any)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		events[fmt.Sprint(e["event"])] = e
+	}
+	sent, ok := events["message_sent"]
+	if !ok {
+		t.Fatalf("no message_sent event in %s", out.String())
+	}
+	want := map[string]any{"level": "INFO", "msg": "message_sent", "client": "alice", "room": defaultRoom, "seq": float64(reply.Last), "recipients": float64(1)}
+	for k, v := range want {
+		if sent[k] != v {
+			t.Errorf("message_sent %s = %v, want %v", k, sent[k], v)
+		}
+	}
+	if _, ok := sent["text"]; ok {
+		t.Error("message_sent logs the message text")
+	}
+	if reg := events["registered"]; reg["client"] != "bob" || reg["addr"] != bob.addr {
+		t.Errorf("registered event %v, want bob at %s", reg, bob.addr)
+	}
+}
+
+func TestSendRefusesServerKinds(t *testing.T) {
+	c := NewChatServer()
+	for _, kind := range []string{"join", "leave", "rename", "private", "announcement", "users", "selftest", "other"} {
+		err := c.SendAck(protocol.MessageArgs{Sender: "alice", Text: "hi", Kind: kind}, &protocol.SendAck{})
+		if err == nil {
+			t.Errorf("kind %q: sent, want refused", kind)
+		}
+	}
+	if err := c.SendAck(protocol.MessageArgs{Sender: "alice", Text: "hi", Users: &protocol.UsersUpdate{}}, &protocol.SendAck{}); err == nil {
+		t.Error("message with a user list: sent, want refused")
+	}
+	table := &protocol.Table{Headers: []string{"name"}, Rows: [][]string{{"bob"}}}
+	for _, m := range []protocol.MessageArgs{
+		{Sender: "alice", Text: "hi"},
+		{Sender: "alice", Kind: "table", Table: table},
+	} {
+		if err := c.SendAck(m, &protocol.SendAck{}); err != nil {
+			t.Errorf("kind %q: %v", m.Kind, err)
+		}
+	}
+}
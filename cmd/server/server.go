@@ -0,0 +1,3677 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// recentLeftMax bounds how many disconnects RecentlyLeft remembers.
+const recentLeftMax = 20
+
+// Message is one history entry. System messages (joins, leaves) have no Sender.
+type Message struct {
+	Seq    uint64 // increases by one per entry in its room
+	Sender string
+	Text   string
+	Time   time.Time // when the server stored it
+	Room   string    // empty in files saved before rooms, read as defaultRoom
+}
+
+// defaultRoom is where clients that don't name a room are put.
+const defaultRoom = "general"
+
+// room is one chat room's clients; its history is kept in ChatServer.history.
+type room struct {
+	members map[string]*client
+}
+
+// checkRoomName rejects room names that are empty, long or contain spaces.
+func checkRoomName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > 32 || strings.ContainsFunc(name, unicode.IsSpace) {
+		return fmt.Errorf("bad room name %q: want 1 to 32 characters without spaces", name)
+	}
+	return nil
+}
+
+func (m Message) String() string {
+	if m.Sender == "" {
+		return m.Text
+	}
+	return fmt.Sprintf("%s: %s", m.Sender, m.Text)
+}
+
+// formatHistory renders history entries for the wire, each prefixed with its
+// time in layout, e.g. "[15:04:05] alice: hello". An empty layout leaves times out.
+func formatHistory(msgs []Message, layout string) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		if layout == "" {
+			out[i] = m.String()
+		} else {
+			out[i] = "[" + m.Time.Format(layout) + "] " + m.String()
+		}
+	}
+	return out
+}
+
+// seqsOf is the Seq of each of msgs, for HistoryReply.Seqs.
+func seqsOf(msgs []Message) []uint64 {
+	out := make([]uint64, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Seq
+	}
+	return out
+}
+
+// client is one registered client and the connection the server dials back on.
+type client struct {
+	id     string
+	addr   string
+	nonce  string // from RegisterArgs; identifies the client process
+	conn   *rpc.Client
+	joined time.Time
+	epoch  uint64   // registration order; a newer registration for the same ID replaces this one
+	room   string   // the room Sends go to; guarded by ChatServer.mu
+	extra  []string // rooms joined besides room, whose messages it also gets; guarded by ChatServer.mu
+
+	lastActive time.Time // last Send; guarded by ChatServer.mu
+	admin      bool      // registered with the admin token
+	sent       int       // messages sent; guarded by ChatServer.mu
+	tokens     float64   // Send allowance left; guarded by ChatServer.mu
+	refilled   time.Time // when tokens was last topped up
+	flood      floodState
+
+	pending atomic.Int64           // deliveries queued or in flight to this client
+	movedTo atomic.Pointer[client] // set by fastDelivery.migrate: where this connection's queued messages go
+	paced   atomic.Int64           // fast delivery under -slowstart: UnixNano before which the next call waits
+}
+
+// rooms is every room cl is in, the one it sends to first. ChatServer.mu must be held.
+func (cl *client) rooms() []string {
+	return append([]string{cl.room}, cl.extra...)
+}
+
+// errShuttingDown is returned by calls that would broadcast once shutdown has begun.
+var errShuttingDown = errors.New("server shutting down")
+
+// errRateLimited is returned by Send when the sender is over -sendrate,
+// wrapped with how long until the next message would be accepted.
+var errRateLimited = errors.New("rate limited")
+
+// jsonLog is set by -logformat json; nil keeps the plain log lines.
+var jsonLog *slog.Logger
+
+// logEvent records a key server event. As JSON it is one line with event and
+// the attrs as fields, text (or else event) as msg; as plain text only a
+// non-empty text is logged, so the default output is as it always was.
+func logEvent(level slog.Level, event, text string, attrs ...any) {
+	if jsonLog == nil {
+		if text != "" {
+			log.Print(text)
+		}
+		return
+	}
+	msg := text
+	if msg == "" {
+		msg = event
+	}
+	jsonLog.Log(context.Background(), level, msg, append([]any{"event", event}, attrs...)...)
+}
+
+// penalty is one step of the -floodpenalties schedule: a warning when
+// cooldown is 0, otherwise no sending for cooldown. A mute is worded as one.
+type penalty struct {
+	cooldown time.Duration
+	mute     bool
+}
+
+// parsePenalties reads a schedule such as "warn,10s,1m,mute=10m": the step for
+// the nth offense is the nth entry, and the last repeats. "off" or empty
+// turns escalation off.
+func parsePenalties(s string) ([]penalty, error) {
+	if s == "" || s == "off" {
+		return nil, nil
+	}
+	var steps []penalty
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "warn" {
+			steps = append(steps, penalty{})
+			continue
+		}
+		d, mute := strings.CutPrefix(f, "mute=")
+		cooldown, err := time.ParseDuration(d)
+		if err != nil || cooldown <= 0 {
+			return nil, fmt.Errorf("bad step %q: want warn, a duration or mute=DURATION", f)
+		}
+		steps = append(steps, penalty{cooldown: cooldown, mute: mute})
+	}
+	return steps, nil
+}
+
+// formatPenalties is the inverse of parsePenalties.
+func formatPenalties(steps []penalty) string {
+	fields := make([]string, len(steps))
+	for i, p := range steps {
+		switch {
+		case p.cooldown == 0:
+			fields[i] = "warn"
+		case p.mute:
+			fields[i] = "mute=" + p.cooldown.String()
+		default:
+			fields[i] = p.cooldown.String()
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// floodState is a client's record of rate limit offenses.
+type floodState struct {
+	offenses int       // lowered by one per offenseDecay without a new offense
+	since    time.Time // last offense
+	until    time.Time // no sending before this
+	muted    bool      // the current block is a mute
+}
+
+// ChatServer holds history, connected clients and a broadcast channel.
+type ChatServer struct {
+	mu        sync.Mutex
+	rooms     map[string]*room   // by name; every connected client is in exactly one
+	clients   map[string]*client // every connected client by ID, whatever its room
+	broadcast chan broadcastMsg
+	peers     []*peerLink // set before serving; read-only after
+	peerToken string      // peers must present this to relay; empty = no inbound peering
+	delivery  delivery
+
+	started        time.Time
+	sentTotal      uint64                     // messages accepted since start, for Stats
+	usersVersion   uint64                     // of the last user list pushed
+	silentJoins    bool                       // don't announce joins/leaves in chat
+	clearWhenEmpty bool                       // wipe history when the last client leaves
+	onPersistError string                     // "warn": a failed history write is logged and admins alerted; "fail": the sender is also told
+	persistErrors  atomic.Uint64              // failed history writes since start, for Stats
+	persistAlerted time.Time                  // when admins were last alerted to a failed write; guarded by mu
+	retention      time.Duration              // compaction drops entries older than this; 0 = keep them
+	lastAppend     time.Time                  // when history last grew, so compaction can wait for a quiet spell; guarded by mu
+	maxRooms       int                        // most rooms at once, the default room included; 0 = no limit
+	roomCreate     string                     // "open": joining a missing room creates it; "admin": only with the admin token
+	everyone       string                     // who may mention @everyone: "admin" or "anyone"
+	idleAfter      time.Duration              // @here skips members who haven't sent anything for this long
+	adminToken     string                     // enables admin RPCs when set
+	authToken      string                     // Register requires it when set; empty = anyone may join
+	maxBlob        int                        // largest MessageArgs.Data accepted
+	maxLen         int                        // longest MessageArgs.Text accepted, in runes; 0 = no limit
+	slowStart      time.Duration              // pace deliveries to new clients for this long
+	slowStartGap   time.Duration              // pause between deliveries right after joining
+	macros         bool                       // expand !uptime, !users etc. in sent messages
+	leaveGrace     time.Duration              // hold back leave broadcasts this long
+	pendingLeaves  map[string]*time.Timer     // held-back leaves by ID; guarded by mu
+	roles          map[string]map[string]bool // IDs given each role with SetRole, online or not; guarded by mu
+	recentLeft     []protocol.LeftUser        // last recentLeftMax disconnects, oldest first
+	deliverTimeout time.Duration              // drop a client whose Receive takes longer; 0 = wait forever
+	enqueueWait    time.Duration              // how long enqueue waits for room on a full broadcast queue
+	pressureAt     float64                    // broadcast queue fill (0-1] at which senders are asked to wait; 0 = off
+	epoch          uint64                     // last registration epoch handed out; guarded by mu
+	dialTimeout    time.Duration              // bound on Register's dial-back and nonce check; 0 = none
+	timeFormat     string                     // time layout prefixed to history entries; empty = none
+	nameSimilarity string                     // off, warn or reject names confusable with a connected one
+	maxHistory     int                        // most history entries kept; 0 = unlimited
+	history        HistoryStore               // every room's entries; guarded by mu
+	audit          *auditLog                  // administrative actions; saved apart from history
+	tlsConfig      *tls.Config                // serve and dial with TLS; nil = plain TCP
+	startTLS       string                     // with tlsConfig: "allow" or "require" StartTLS on a plain port; "" = TLS port
+	seqs           map[string]uint64          // sequence number of each room's last history entry; guarded by mu
+	announcements  []protocol.Announcement    // server-wide board, oldest first; guarded by mu
+	sendRate       float64                    // sustained messages per second per sender; 0 = unlimited
+	sendBurst      float64                    // messages a sender may send at once
+	sendGrace      float64                    // messages past sendBurst that are delayed instead of refused; 0 = none
+	graceDelay     time.Duration              // delay for the first message into the grace allowance, growing by as much for each one after
+	graceDelayMax  time.Duration              // longest delay a grace message gets
+	penalties      []penalty                  // escalating responses to repeated rate limit hits; nil = flat limit
+	offenseDecay   time.Duration              // good behavior this long forgives one offense
+	byteQuota      int64                      // per-connection bytes per byteWindow; 0 = no limit
+	byteWindow     time.Duration
+	regLimit       int // registrations allowed per ID within regWindow; 0 = no limit
+	regWindow      time.Duration
+	registrations  map[string][]time.Time // recent Register attempts by ID, oldest first; guarded by mu
+
+	closing  bool           // set by shutdown; guarded by mu
+	sending  sync.WaitGroup // handlers about to enqueue on broadcast
+	inflight sync.WaitGroup // queued or running Client.Receive calls
+	stopped  chan struct{}  // closed when the broadcaster exits
+}
+
+func NewChatServer() *ChatServer {
+	c := &ChatServer{
+		rooms:          make(map[string]*room),
+		clients:        make(map[string]*client),
+		broadcast:      make(chan broadcastMsg, 100),
+		pendingLeaves:  make(map[string]*time.Timer),
+		roles:          make(map[string]map[string]bool),
+		seqs:           make(map[string]uint64),
+		registrations:  make(map[string][]time.Time),
+		regLimit:       5,
+		regWindow:      time.Minute,
+		started:        time.Now(),
+		maxBlob:        64 << 10,
+		maxLen:         1024,
+		deliverTimeout: 5 * time.Second,
+		enqueueWait:    time.Second,
+		dialTimeout:    3 * time.Second,
+		timeFormat:     "15:04:05",
+		nameSimilarity: "off",
+		roomCreate:     "open",
+		everyone:       "admin",
+		idleAfter:      10 * time.Minute,
+		maxHistory:     1000,
+		sendRate:       10,
+		sendBurst:      20,
+		offenseDecay:   5 * time.Minute,
+		stopped:        make(chan struct{}),
+		audit:          &auditLog{},
+		history:        newMemoryStore(1000),
+		onPersistError: "warn",
+	}
+	c.delivery = newFastDelivery(c, defaultWorkers)
+	// broadcaster goroutine
+	go func() {
+		defer close(c.stopped)
+		for b := range c.broadcast {
+			msg := b.MessageArgs
+			out := msg
+			private := b.to != "" || b.group != nil
+			if !b.system && !private && msg.Data == nil {
+				out.Text = historyEntry(msg).String() // clients see a chat line as history shows it
+			}
+			// snapshot clients to avoid holding lock during RPC calls
+			c.mu.Lock()
+			members := c.clients
+			if msg.Room != "" && !private {
+				members = nil
+				if r, ok := c.rooms[msg.Room]; ok {
+					members = r.members // room messages reach that room only
+				}
+			}
+			clients := make([]*client, 0, len(members))
+			pinged := make(map[*client]bool)
+			ping := ""
+			if !b.system && !private {
+				ping = pingOf(msg.Text)
+			}
+			for _, cl := range members {
+				clients = append(clients, cl)
+				if ping == "everyone" || ping == "here" && time.Since(cl.lastActive) < c.idleAfter {
+					pinged[cl] = true
+				}
+			}
+			c.mu.Unlock()
+
+			for _, cl := range clients {
+				if private {
+					if cl.id != b.to && cl.id != msg.Sender && !slices.Contains(b.group, cl.id) {
+						continue // private: recipients and the sender's own copy only
+					}
+				} else if cl.id == msg.Sender {
+					continue // no self-echo
+				}
+				o := out
+				o.Mentioned = pinged[cl]
+				c.delivery.deliver(cl, o)
+			}
+			if !b.fromPeer && !b.local && !private { // relayed messages are never relayed again, which prevents loops
+				for _, p := range c.peers {
+					p.forward(RelayArgs{Msg: msg, System: b.system, Forget: b.forget, Count: b.count})
+				}
+			}
+		}
+		c.delivery.close()
+	}()
+	return c
+}
+
+// pingPattern finds @everyone and @here as words of their own.
+var pingPattern = regexp.MustCompile(`(?i)(^|[^\pL\pN_])@(everyone|here)($|[^\pL\pN_])`)
+
+// pingOf is whom text pings: "everyone" (every member of the room), "here"
+// (the members who have been active within idleAfter) or "" (no one).
+// @everyone wins when text has both.
+func pingOf(text string) string {
+	ping := ""
+	for _, m := range pingPattern.FindAllStringSubmatch(text, -1) {
+		if ping = strings.ToLower(m[2]); ping == "everyone" {
+			break
+		}
+	}
+	return ping
+}
+
+// broadcastMsg is a message queued for the broadcaster.
+type broadcastMsg struct {
+	protocol.MessageArgs
+	system   bool     // join/leave style notice rather than a chat message
+	fromPeer bool     // relayed in from a peer server
+	to       string   // private message recipient; such messages stay on this server
+	group    []string // recipients of a private message to a role, instead of to
+	local    bool     // notice about this server itself, not relayed to peers
+	forget   bool     // notice of a ForgetMe or DeleteMine; peers get the removal
+	count    int      // with forget, how many entries went; 0 = all
+}
+
+// publish hands a chat message to the broadcaster. The caller must have
+// checked closing and called c.sending.Add(1) while holding c.mu.
+func (c *ChatServer) publish(m protocol.MessageArgs) {
+	c.enqueue(broadcastMsg{MessageArgs: m})
+}
+
+// publishNotice is publish for system notices such as joins and leaves.
+func (c *ChatServer) publishNotice(m protocol.MessageArgs) {
+	c.enqueue(broadcastMsg{MessageArgs: m, system: true})
+}
+
+// publishForget is publishNotice for the notice of a ForgetMe or DeleteMine
+// that removed count of m.Sender's entries (0 = all). Peers are sent the
+// removal itself, to apply to their copies.
+func (c *ChatServer) publishForget(m protocol.MessageArgs, count int) {
+	c.enqueue(broadcastMsg{MessageArgs: m, system: true, forget: true, count: count})
+}
+
+// pushUsers queues the current user list for every client on this server. It
+// goes through the broadcaster after whatever join or leave notice was queued
+// before it. c.mu must not be held.
+func (c *ChatServer) pushUsers() {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return
+	}
+	c.usersVersion++
+	u := &protocol.UsersUpdate{Users: make([]string, 0, len(c.clients)), Version: c.usersVersion}
+	for id := range c.clients {
+		u.Users = append(u.Users, id)
+	}
+	c.sending.Add(1)
+	c.mu.Unlock()
+	sort.Strings(u.Users)
+	c.enqueue(broadcastMsg{MessageArgs: protocol.MessageArgs{Kind: "users", Users: u}, system: true, local: true})
+}
+
+// enqueue hands b to the broadcaster without ever blocking for good: if the
+// queue is full it waits up to enqueueWait for room, then drops b with a
+// logged warning. A dropped chat message is still in history; only the live
+// broadcast is lost.
+func (c *ChatServer) enqueue(b broadcastMsg) {
+	defer c.sending.Done()
+	select {
+	case c.broadcast <- b:
+		return
+	default:
+	}
+	if c.enqueueWait > 0 {
+		t := time.NewTimer(c.enqueueWait)
+		defer t.Stop()
+		select {
+		case c.broadcast <- b:
+			return
+		case <-t.C:
+		}
+	}
+	log.Printf("broadcast queue full, dropped message seq %d from %q", b.Seq, b.Sender)
+}
+
+// shutdown stops accepting new messages, lets the broadcaster drain, waits up
+// to timeout for outstanding deliveries and then closes every client.
+func (c *ChatServer) shutdown(timeout time.Duration) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closing = true
+	for id, t := range c.pendingLeaves {
+		t.Stop()
+		delete(c.pendingLeaves, id)
+	}
+	c.sending.Add(1)
+	c.mu.Unlock()
+	// the last broadcast: a notice for this server's clients only, kept out of history
+	c.enqueue(broadcastMsg{MessageArgs: protocol.MessageArgs{Text: "Server shutting down"}, system: true, local: true})
+
+	drained := make(chan struct{})
+	go func() {
+		c.sending.Wait()
+		close(c.broadcast)
+		<-c.stopped
+		c.inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		err = fmt.Errorf("deliveries still in flight after %v", timeout)
+	}
+
+	c.mu.Lock()
+	gone := make([]*client, 0, len(c.clients))
+	for _, cl := range c.clients {
+		gone = append(gone, cl)
+		c.dropLocked(cl)
+	}
+	c.mu.Unlock()
+	for _, cl := range gone {
+		cl.conn.Close()
+	}
+	c.mu.Lock()
+	if err := c.history.Close(); err != nil { // closing stops every history write
+		log.Printf("close history: %v", err)
+	}
+	c.mu.Unlock()
+	c.audit.close()
+	return err
+}
+
+// receive calls Client.Receive on one client, giving up after deliverTimeout.
+func (c *ChatServer) receive(cl *client, m protocol.MessageArgs) error {
+	var reply struct{}
+	var call *rpc.Call
+	if m.Kind == "users" && m.Users != nil {
+		call = cl.conn.Go("Client.UpdateUsers", *m.Users, &reply, make(chan *rpc.Call, 1))
+	} else {
+		call = cl.conn.Go("Client.Receive", m, &reply, make(chan *rpc.Call, 1))
+	}
+	if c.deliverTimeout <= 0 {
+		return callbackErr(<-call.Done)
+	}
+	t := time.NewTimer(c.deliverTimeout)
+	defer t.Stop()
+	select {
+	case <-call.Done:
+		return callbackErr(call)
+	case <-t.C:
+		return fmt.Errorf("no reply within %s", c.deliverTimeout) // closing conn ends the call
+	}
+}
+
+// callbackErr is call's error, except that an older client without the
+// method (UpdateUsers) still counts as reached.
+func callbackErr(call *rpc.Call) error {
+	if _, ok := call.Error.(rpc.ServerError); ok && strings.HasPrefix(call.Error.Error(), "rpc: can't find ") {
+		return nil
+	}
+	return call.Error
+}
+
+// deliverTo calls Client.Receive on one client and removes it on error.
+func (c *ChatServer) deliverTo(cl *client, m protocol.MessageArgs) error {
+	err := c.receive(cl, m)
+	if err != nil {
+		// on error remove client
+		logEvent(slog.LevelWarn, "delivery_failed", fmt.Sprintf("failed to deliver to %s: %v (removing)", cl.id, err), "client", cl.id, "addr", cl.addr, "error", err.Error())
+		// only the map updates need the lock; Close can block on a dead peer
+		c.mu.Lock()
+		// two failing broadcasts can race here: only the first one removes
+		removed := c.clients[cl.id] == cl // not already removed or replaced
+		rooms := cl.rooms()
+		if removed {
+			c.dropLocked(cl)
+			c.recordLeftLocked(cl.id)
+		}
+		c.mu.Unlock()
+		cl.conn.Close() // a second Close just returns rpc.ErrShutdown
+		c.delivery.forget(cl)
+		if removed {
+			// async: in ordered mode this runs on the worker the broadcaster may be waiting on
+			go func() {
+				c.announceLeave(cl.id, rooms)
+				c.pushUsers()
+			}()
+		}
+	}
+	return err
+}
+
+// announceLeave records and broadcasts to each of rooms that id left. With a
+// leave grace period the broadcasts are held back, and a Register for the same
+// ID within the window cancels them along with the rejoin announcement.
+func (c *ChatServer) announceLeave(id string, rooms []string) {
+	leave := func() { // called with c.mu held, which it releases
+		var notices []protocol.MessageArgs
+		for _, room := range rooms {
+			if m, ok := c.leaveLocked(id, room); ok {
+				notices = append(notices, m)
+			}
+		}
+		c.mu.Unlock()
+		for _, m := range notices {
+			c.publishNotice(m)
+		}
+	}
+	c.mu.Lock()
+	if c.leaveGrace > 0 {
+		if _, ok := c.pendingLeaves[id]; !ok {
+			var t *time.Timer
+			t = time.AfterFunc(c.leaveGrace, func() {
+				c.mu.Lock()
+				if c.pendingLeaves[id] != t {
+					c.mu.Unlock()
+					return // cancelled by a re-register
+				}
+				delete(c.pendingLeaves, id)
+				leave()
+			})
+			c.pendingLeaves[id] = t
+		}
+		c.mu.Unlock()
+		return
+	}
+	leave()
+}
+
+// recordLeftLocked remembers that id disconnected, dropping the oldest entry
+// once recentLeftMax is reached. c.mu must be held.
+func (c *ChatServer) recordLeftLocked(id string) {
+	if len(c.recentLeft) == recentLeftMax {
+		c.recentLeft = append(c.recentLeft[:0], c.recentLeft[1:]...)
+	}
+	c.recentLeft = append(c.recentLeft, protocol.LeftUser{ID: id, At: time.Now()})
+}
+
+// leaveLocked appends the leave entry to room's history and returns the
+// message for the caller to publish once c.mu is released. Under -emptyroom
+// clear, if no one is in the room at this point (including anyone who
+// reconnected during the leave grace period) its history is wiped instead.
+// c.mu must be held.
+func (c *ChatServer) leaveLocked(id, room string) (protocol.MessageArgs, bool) {
+	if c.closing {
+		return protocol.MessageArgs{}, false
+	}
+	if c.clearWhenEmpty && len(c.roomLocked(room).members) == 0 {
+		// last one out: the history goes with them, and there is no one to tell.
+		// Numbering starts again, so a client that saw the old entries finds
+		// its place is past the end and fetches the room's history afresh.
+		c.history.Replace(room, nil)
+		delete(c.seqs, room)
+		if room != defaultRoom {
+			delete(c.rooms, room)
+		}
+		return protocol.MessageArgs{}, false
+	}
+	if c.silentJoins {
+		log.Printf("%s left (not announced)", id)
+		return protocol.MessageArgs{}, false
+	}
+	leaveMsg := fmt.Sprintf("User %s left", id)
+	seq := c.appendLocked(Message{Text: leaveMsg, Room: room}).Seq
+	c.sending.Add(1)
+	return protocol.MessageArgs{Sender: id, Text: leaveMsg, Kind: "leave", Seq: seq, Room: room}, true
+}
+
+// openRoomLocked checks that a client may enter the room called name: it
+// exists, or the -roomcreate policy lets this client create it (admin says
+// whether it sent the admin token) and -maxrooms leaves space. A room that
+// has to be created is, so a second client isn't counted against the cap
+// again. c.mu must be held.
+func (c *ChatServer) openRoomLocked(name string, admin bool) error {
+	if _, ok := c.rooms[name]; ok || name == defaultRoom {
+		return nil
+	}
+	if c.roomCreate == "admin" && !admin {
+		return errors.New("room does not exist")
+	}
+	if n := len(c.rooms); c.maxRooms > 0 {
+		if _, ok := c.rooms[defaultRoom]; !ok {
+			n++ // the default room is always there
+		}
+		if n >= c.maxRooms {
+			return fmt.Errorf("can't create room %s: the server's limit of %d rooms is reached", name, c.maxRooms)
+		}
+	}
+	c.roomLocked(name)
+	return nil
+}
+
+// roomLocked returns the room called name, creating it if needed. c.mu must be held.
+func (c *ChatServer) roomLocked(name string) *room {
+	r, ok := c.rooms[name]
+	if !ok {
+		r = &room{members: make(map[string]*client)}
+		c.rooms[name] = r
+	}
+	return r
+}
+
+// roomOfLocked is the room id is in, defaultRoom if id is not connected.
+// c.mu must be held.
+func (c *ChatServer) roomOfLocked(id string) string {
+	if cl, ok := c.clients[id]; ok {
+		return cl.room
+	}
+	return defaultRoom
+}
+
+func (c *ChatServer) roomOf(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roomOfLocked(id)
+}
+
+// dropLocked removes cl from the client list and from its rooms. c.mu must be held.
+func (c *ChatServer) dropLocked(cl *client) {
+	delete(c.clients, cl.id)
+	for _, r := range cl.rooms() {
+		delete(c.roomLocked(r).members, cl.id)
+	}
+}
+
+// delivery decides how a broadcast message reaches each client. deliver and
+// close are only called from the broadcaster goroutine; forget is called from
+// anywhere once a client has been removed, and migrate from Register with
+// c.mu held. Every delivery is counted in c.inflight until its call returns or
+// is abandoned.
+type delivery interface {
+	deliver(cl *client, m protocol.MessageArgs)
+	forget(cl *client)
+	migrate(from, to *client) // to replaces from: pass on whatever is still queued
+	close()
+}
+
+// defaultWorkers is the fast delivery pool size unless -workers says otherwise.
+const defaultWorkers = 64
+
+// fastDelivery hands each delivery to a fixed pool of workers, so up to that
+// many clients are called at once whatever the fan-out. Nothing waits on one
+// slow client while other workers are free, but a client may see messages out
+// of order. When every worker is busy and the job queue is full, deliver
+// blocks the broadcaster, which shows up as backpressure to senders.
+type fastDelivery struct {
+	c       *ChatServer
+	workers int
+	jobs    chan deliveryJob
+	start   sync.Once // workers start with the first delivery
+}
+
+type deliveryJob struct {
+	cl *client
+	m  protocol.MessageArgs
+}
+
+func newFastDelivery(c *ChatServer, workers int) *fastDelivery {
+	return &fastDelivery{c: c, workers: workers, jobs: make(chan deliveryJob, workers*4)}
+}
+
+func (d *fastDelivery) deliver(cl *client, m protocol.MessageArgs) {
+	d.start.Do(func() {
+		for i := 0; i < d.workers; i++ {
+			go d.work()
+		}
+	})
+	d.c.inflight.Add(1)
+	cl.pending.Add(1)
+	d.jobs <- deliveryJob{cl: cl, m: m}
+}
+
+func (d *fastDelivery) work() {
+	for j := range d.jobs {
+		cl := successor(j.cl)
+		if d.c.slowStart > 0 {
+			time.Sleep(time.Until(d.slot(cl))) // the worker waits, so pacing costs the pool a worker meanwhile
+		}
+		d.c.deliverTo(cl, j.m) // removes the client if the call fails
+		j.cl.pending.Add(-1)
+		d.c.inflight.Done()
+	}
+}
+
+// slot reserves the next call to cl under -slowstart: it returns when the
+// call may start and keeps slowStartPause free after it. Workers holding jobs
+// for the same client thus take turns instead of calling it at once.
+func (d *fastDelivery) slot(cl *client) time.Time {
+	for {
+		prev := cl.paced.Load()
+		start := max(prev, time.Now().UnixNano())
+		if cl.paced.CompareAndSwap(prev, start+int64(d.c.slowStartPause(cl.joined))) {
+			return time.Unix(0, start)
+		}
+	}
+}
+
+func (d *fastDelivery) forget(*client) {}
+
+// migrate sends the jobs still queued for from, and any the broadcaster queues
+// for it later, to to instead. A call already in flight to from fails when
+// its connection closes.
+func (d *fastDelivery) migrate(from, to *client) {
+	from.movedTo.Store(to)
+}
+
+// successor follows cl's migrations to the connection in use now.
+func successor(cl *client) *client {
+	for next := cl.movedTo.Load(); next != nil; next = cl.movedTo.Load() {
+		cl = next
+	}
+	return cl
+}
+
+// close stops the workers once the jobs already queued are done. Only the
+// broadcaster calls deliver, and it calls close last.
+func (d *fastDelivery) close() {
+	close(d.jobs)
+}
+
+// orderedDelivery keeps one sequential worker per client, so each client sees
+// messages in broadcast order. The cost is head-of-line blocking: a slow call
+// delays everything queued behind it for that client, and once its queue is
+// full the broadcaster waits too.
+type orderedDelivery struct {
+	c      *ChatServer
+	mu     sync.Mutex
+	queues map[*client]*clientQueue
+	gone   []*client // forgotten clients whose queues are not yet closed
+}
+
+// clientQueue is one worker's queue. Its recipient changes when migrate hands
+// the queue to a client's newer connection.
+type clientQueue struct {
+	ch chan queuedMsg
+	to atomic.Pointer[client]
+}
+
+type queuedMsg struct {
+	protocol.MessageArgs
+	cl *client // the client it was queued for, whose pending count it holds
+}
+
+func newOrderedDelivery(c *ChatServer) *orderedDelivery {
+	return &orderedDelivery{c: c, queues: make(map[*client]*clientQueue)}
+}
+
+func (d *orderedDelivery) deliver(cl *client, m protocol.MessageArgs) {
+	d.mu.Lock()
+	d.sweep()
+	q, ok := d.queues[cl]
+	if !ok {
+		q = &clientQueue{ch: make(chan queuedMsg, 100)}
+		q.to.Store(cl)
+		d.queues[cl] = q
+		go d.worker(q)
+	}
+	d.mu.Unlock()
+
+	d.c.inflight.Add(1)
+	cl.pending.Add(1)
+	q.ch <- queuedMsg{MessageArgs: m, cl: cl}
+}
+
+// worker delivers q in order. After a failure the client is gone, so the rest
+// of the queue is discarded unless migrate hands it to a newer connection.
+func (d *orderedDelivery) worker(q *clientQueue) {
+	var failed *client
+	for m := range q.ch {
+		cl := q.to.Load()
+		if cl != failed && d.c.deliverTo(cl, m.MessageArgs) != nil {
+			failed = cl
+		}
+		d.c.inflight.Done()
+		m.cl.pending.Add(-1)
+		if pause := d.c.slowStartPause(cl.joined); pause > 0 && cl != failed {
+			time.Sleep(pause)
+		}
+	}
+}
+
+func (d *orderedDelivery) migrate(from, to *client) {
+	d.mu.Lock()
+	if q, ok := d.queues[from]; ok {
+		delete(d.queues, from)
+		q.to.Store(to)
+		d.queues[to] = q
+	}
+	d.mu.Unlock()
+}
+
+func (d *orderedDelivery) forget(cl *client) {
+	d.mu.Lock()
+	d.gone = append(d.gone, cl)
+	d.mu.Unlock()
+}
+
+// sweep closes the queues of forgotten clients. Queues are only closed from
+// the broadcaster goroutine, which is also the only sender. d.mu must be held.
+func (d *orderedDelivery) sweep() {
+	for _, cl := range d.gone {
+		if q, ok := d.queues[cl]; ok {
+			close(q.ch)
+			delete(d.queues, cl)
+		}
+	}
+	d.gone = nil
+}
+
+func (d *orderedDelivery) close() {
+	d.mu.Lock()
+	for cl, q := range d.queues {
+		close(q.ch)
+		delete(d.queues, cl)
+	}
+	d.gone = nil
+	d.mu.Unlock()
+}
+
+// slowStartPause is how long to wait after a delivery to a client that joined
+// at joined: the full slowStartGap right after joining, shrinking linearly to
+// nothing once slowStart has passed. A new client thus gets its first burst
+// paced instead of all at once.
+func (c *ChatServer) slowStartPause(joined time.Time) time.Duration {
+	if c.slowStart <= 0 {
+		return 0
+	}
+	elapsed := time.Since(joined)
+	if elapsed >= c.slowStart {
+		return 0
+	}
+	return time.Duration(float64(c.slowStartGap) * (1 - float64(elapsed)/float64(c.slowStart)))
+}
+
+// Register: client tells server its ID and listening address. Server dials back and stores client RPC.
+func (c *ChatServer) Register(args protocol.RegisterArgs, reply *struct{}) error {
+	_, err := c.register(args)
+	if err == nil {
+		c.greet(args.ID)
+	}
+	return err
+}
+
+// register is Register, also returning the registration's epoch. An ID that is
+// already connected is refused, unless the same client process (same nonce)
+// is registering again: then the newest registration wins, the old connection
+// is closed and its queued messages go to the new one. A name in use is
+// refused before dialing anyone back, and checked again after in case it was
+// taken meanwhile. Epochs are taken before the dial-back, so a slow older
+// registration can't displace a newer one.
+func (c *ChatServer) register(args protocol.RegisterArgs) (uint64, error) {
+	if c.authToken != "" && subtle.ConstantTimeCompare([]byte(args.Token), []byte(c.authToken)) != 1 {
+		return 0, errors.New("authentication failed")
+	}
+	if args.Room == "" {
+		args.Room = defaultRoom
+	} else if err := checkRoomName(args.Room); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	if old, ok := c.clients[args.ID]; ok && (args.Nonce == "" || old.nonce != args.Nonce) {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("nickname %s already in use", args.ID)
+	}
+	if wait := c.registerWaitLocked(args.ID); wait > 0 {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("reconnecting too frequently, wait %ds", int((wait+time.Second-1)/time.Second))
+	}
+	c.epoch++
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	nc, err := c.dialBack(args)
+	if err != nil {
+		return 0, fmt.Errorf("dial client %s at %s: %w", args.ID, args.Addr, err)
+	}
+	conn := rpc.NewClient(nc)
+	if c.dialTimeout > 0 {
+		nc.SetDeadline(time.Now().Add(c.dialTimeout)) // the nonce check gets the same bound
+	}
+	if err := verifyCallback(conn, args); err != nil {
+		conn.Close()
+		return 0, err
+	}
+	nc.SetDeadline(time.Time{})
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		conn.Close()
+		return 0, errShuttingDown
+	}
+	if other := c.similarNameLocked(args.ID, args.ID); other != "" {
+		switch c.nameSimilarity {
+		case "warn":
+			log.Printf("%s registered with a name confusable with %s", args.ID, other)
+		case "reject":
+			c.mu.Unlock()
+			conn.Close()
+			return 0, fmt.Errorf("name %q is too similar to %q, who is already connected", args.ID, other)
+		}
+	}
+	old, replacing := c.clients[args.ID]
+	if replacing && (args.Nonce == "" || old.nonce != args.Nonce) {
+		c.mu.Unlock()
+		conn.Close()
+		return 0, fmt.Errorf("nickname %s already in use", args.ID)
+	}
+	if replacing && old.epoch > epoch {
+		c.mu.Unlock()
+		conn.Close()
+		return 0, fmt.Errorf("%s was registered again by a newer connection", args.ID)
+	}
+	if err := c.openRoomLocked(args.Room, false); err != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return 0, err
+	}
+	now := time.Now()
+	cl := &client{id: args.ID, addr: args.Addr, nonce: args.Nonce, conn: conn, joined: now, lastActive: now, epoch: epoch,
+		room: args.Room, tokens: c.sendBurst, refilled: now, admin: args.AdminToken != "" && c.isAdmin(args.AdminToken)}
+	if replacing {
+		c.dropLocked(old)
+	}
+	c.clients[args.ID] = cl
+	c.roomLocked(cl.room).members[args.ID] = cl
+	if replacing {
+		cl.tokens, cl.refilled, cl.flood = old.tokens, old.refilled, old.flood // reconnecting doesn't reset the rate limit
+		for _, r := range old.rooms() {
+			if r != cl.room { // the same process keeps the rooms it was in
+				cl.extra = append(cl.extra, r)
+				c.roomLocked(r).members[cl.id] = cl
+			}
+		}
+		// same user on a new connection: nothing to announce
+		c.delivery.migrate(old, cl)
+		c.mu.Unlock()
+		old.conn.Close()
+		logEvent(slog.LevelInfo, "registered", fmt.Sprintf("%s re-registered from %s, replacing the connection from %s", args.ID, args.Addr, old.addr), "client", args.ID, "addr", args.Addr, "replaced", old.addr)
+		c.pushUsers() // the list is the same, but the new connection needs it
+		return epoch, nil
+	}
+	if t, ok := c.pendingLeaves[args.ID]; ok {
+		// back within the leave grace period: neither leave nor rejoin is announced
+		t.Stop()
+		delete(c.pendingLeaves, args.ID)
+		c.mu.Unlock()
+		logEvent(slog.LevelInfo, "registered", "", "client", args.ID, "addr", args.Addr, "rejoined", true)
+		c.pushUsers()
+		return epoch, nil
+	}
+	if c.silentJoins {
+		c.mu.Unlock()
+		logEvent(slog.LevelInfo, "registered", fmt.Sprintf("%s joined from %s (not announced)", args.ID, args.Addr), "client", args.ID, "addr", args.Addr)
+		c.pushUsers()
+		return epoch, nil
+	}
+	m := c.joinLocked(args.ID, args.Room)
+	c.mu.Unlock()
+	logEvent(slog.LevelInfo, "registered", "", "client", args.ID, "addr", args.Addr, "room", m.Room)
+
+	// broadcast join to others (no self-echo)
+	c.publishNotice(m)
+	c.pushUsers()
+	return epoch, nil
+}
+
+// joinLocked appends the join entry to room's history and returns the message
+// for the caller to publish once c.mu is released. c.mu must be held.
+func (c *ChatServer) joinLocked(id, room string) protocol.MessageArgs {
+	joinMsg := fmt.Sprintf("User %s joined", id)
+	seq := c.appendLocked(Message{Text: joinMsg, Room: room}).Seq
+	c.sending.Add(1)
+	return protocol.MessageArgs{Sender: id, Text: joinMsg, Kind: "join", Seq: seq, Room: room}
+}
+
+// Join: move args.ID to args.Room, announcing the move in both rooms, and
+// return the new room's history. With args.Keep the rooms already joined are
+// kept: args.Room is joined as well, if it wasn't, and becomes the one sent to.
+func (c *ChatServer) Join(args protocol.JoinArgs, reply *protocol.HistoryReply) error {
+	if err := checkRoomName(args.Room); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	cl, ok := c.clients[args.ID]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is not registered", args.ID)
+	}
+	var notices []protocol.MessageArgs
+	if from := cl.room; from != args.Room {
+		member := slices.Contains(cl.extra, args.Room)
+		if !member {
+			if err := c.openRoomLocked(args.Room, c.isAdmin(args.Token)); err != nil {
+				c.mu.Unlock()
+				return err
+			}
+		}
+		cl.extra = slices.DeleteFunc(slices.Clone(cl.extra), func(r string) bool { return r == args.Room })
+		cl.room = args.Room
+		c.roomLocked(args.Room).members[cl.id] = cl
+		if args.Keep {
+			cl.extra = append(cl.extra, from)
+		} else {
+			delete(c.roomLocked(from).members, cl.id)
+			if m, ok := c.leaveLocked(cl.id, from); ok {
+				notices = append(notices, m)
+			}
+		}
+		if !member && !c.silentJoins {
+			notices = append(notices, c.joinLocked(cl.id, args.Room))
+		}
+	}
+	snap := c.history.All(args.Room)
+	c.mu.Unlock()
+
+	for _, m := range notices {
+		c.publishNotice(m)
+	}
+	reply.Messages = formatHistory(snap, c.timeFormat)
+	reply.Seqs = seqsOf(snap)
+	reply.Last = lastSeq(snap)
+	return nil
+}
+
+// Part: take args.ID out of args.Room, a room it joined with Keep besides the
+// one it sends to, and announce it there
+func (c *ChatServer) Part(args protocol.JoinArgs, reply *struct{}) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	cl, ok := c.clients[args.ID]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is not registered", args.ID)
+	}
+	if args.Room == cl.room {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is the room you send to; join another room first", args.Room)
+	}
+	if !slices.Contains(cl.extra, args.Room) {
+		c.mu.Unlock()
+		return fmt.Errorf("you are not in room %s", args.Room)
+	}
+	cl.extra = slices.DeleteFunc(slices.Clone(cl.extra), func(r string) bool { return r == args.Room })
+	delete(c.roomLocked(args.Room).members, cl.id)
+	m, ok := c.leaveLocked(cl.id, args.Room)
+	c.mu.Unlock()
+	if ok {
+		c.publishNotice(m)
+	}
+	return nil
+}
+
+// registerWaitLocked counts a Register attempt for id and returns how long
+// until another would be allowed, if id has already made regLimit attempts
+// within regWindow; 0 lets it through. Refused attempts are not counted, so
+// a client that keeps retrying is not locked out for good. c.mu must be held.
+func (c *ChatServer) registerWaitLocked(id string) time.Duration {
+	if c.regLimit <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if len(c.registrations) > 1024 {
+		for other, times := range c.registrations { // forget IDs that have gone quiet
+			if now.Sub(times[len(times)-1]) >= c.regWindow {
+				delete(c.registrations, other)
+			}
+		}
+	}
+	times := c.registrations[id]
+	for len(times) > 0 && now.Sub(times[0]) >= c.regWindow {
+		times = times[1:]
+	}
+	if len(times) >= c.regLimit {
+		c.registrations[id] = times
+		return c.regWindow - now.Sub(times[0])
+	}
+	c.registrations[id] = append(times, now)
+	return 0
+}
+
+// dialBack connects to the client's callback listener: plain TCP, or with TLS
+// on, a TLS connection that accepts only the certificate named by args.CertHash.
+// A client's listener has a self-signed certificate; its hash arrived over the
+// verified connection to this server, so it needs no CA.
+func (c *ChatServer) dialBack(args protocol.RegisterArgs) (net.Conn, error) {
+	if c.tlsConfig == nil || (args.CertHash == "" && c.startTLS == "allow") {
+		return net.DialTimeout("tcp", args.Addr, c.dialTimeout)
+	}
+	if args.CertHash == "" {
+		return nil, errors.New("this server uses TLS: connect with -tls so it can call back securely")
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: true, // replaced by the pin below
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 {
+				return errors.New("no certificate")
+			}
+			sum := sha256.Sum256(certs[0])
+			if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(args.CertHash)) != 1 {
+				return errors.New("callback certificate does not match the one registered")
+			}
+			return nil
+		},
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: c.dialTimeout}, "tcp", args.Addr, cfg)
+}
+
+// loadTLS builds the server's TLS config from a certificate and key, and an
+// optional CA file that peers' certificates are checked against. Without a
+// CA the system roots are used.
+func loadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// homoglyphs folds characters that are easily mistaken for a Latin letter
+// into that letter: Cyrillic and Greek lookalikes, and leetspeak digits.
+var homoglyphs = strings.NewReplacer(
+	"а", "a", "е", "e", "о", "o", "р", "p", "с", "c", "у", "y", "х", "x", "і", "l", "ј", "j", "ѕ", "s",
+	"α", "a", "ο", "o", "ρ", "p", "ν", "v", "κ", "k", "ι", "l",
+	"0", "o", "1", "l", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+	"i", "l", "|", "l", // i, l and | look alike in many fonts; fold them all to l
+)
+
+// nameSkeleton is the form of a name compared for confusability.
+func nameSkeleton(name string) string {
+	return homoglyphs.Replace(strings.ToLower(name))
+}
+
+// similarNameLocked returns a connected ID other than id and self that looks
+// like id: the same after folding homoglyphs, or one edit apart for names of
+// five or more letters. c.mu must be held.
+func (c *ChatServer) similarNameLocked(id, self string) string {
+	if c.nameSimilarity == "off" {
+		return ""
+	}
+	skel := nameSkeleton(id)
+	for other := range c.clients {
+		if other == id || other == self {
+			continue
+		}
+		o := nameSkeleton(other)
+		if o == skel || min(len([]rune(o)), len([]rune(skel))) >= 5 && editDistance(o, skel) <= 1 {
+			return other
+		}
+	}
+	return ""
+}
+
+// editDistance is the Levenshtein distance between a and b, counted in runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// verifyCallback checks that the process answering at args.Addr is the one
+// registering, not an unrelated process that reused the port. Clients that send
+// no nonce predate the check and are accepted as before.
+func verifyCallback(conn *rpc.Client, args protocol.RegisterArgs) error {
+	if args.Nonce == "" {
+		return nil
+	}
+	var nonce string
+	if err := conn.Call("Client.Nonce", struct{}{}, &nonce); err != nil {
+		return fmt.Errorf("verify callback for %s at %s: %w", args.ID, args.Addr, err)
+	}
+	if nonce != args.Nonce {
+		return fmt.Errorf("callback at %s belongs to another process (nonce mismatch)", args.Addr)
+	}
+	return nil
+}
+
+// Unregister: remove client
+func (c *ChatServer) Unregister(args protocol.RegisterArgs, reply *struct{}) error {
+	c.unregister(args.ID, 0)
+	return nil
+}
+
+// unregister removes id if it is still the registration from epoch (0 = any).
+// A connection that a newer registration replaced leaves without a trace.
+func (c *ChatServer) unregister(id string, epoch uint64) {
+	c.mu.Lock()
+	cl, ok := c.clients[id]
+	if ok && epoch != 0 && cl.epoch != epoch {
+		c.mu.Unlock()
+		return
+	}
+	rooms := []string{defaultRoom}
+	if ok {
+		rooms = cl.rooms()
+		c.dropLocked(cl)
+		c.recordLeftLocked(id)
+	}
+	c.mu.Unlock()
+	if ok {
+		cl.conn.Close()
+		c.delivery.forget(cl)
+		logEvent(slog.LevelInfo, "unregistered", "", "client", id, "addr", cl.addr)
+	}
+
+	c.announceLeave(id, rooms)
+	if ok {
+		c.pushUsers()
+	}
+}
+
+// allowSendLocked takes one message from id's allowance: a token bucket that
+// refills at sendRate per second up to sendBurst. Past the burst, the bucket
+// may go sendGrace messages into debt: those are accepted, but the caller is
+// to wait the returned delay first, graceDelay longer for each message
+// further into the debt, up to graceDelayMax. Unknown IDs and a zero rate are
+// not limited. Going over counts as an offense, and repeated offenses escalate
+// along c.penalties; the error says what the sender faces. Only the sender
+// hears about it. c.mu must be held.
+func (c *ChatServer) allowSendLocked(id string) (time.Duration, error) {
+	cl, ok := c.clients[id]
+	if !ok {
+		return 0, nil
+	}
+	now := time.Now()
+	if left := cl.flood.until.Sub(now); left > 0 {
+		secs := int((left + time.Second - 1) / time.Second)
+		if cl.flood.muted {
+			return 0, fmt.Errorf("muted for flooding, %ds left", secs)
+		}
+		return 0, fmt.Errorf("cooling down after flooding, wait %ds", secs)
+	}
+	if c.sendRate <= 0 {
+		return 0, nil
+	}
+	cl.tokens = min(c.sendBurst, cl.tokens+now.Sub(cl.refilled).Seconds()*c.sendRate)
+	cl.refilled = now
+	if cl.tokens >= 1 {
+		cl.tokens--
+		return 0, nil
+	}
+	if cl.tokens+c.sendGrace >= 1 {
+		into := math.Ceil(1 - cl.tokens) // 1 for the first message past the burst
+		cl.tokens--
+		return min(c.graceDelayMax, time.Duration(into)*c.graceDelay), nil
+	}
+	retry := retryAfter(cl.tokens+c.sendGrace, c.sendRate)
+	if len(c.penalties) == 0 {
+		return 0, fmt.Errorf("%w, retry in %s", errRateLimited, retry)
+	}
+	f := &cl.flood
+	if c.offenseDecay > 0 && f.offenses > 0 {
+		steps := int(now.Sub(f.since) / c.offenseDecay)
+		f.offenses = max(0, f.offenses-steps)
+	}
+	f.offenses++
+	f.since = now
+	p := c.penalties[min(f.offenses, len(c.penalties))-1]
+	if p.cooldown == 0 {
+		return 0, fmt.Errorf("%w, retry in %s (warning: keep flooding and you will have to wait)", errRateLimited, retry)
+	}
+	f.until, f.muted = now.Add(p.cooldown), p.mute
+	log.Printf("%s flooding: offense %d, no sending for %s", id, f.offenses, p.cooldown)
+	if p.mute {
+		return 0, fmt.Errorf("muted for flooding for %s", p.cooldown)
+	}
+	return 0, fmt.Errorf("%w; you can't send for %s", errRateLimited, p.cooldown)
+}
+
+// retryAfter is how long a bucket holding tokens takes to refill to one at
+// rate per second, rounded up to a tenth of a second so waiting that long is
+// always enough.
+func retryAfter(tokens, rate float64) time.Duration {
+	d := time.Duration((1 - tokens) / rate * float64(time.Second))
+	return (d + 100*time.Millisecond - 1).Truncate(100 * time.Millisecond)
+}
+
+// historyEntry is the history record for a chat message.
+func historyEntry(m protocol.MessageArgs) Message {
+	if m.Data != nil {
+		return Message{Sender: m.Sender, Text: fmt.Sprintf("[sent %s, %d bytes]", m.ContentType, len(m.Data)), Room: m.Room}
+	}
+	return Message{Sender: m.Sender, Text: m.Text, Room: m.Room}
+}
+
+// checkLength rejects text longer than maxLen runes.
+func (c *ChatServer) checkLength(text string) error {
+	if n := utf8.RuneCountInString(text); c.maxLen > 0 && n > c.maxLen {
+		return fmt.Errorf("message is %d characters long; the limit is %d", n, c.maxLen)
+	}
+	return nil
+}
+
+// checkTable rejects a missing table and rows that don't match the headers.
+func checkTable(t *protocol.Table) error {
+	if t == nil || len(t.Headers) == 0 {
+		return errors.New("table message without headers")
+	}
+	for i, row := range t.Rows {
+		if len(row) != len(t.Headers) {
+			return fmt.Errorf("table row %d has %d cells, want %d", i+1, len(row), len(t.Headers))
+		}
+	}
+	return nil
+}
+
+// tableText is the one-line form of t kept in history, e.g. "[name | age; bob | 42]".
+func tableText(t protocol.Table) string {
+	rows := []string{strings.Join(t.Headers, " | ")}
+	for _, row := range t.Rows {
+		rows = append(rows, strings.Join(row, " | "))
+	}
+	return "[" + strings.Join(rows, "; ") + "]"
+}
+
+// Send: append to the sender's room's history and broadcast to the others in
+// that room (no self-echo). Returns the room's full history to caller.
+func (c *ChatServer) Send(args protocol.MessageArgs, reply *protocol.HistoryReply) error {
+	m, recipients, snap, err := c.send(args)
+	if err != nil {
+		return err
+	}
+	reply.Messages = formatHistory(snap, c.timeFormat)
+	reply.Seqs = seqsOf(snap)
+	reply.Recipients = recipients
+	reply.Last = m.Seq
+	return nil
+}
+
+// SendAck: Send, returning only where the message landed instead of the history
+func (c *ChatServer) SendAck(args protocol.MessageArgs, reply *protocol.SendAck) error {
+	m, recipients, _, err := c.send(args)
+	if err != nil {
+		return err
+	}
+	*reply = protocol.SendAck{Seq: m.Seq, Time: m.Time, Recipients: recipients, Backpressure: c.backpressure()}
+	return nil
+}
+
+// Backpressure pauses asked of senders, from the first at -backpressure fill
+// up to a full broadcast queue.
+const (
+	pressureMinPause = 100 * time.Millisecond
+	pressureMaxPause = time.Second
+)
+
+// backpressure is how long a sender should wait before its next message: 0
+// while the broadcast queue is less than pressureAt full, then rising from
+// pressureMinPause to pressureMaxPause as the queue fills. Cooperative
+// clients slow down; the rate limit is there for the rest.
+func (c *ChatServer) backpressure() time.Duration {
+	if c.pressureAt <= 0 {
+		return 0
+	}
+	fill := float64(len(c.broadcast)) / float64(cap(c.broadcast))
+	if fill < c.pressureAt {
+		return 0
+	}
+	frac := 1.0
+	if c.pressureAt < 1 {
+		frac = min(1, (fill-c.pressureAt)/(1-c.pressureAt))
+	}
+	return pressureMinPause + time.Duration(frac*float64(pressureMaxPause-pressureMinPause))
+}
+
+// send checks, stores and publishes a chat message. It returns the history
+// entry, how many clients the message goes to and the room's history up to it.
+func (c *ChatServer) send(args protocol.MessageArgs) (Message, int, []Message, error) {
+	if args.Users != nil {
+		return Message{}, 0, nil, errors.New("user lists come from the server only")
+	}
+	switch args.Kind {
+	case "", "table":
+	default: // joins, leaves, announcements and the like are set by the server only
+		return Message{}, 0, nil, fmt.Errorf("message kind %q cannot be sent", args.Kind)
+	}
+	if args.Data != nil {
+		if len(args.Data) > c.maxBlob {
+			return Message{}, 0, nil, fmt.Errorf("payload of %d bytes exceeds limit of %d", len(args.Data), c.maxBlob)
+		}
+		if args.ContentType == "" {
+			args.ContentType = "application/octet-stream"
+		}
+	}
+	if args.Kind == "table" {
+		if err := checkTable(args.Table); err != nil {
+			return Message{}, 0, nil, err
+		}
+		args.Text = tableText(*args.Table) // what history and older clients show
+	}
+	if err := c.checkLength(args.Text); err != nil {
+		return Message{}, 0, nil, err
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return Message{}, 0, nil, errShuttingDown
+	}
+	if c.everyone == "admin" && pingOf(args.Text) == "everyone" {
+		if cl, ok := c.clients[args.Sender]; !ok || !cl.admin {
+			c.mu.Unlock()
+			return Message{}, 0, nil, errors.New("only admins may mention @everyone on this server; try @here")
+		}
+	}
+	delay, err := c.allowSendLocked(args.Sender)
+	if err != nil {
+		c.mu.Unlock()
+		return Message{}, 0, nil, err
+	}
+	if delay > 0 {
+		// over the burst but within the grace allowance: slow the sender down
+		c.mu.Unlock()
+		time.Sleep(delay)
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return Message{}, 0, nil, errShuttingDown
+		}
+	}
+	if args.Data != nil {
+		args.Text = ""
+	} else if c.macros {
+		args.Text = c.expandMacrosLocked(args.Text)
+	}
+	args.Room = c.roomOfLocked(args.Sender)
+	m := c.appendLocked(historyEntry(args))
+	args.Seq = m.Seq
+	snap := c.history.All(args.Room)
+	members := c.roomLocked(args.Room).members
+	recipients := len(members)
+	if cl, ok := members[args.Sender]; ok {
+		recipients-- // no self-echo
+		cl.lastActive = time.Now()
+		cl.sent++
+	}
+	c.sentTotal++
+	c.sending.Add(1)
+	c.mu.Unlock()
+	logEvent(slog.LevelInfo, "message_sent", "", "client", args.Sender, "room", args.Room, "seq", m.Seq, "recipients", recipients)
+
+	// broadcast to others
+	c.publish(args)
+	if c.onPersistError == "fail" {
+		if err := c.history.Sync(); err != nil {
+			return m, recipients, snap, fmt.Errorf("message delivered, but not saved to the history file: %v", err)
+		}
+	}
+	return m, recipients, snap, nil
+}
+
+// persistAlertEvery is how often admins are alerted while history writes keep
+// failing.
+const persistAlertEvery = time.Minute
+
+// persistFailed is the history file's report of a failed write. It is counted
+// for Stats and the admins online are told, at most once per
+// persistAlertEvery. Messages are still delivered either way.
+func (c *ChatServer) persistFailed(err error) {
+	c.persistErrors.Add(1)
+	c.mu.Lock()
+	if c.closing || time.Since(c.persistAlerted) < persistAlertEvery {
+		c.mu.Unlock()
+		return
+	}
+	c.persistAlerted = time.Now()
+	var admins []string
+	for id, cl := range c.clients {
+		if cl.admin {
+			admins = append(admins, id)
+		}
+	}
+	c.sending.Add(len(admins))
+	c.mu.Unlock()
+	text := fmt.Sprintf("[admin alert] history is not being saved: %v (messages are still delivered)", err)
+	for _, id := range admins {
+		c.enqueue(broadcastMsg{MessageArgs: protocol.MessageArgs{Sender: "server", Text: text}, system: true, to: id, local: true})
+	}
+}
+
+// macros maps each !token to its current value. Values are computed with c.mu held.
+var macros = map[string]func(c *ChatServer) string{
+	"!uptime": func(c *ChatServer) string { return time.Since(c.started).Round(time.Second).String() },
+	"!users":  func(c *ChatServer) string { return strconv.Itoa(len(c.clients)) },
+}
+
+var macroToken = regexp.MustCompile(`![A-Za-z]+`)
+
+// expandMacrosLocked substitutes known macro tokens in text; unknown !tokens
+// are left as typed. c.mu must be held.
+func (c *ChatServer) expandMacrosLocked(text string) string {
+	return macroToken.ReplaceAllStringFunc(text, func(tok string) string {
+		if fn, ok := macros[tok]; ok {
+			return fn(c)
+		}
+		return tok
+	})
+}
+
+// ListUsers: return the IDs of everyone connected, sorted
+func (c *ChatServer) ListUsers(_ struct{}, reply *protocol.ListUsersReply) error {
+	c.mu.Lock()
+	for id := range c.clients {
+		reply.Users = append(reply.Users, id)
+	}
+	c.mu.Unlock()
+	sort.Strings(reply.Users)
+	return nil
+}
+
+// RecentlyLeft: return the most recent disconnects, oldest first
+func (c *ChatServer) RecentlyLeft(_ struct{}, reply *protocol.RecentLeftReply) error {
+	c.mu.Lock()
+	reply.Users = append([]protocol.LeftUser(nil), c.recentLeft...)
+	c.mu.Unlock()
+	return nil
+}
+
+// isAdmin reports whether token is the admin token. Admin RPCs are off when
+// no token is configured.
+func (c *ChatServer) isAdmin(token string) bool {
+	return c.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.adminToken)) == 1
+}
+
+// PostAnnouncement: admin-only; add a server-wide announcement and show it to
+// everyone connected
+func (c *ChatServer) PostAnnouncement(args protocol.AnnouncementArgs, reply *struct{}) error {
+	if !c.isAdmin(args.Token) {
+		return errors.New("not authorized")
+	}
+	if strings.TrimSpace(args.Text) == "" {
+		return errors.New("empty announcement")
+	}
+	a := protocol.Announcement{Text: args.Text, Posted: time.Now()}
+	if args.TTL > 0 {
+		a.Expires = a.Posted.Add(args.TTL)
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	c.announcements = append(c.activeAnnouncementsLocked(), a)
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	c.enqueue(broadcastMsg{MessageArgs: announcementMsg(a), system: true, local: true})
+	return nil
+}
+
+// Announcements: list the announcements that have not expired
+func (c *ChatServer) Announcements(_ struct{}, reply *protocol.AnnouncementsReply) error {
+	c.mu.Lock()
+	reply.Announcements = c.activeAnnouncementsLocked()
+	c.mu.Unlock()
+	return nil
+}
+
+// activeAnnouncementsLocked drops expired announcements and returns a copy of
+// the rest. c.mu must be held.
+func (c *ChatServer) activeAnnouncementsLocked() []protocol.Announcement {
+	now := time.Now()
+	kept := c.announcements[:0]
+	for _, a := range c.announcements {
+		if a.Expires.IsZero() || now.Before(a.Expires) {
+			kept = append(kept, a)
+		}
+	}
+	c.announcements = kept
+	return append([]protocol.Announcement(nil), kept...)
+}
+
+func announcementMsg(a protocol.Announcement) protocol.MessageArgs {
+	return protocol.MessageArgs{Text: "[announcement] " + a.Text, Kind: "announcement"}
+}
+
+// greet sends a newly registered client the active announcements.
+func (c *ChatServer) greet(id string) {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return
+	}
+	active := c.activeAnnouncementsLocked()
+	c.sending.Add(len(active))
+	c.mu.Unlock()
+	for _, a := range active {
+		c.enqueue(broadcastMsg{MessageArgs: announcementMsg(a), to: id})
+	}
+}
+
+// Inspect: admin-only view of one connected client's state
+func (c *ChatServer) Inspect(args protocol.InspectArgs, reply *protocol.InspectReply) error {
+	if !c.isAdmin(args.Token) {
+		return errors.New("not authorized")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.clients[args.Target]
+	if !ok {
+		return fmt.Errorf("user %s not online", args.Target)
+	}
+	*reply = protocol.InspectReply{
+		ID:           cl.id,
+		Addr:         cl.addr,
+		Connected:    cl.joined,
+		LastActive:   cl.lastActive,
+		MessagesSent: cl.sent,
+		QueueLag:     int(cl.pending.Load()),
+		Room:         cl.room,
+	}
+	return nil
+}
+
+// AuditLog: admin-only; return the audit log and whether its chain is intact
+func (c *ChatServer) AuditLog(args protocol.AdminArgs, reply *protocol.AuditReply) error {
+	if !c.isAdmin(args.Token) {
+		return errors.New("not authorized")
+	}
+	reply.Entries = c.audit.snapshot()
+	reply.Intact = verifyAudit(reply.Entries)
+	return nil
+}
+
+// Hello: handshake returning the server's build version
+func (c *ChatServer) Hello(_ struct{}, reply *protocol.HelloReply) error {
+	reply.Version = Version
+	return nil
+}
+
+// Stats: report how busy the server is, for monitoring
+func (c *ChatServer) Stats(_ struct{}, reply *protocol.StatsReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply.Clients = len(c.clients)
+	for _, room := range c.history.Rooms() {
+		reply.Stored += len(c.history.All(room))
+	}
+	reply.Sent = c.sentTotal
+	reply.PersistErrors = c.persistErrors.Load()
+	reply.Uptime = time.Since(c.started)
+	return nil
+}
+
+// GetConfig: report how the server is configured, leaving out secrets
+func (c *ChatServer) GetConfig(_ struct{}, reply *protocol.ConfigReply) error {
+	*reply = protocol.ConfigReply{
+		Version:        Version,
+		Delivery:       "fast",
+		MaxHistory:     c.maxHistory,
+		MaxBlob:        c.maxBlob,
+		MaxLen:         c.maxLen,
+		SendRate:       c.sendRate,
+		SendBurst:      c.sendBurst,
+		SendGrace:      c.sendGrace,
+		GraceDelay:     c.graceDelay,
+		GraceDelayMax:  c.graceDelayMax,
+		FloodPenalties: formatPenalties(c.penalties),
+		OffenseDecay:   c.offenseDecay,
+		Persistent:     c.persistent(),
+		AnnounceJoins:  !c.silentJoins,
+		ClearWhenEmpty: c.clearWhenEmpty,
+		MaxRooms:       c.maxRooms,
+		RoomCreate:     c.roomCreate,
+		Everyone:       c.everyone,
+		IdleAfter:      c.idleAfter,
+		Macros:         c.macros,
+		NameSimilarity: c.nameSimilarity,
+		TimeFormat:     c.timeFormat,
+		LeaveGrace:     c.leaveGrace,
+		DeliverTimeout: c.deliverTimeout,
+		EnqueueWait:    c.enqueueWait,
+		Backpressure:   c.pressureAt,
+		DialTimeout:    c.dialTimeout,
+		SlowStart:      c.slowStart,
+		ByteQuota:      c.byteQuota,
+		ByteWindow:     c.byteWindow,
+		RegLimit:       c.regLimit,
+		RegWindow:      c.regWindow,
+		Peers:          len(c.peers),
+		AdminEnabled:   c.adminToken != "",
+		AuthRequired:   c.authToken != "",
+		TLS:            c.tlsConfig != nil,
+		StartTLS:       c.startTLS,
+	}
+	switch d := c.delivery.(type) {
+	case *orderedDelivery:
+		reply.Delivery = "ordered"
+	case *fastDelivery:
+		reply.Workers = d.workers
+	}
+	return nil
+}
+
+// roomHistory returns room's entries after seq (0 = all of them). If some
+// have been dropped by then, the rest is returned. A seq past the room's last
+// one means the room was cleared and numbering restarted since the caller
+// saw it, so everything is returned.
+func (c *ChatServer) roomHistory(room string, seq uint64, reply *protocol.HistoryReply) error {
+	c.mu.Lock()
+	last := c.seqs[room]
+	if seq > last {
+		seq = 0
+	}
+	since := c.history.Since(room, seq)
+	c.mu.Unlock()
+	reply.Messages = formatHistory(since, c.timeFormat)
+	reply.Seqs = seqsOf(since)
+	reply.Last = last
+	return nil
+}
+
+// persistent reports whether history survives a restart.
+func (c *ChatServer) persistent() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.history.(*fileStore)
+	return ok
+}
+
+// lastSeq is the sequence number of the newest entry in msgs, 0 if none.
+func lastSeq(msgs []Message) uint64 {
+	if len(msgs) == 0 {
+		return 0
+	}
+	return msgs[len(msgs)-1].Seq
+}
+
+// appendLocked stores m in the history of m.Room, stamped with the current time
+// and the room's next sequence number, and returns the stored entry. c.mu must
+// be held.
+func (c *ChatServer) appendLocked(m Message) Message {
+	c.seqs[m.Room]++
+	m.Seq = c.seqs[m.Room]
+	m.Time = time.Now()
+	c.history.Append(m)
+	c.lastAppend = m.Time
+	return m
+}
+
+// compact drops entries older than retention from every room, then has the
+// history store bring its saved copy in line with what it holds: entries
+// trimmed beyond -history and any a failed removal left on disk go too. It
+// returns how many entries retention dropped. Appends wait on c.mu meanwhile
+// and are queued after the rewrite.
+func (c *ChatServer) compact() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	if c.retention > 0 {
+		cutoff := time.Now().Add(-c.retention)
+		for _, room := range c.history.Rooms() {
+			msgs := c.history.All(room)
+			i := sort.Search(len(msgs), func(i int) bool { return !msgs[i].Time.Before(cutoff) })
+			if i > 0 {
+				c.history.Replace(room, slices.Clone(msgs[i:]))
+				dropped += i
+			}
+		}
+	}
+	c.history.Compact()
+	return dropped
+}
+
+// compactEvery runs compact once per interval until shutdown, skipping runs
+// while history has grown within the last idle.
+func (c *ChatServer) compactEvery(interval, idle time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.stopped:
+			return
+		case <-tick.C:
+		}
+		c.mu.Lock()
+		busy := c.closing || time.Since(c.lastAppend) < idle
+		c.mu.Unlock()
+		if busy {
+			continue
+		}
+		if n := c.compact(); n > 0 {
+			log.Printf("compacted history: dropped %d entries past -retention", n)
+		}
+	}
+}
+
+// HistoryStore keeps the history of every room. ChatServer stamps entries
+// with Seq, Time and Room before Append and serializes all calls under its
+// mutex, so implementations need no locking of their own; Sync is the one
+// call made without the mutex. Slices returned by All and Since are read
+// after the mutex is released and must stay valid, and unchanged, through
+// later calls.
+type HistoryStore interface {
+	Append(m Message)                        // add m as its room's newest entry
+	All(room string) []Message               // the room's entries, oldest first
+	Since(room string, seq uint64) []Message // the room's entries with Seq > seq
+	Replace(room string, msgs []Message)     // make msgs the room's whole history
+	Rooms() []string                         // rooms with any history, sorted
+	Compact()                                // make the saved copy, if any, hold exactly what the store does
+	Sync() error                             // wait for earlier changes to be stored; why they aren't, if not
+	Close() error                            // flush and stop; no calls follow
+}
+
+// memoryStore is the default HistoryStore: each room's entries in a slice,
+// the oldest dropped beyond max (0 = unlimited). Slices are only appended to
+// in place and trimming only reslices, so ones already handed out stay valid.
+type memoryStore struct {
+	max   int
+	rooms map[string][]Message
+}
+
+func newMemoryStore(max int) *memoryStore {
+	return &memoryStore{max: max, rooms: make(map[string][]Message)}
+}
+
+func (s *memoryStore) Append(m Message) {
+	msgs := append(s.rooms[m.Room], m)
+	if s.max > 0 && len(msgs) > s.max {
+		msgs = msgs[len(msgs)-s.max:]
+	}
+	s.rooms[m.Room] = msgs
+}
+
+// All caps the slice's capacity, so a later Append can't write into it.
+func (s *memoryStore) All(room string) []Message {
+	msgs := s.rooms[room]
+	return msgs[:len(msgs):len(msgs)]
+}
+
+func (s *memoryStore) Since(room string, seq uint64) []Message {
+	msgs := s.All(room)
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq > seq })
+	return msgs[i:]
+}
+
+// Replace keeps msgs itself; callers pass a new slice rather than editing an
+// old one in place.
+func (s *memoryStore) Replace(room string, msgs []Message) {
+	if len(msgs) == 0 {
+		delete(s.rooms, room)
+		return
+	}
+	s.rooms[room] = msgs
+}
+
+func (s *memoryStore) Rooms() []string {
+	rooms := make([]string, 0, len(s.rooms))
+	for r := range s.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (s *memoryStore) Compact()     {}
+func (s *memoryStore) Sync() error  { return nil }
+func (s *memoryStore) Close() error { return nil }
+
+// fileStore is a memoryStore whose changes are also written to a historyFile,
+// for -store.
+type fileStore struct {
+	*memoryStore
+	file         *historyFile
+	stale        int // entries in the file that memory has trimmed beyond max
+	compactAfter int // rewrite the file once stale reaches this; 0 = only on Compact
+}
+
+// Append queues m for the file. If the writer has fallen storeBacklog ops
+// behind, a rewrite of everything replaces the backlog, so a slow disk costs
+// at most one copy of the history in memory.
+func (s *fileStore) Append(m Message) {
+	if s.max > 0 && len(s.rooms[m.Room]) >= s.max {
+		s.stale++ // the room's oldest is trimmed from memory but stays in the file
+	}
+	s.memoryStore.Append(m)
+	if s.file.backlog() >= storeBacklog || s.compactAfter > 0 && s.stale >= s.compactAfter {
+		s.Compact()
+		return
+	}
+	s.file.put(storeOp{msg: &m})
+}
+
+// Compact rewrites the file to hold the entries in memory, and no others.
+func (s *fileStore) Compact() {
+	s.stale = 0
+	s.file.put(storeOp{rewrite: s.everything()})
+}
+
+// Replace rewrites the whole file, since entries of every room share it.
+func (s *fileStore) Replace(room string, msgs []Message) {
+	s.memoryStore.Replace(room, msgs)
+	s.Compact()
+}
+
+// everything is every room's entries in the order they were added, as the
+// file holds them.
+func (s *fileStore) everything() []Message {
+	var all []Message
+	for _, r := range s.Rooms() {
+		all = append(all, s.All(r)...)
+	}
+	sortByTime(all)
+	return all
+}
+
+// sortByTime puts msgs oldest first. Each room numbers its own entries, so
+// Seq only orders entries within a room.
+func sortByTime(msgs []Message) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if msgs[i].Room == msgs[j].Room {
+			return msgs[i].Seq < msgs[j].Seq
+		}
+		return msgs[i].Time.Before(msgs[j].Time)
+	})
+}
+
+func (s *fileStore) Sync() error { return s.file.sync() }
+
+func (s *fileStore) Close() error {
+	s.file.close()
+	return nil
+}
+
+// historyFile keeps history in a file, one JSON-encoded Message per line.
+// Writes happen on the file's own goroutine so handlers never wait on disk:
+// put only queues, and a rewrite makes the writes queued before it moot.
+type historyFile struct {
+	path string
+	wake chan struct{} // cap 1: something was queued, or the file closed
+	done chan struct{}
+
+	mu     sync.Mutex
+	queue  []storeOp
+	closed bool
+	onFail func(error) // told of each failed write, from the writer goroutine
+}
+
+// storeBacklog is how many queued ops fileStore.Append lets build up before
+// it queues one rewrite instead.
+const storeBacklog = 1024
+
+// storeOp appends msg, or reports on everything before it to synced, or
+// otherwise replaces the file with rewrite.
+type storeOp struct {
+	msg     *Message
+	rewrite []Message
+	synced  chan error
+}
+
+// put queues op for the writer without waiting. A rewrite drops the appends
+// and rewrites queued before it, since it holds the whole history.
+func (st *historyFile) put(op storeOp) {
+	st.mu.Lock()
+	if op.msg == nil && op.synced == nil {
+		kept := st.queue[:0]
+		for _, q := range st.queue {
+			if q.synced != nil {
+				kept = append(kept, q)
+			}
+		}
+		st.queue = kept
+	}
+	st.queue = append(st.queue, op)
+	st.mu.Unlock()
+	st.signal()
+}
+
+func (st *historyFile) signal() {
+	select {
+	case st.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// notify makes fn the one told of failed writes.
+func (st *historyFile) notify(fn func(error)) {
+	st.mu.Lock()
+	st.onFail = fn
+	st.mu.Unlock()
+}
+
+// report passes a failed write on to onFail, if set.
+func (st *historyFile) report(err error) {
+	st.mu.Lock()
+	fn := st.onFail
+	st.mu.Unlock()
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// backlog is the number of ops queued and not yet taken by the writer.
+func (st *historyFile) backlog() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.queue)
+}
+
+// loadHistory reads the entries stored at path, keeping the last max (0 = all)
+// of each room. A missing file is an empty history. On a read error the
+// entries read before it are returned along with the error.
+func loadHistory(path string, max int) ([]Message, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHistory(f, path, max)
+}
+
+// readHistory is loadHistory on an open file; path is only for messages.
+// Lines have no length limit, since -maxlen 0 allows any size of entry.
+func readHistory(r io.Reader, path string, max int) ([]Message, error) {
+	var msgs []Message
+	br := bufio.NewReader(r)
+	var err error
+	for n := 1; err == nil; n++ {
+		var line []byte
+		line, err = br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			break // a partial line from a failed read is not an entry
+		}
+		var m Message
+		if jerr := json.Unmarshal(line, &m); jerr != nil {
+			log.Printf("%s:%d: skipping bad entry: %v", path, n, jerr)
+			continue
+		}
+		if m.Room == "" {
+			m.Room = defaultRoom
+		}
+		msgs = append(msgs, m)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if max > 0 {
+		perRoom := make(map[string]int)
+		for _, m := range msgs {
+			perRoom[m.Room]++
+		}
+		kept := msgs[:0]
+		for _, m := range msgs {
+			if perRoom[m.Room] > max {
+				perRoom[m.Room]--
+				continue // one of the room's oldest
+			}
+			kept = append(kept, m)
+		}
+		msgs = kept
+	}
+	return msgs, err
+}
+
+// openStore loads the history saved at path and keeps saving to it. If the
+// file can't be read to the end it is moved aside, not overwritten, and the
+// entries read before the error are kept; if it can't be moved either, history
+// stays in memory only. It returns the store and each room's last sequence
+// number.
+func openStore(path string, max int) (HistoryStore, map[string]uint64) {
+	msgs, err := loadHistory(path, max)
+	mem := newMemoryStore(max)
+	seqs := make(map[string]uint64)
+	for _, m := range msgs {
+		mem.Append(m)
+		if m.Seq > seqs[m.Room] {
+			seqs[m.Room] = m.Seq
+		}
+	}
+	if err != nil {
+		aside := fmt.Sprintf("%s.unreadable-%s", path, time.Now().Format("20060102T150405"))
+		if rerr := os.Rename(path, aside); rerr != nil {
+			log.Printf("load history from %s: %v; can't move it aside (%v), so history will not be saved", path, err, rerr)
+			return mem, seqs
+		}
+		log.Printf("load history from %s: %v; kept the %d entries before the error and moved the file to %s", path, err, len(msgs), aside)
+	}
+	f, err := openHistoryFile(path, msgs)
+	if err != nil {
+		log.Printf("store %s: %v (history will not be saved)", path, err)
+		return mem, seqs
+	}
+	log.Printf("loaded %d history entries from %s", len(msgs), path)
+	return &fileStore{memoryStore: mem, file: f}, seqs
+}
+
+// openHistoryFile starts a writer for path, first rewriting it to hold
+// exactly msgs so dropped entries don't pile up across restarts.
+func openHistoryFile(path string, msgs []Message) (*historyFile, error) {
+	if err := writeHistory(path, msgs); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	st := &historyFile{path: path, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go st.run(f)
+	return st, nil
+}
+
+// run applies the queued ops. A rewrite that fails leaves the old file in
+// place, which may still hold entries the rewrite dropped, so the writer keeps
+// the wanted contents and tries the rewrite again with each later op instead
+// of appending to the old file. Until one works, sync reports the failure.
+func (st *historyFile) run(f io.WriteCloser) {
+	defer close(st.done)
+	var retry []Message // the file's wanted contents while a rewrite is failing
+	var failed error    // why the file is not as wanted; nil once it is
+	rewrite := func(msgs []Message) {
+		if f != nil {
+			f.Close()
+			f = nil
+		}
+		err := writeHistory(st.path, msgs)
+		if err == nil {
+			var opened *os.File
+			if opened, err = os.OpenFile(st.path, os.O_WRONLY|os.O_APPEND, 0o644); err == nil {
+				f = opened // not a nil *os.File, which f != nil would take for an open file
+			}
+		}
+		if err != nil {
+			if failed == nil {
+				log.Printf("store %s: %v (retrying with the next change)", st.path, err)
+			}
+			st.report(err)
+			retry, failed = msgs, err
+			return
+		}
+		if failed != nil {
+			log.Printf("store %s: rewritten after the earlier failure", st.path)
+		}
+		retry, failed = nil, nil
+	}
+	for range st.wake {
+		st.mu.Lock()
+		ops, closed := st.queue, st.closed
+		st.queue = nil
+		st.mu.Unlock()
+		for _, op := range ops {
+			switch {
+			case op.synced != nil:
+				op.synced <- failed
+			case op.msg != nil && f != nil:
+				line, _ := json.Marshal(op.msg)
+				if _, err := f.Write(append(line, '\n')); err != nil {
+					log.Printf("store %s: %v", st.path, err)
+					failed = err
+					st.report(err)
+				}
+			case op.msg != nil:
+				rewrite(append(retry, *op.msg))
+			default:
+				rewrite(op.rewrite)
+			}
+		}
+		if closed {
+			break
+		}
+	}
+	if f != nil {
+		f.Close()
+	}
+}
+
+// sync waits until the ops queued before it are applied, and returns why the
+// file doesn't hold what it should, or nil.
+func (st *historyFile) sync() error {
+	synced := make(chan error, 1)
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return errors.New("history store is closed")
+	}
+	st.queue = append(st.queue, storeOp{synced: synced})
+	st.mu.Unlock()
+	st.signal()
+	return <-synced
+}
+
+// close writes out whatever is queued and stops the store.
+func (st *historyFile) close() {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+	st.signal()
+	<-st.done
+}
+
+// writeHistory replaces the file at path with msgs, via a rename so a crash
+// leaves either the old or the new contents.
+func writeHistory(path string, msgs []Message) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, m := range msgs {
+		if err := enc.Encode(m); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// migrateHistory reads the history file at from and writes its entries to
+// the new file to in the format -store uses, then reads to back to check that
+// every record came through. from may be in that format, including files
+// saved before rooms or per-room numbering, or plain text with one entry per
+// line as history shows it ("alice: hi", or a notice such as "User bob
+// joined"), which goes to the default room without times. Each room's entries
+// are numbered again from 1. It returns how many entries were migrated and
+// the format from was read as.
+func migrateHistory(from, to string) (int, string, error) {
+	if _, err := os.Stat(to); err == nil {
+		return 0, "", fmt.Errorf("%s already exists; migrate to a new file", to)
+	}
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return 0, "", err
+	}
+	format := "text"
+	if first := bytes.TrimSpace(data); len(first) > 0 && first[0] == '{' {
+		format = "jsonl"
+	}
+	var msgs []Message
+	seqs := make(map[string]uint64)
+	for n, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var m Message
+		switch format {
+		case "jsonl":
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				return 0, format, fmt.Errorf("%s:%d: %v", from, n+1, err)
+			}
+			if m.Room == "" {
+				m.Room = defaultRoom
+			}
+		default:
+			m = Message{Text: strings.TrimSuffix(line, "\r"), Room: defaultRoom}
+			if sender, text, ok := strings.Cut(m.Text, ": "); ok && sender != "" && !strings.ContainsAny(sender, " \t") {
+				m.Sender, m.Text = sender, text
+			}
+		}
+		seqs[m.Room]++
+		m.Seq = seqs[m.Room]
+		msgs = append(msgs, m)
+	}
+	if err := writeHistory(to, msgs); err != nil {
+		return 0, format, err
+	}
+	same := func(a, b Message) bool {
+		return a.Seq == b.Seq && a.Sender == b.Sender && a.Text == b.Text && a.Room == b.Room && a.Time.Equal(b.Time)
+	}
+	if back, err := loadHistory(to, 0); err != nil || !slices.EqualFunc(msgs, back, same) {
+		os.Remove(to) // not to be mistaken for a good copy
+		return 0, format, fmt.Errorf("%s doesn't read back as the %d entries written (%v)", to, len(msgs), err)
+	}
+	return len(msgs), format, nil
+}
+
+// auditLog is the append-only record of administrative actions, kept in
+// memory and, when a file is configured, appended to it as JSON lines.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []protocol.AuditEntry
+	path    string
+	f       *os.File // nil = memory only, or closed
+}
+
+// openAuditLog loads the entries already at path, so the chain continues
+// across restarts, and opens it for appending.
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for n := 1; sc.Scan(); n++ {
+			var e protocol.AuditEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				log.Printf("%s:%d: skipping bad entry: %v", path, n, err) // the chain reports the gap
+				continue
+			}
+			a.entries = append(a.entries, e)
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		if !verifyAudit(a.entries) {
+			log.Printf("audit log %s fails verification: it was edited or truncated", path)
+		}
+	}
+	if a.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// verifyAudit reports whether entries form an unbroken hash chain.
+func verifyAudit(entries []protocol.AuditEntry) bool {
+	prev := ""
+	for _, e := range entries {
+		if e.Prev != prev || e.Digest() != e.Hash {
+			return false
+		}
+		prev = e.Hash
+	}
+	return true
+}
+
+// record appends an entry for action, chained to the one before it. The file
+// is synced before record returns, so an action is never logged only in memory.
+func (a *auditLog) record(actor, action, target, detail string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := protocol.AuditEntry{Seq: 1, Time: time.Now().Round(0), Actor: actor, Action: action, Target: target, Detail: detail}
+	if n := len(a.entries); n > 0 {
+		e.Seq = a.entries[n-1].Seq + 1
+		e.Prev = a.entries[n-1].Hash
+	}
+	e.Hash = e.Digest()
+	a.entries = append(a.entries, e)
+	if a.f == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		log.Printf("audit log %s: %v", a.path, err)
+	} else if err := a.f.Sync(); err != nil {
+		log.Printf("audit log %s: %v", a.path, err)
+	}
+}
+
+func (a *auditLog) snapshot() []protocol.AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]protocol.AuditEntry(nil), a.entries...)
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+}
+
+// Peer: mark this connection as a peer server allowed to Relay
+func (c *ChatServer) Peer(args PeerArgs, reply *struct{}) error {
+	if c.peerToken == "" || subtle.ConstantTimeCompare([]byte(args.Token), []byte(c.peerToken)) != 1 {
+		return errors.New("peering not authorized")
+	}
+	return nil
+}
+
+// Relay: store and broadcast a message that originated on a peer server, or
+// for a relayed forget, remove the sender's entries and show the notice
+func (c *ChatServer) Relay(args RelayArgs, reply *struct{}) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	if args.Forget {
+		if c.forgetLocked(args.Msg.Sender, args.Count) == 0 {
+			c.mu.Unlock()
+			return nil // nothing of theirs here, so nothing to announce
+		}
+		c.sending.Add(1)
+		c.mu.Unlock()
+		c.enqueue(broadcastMsg{MessageArgs: args.Msg, system: true, fromPeer: true})
+		return nil
+	}
+	if args.Msg.Room == "" {
+		args.Msg.Room = defaultRoom // from a peer without rooms, or a server-wide notice
+	}
+	if args.System {
+		args.Msg.Seq = c.appendLocked(Message{Text: args.Msg.Text, Room: args.Msg.Room}).Seq
+	} else {
+		args.Msg.Seq = c.appendLocked(historyEntry(args.Msg)).Seq
+	}
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	c.enqueue(broadcastMsg{MessageArgs: args.Msg, system: args.System, fromPeer: true})
+	return nil
+}
+
+// SendPrivate: deliver a message to args.To and echo it to the sender, without
+// touching the shared history
+func (c *ChatServer) SendPrivate(args protocol.PrivateArgs, reply *struct{}) error {
+	m := args.Msg
+	if m.Data != nil || m.Table != nil {
+		return errors.New("private messages are text only")
+	}
+	if err := c.checkLength(m.Text); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	if _, ok := c.clients[args.To]; !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("user %s not online", args.To)
+	}
+	delay, err := c.allowSendLocked(m.Sender)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if delay > 0 {
+		c.mu.Unlock()
+		time.Sleep(delay)
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return errShuttingDown
+		}
+	}
+	if cl, ok := c.clients[m.Sender]; ok {
+		cl.lastActive = time.Now()
+		cl.sent++
+	}
+	c.sentTotal++
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	m.Kind = "private"
+	m.Text = fmt.Sprintf("%s -> %s (private): %s", m.Sender, args.To, m.Text)
+	c.enqueue(broadcastMsg{MessageArgs: m, to: args.To})
+	return nil
+}
+
+// SetRole: admin-only; give args.Target args.Role, or take it away. Roles go
+// with the name, so they hold across reconnects and whether or not the
+// target is online. "admin" comes with the admin token and can't be given.
+func (c *ChatServer) SetRole(args protocol.RoleArgs, reply *struct{}) error {
+	if !c.isAdmin(args.Token) {
+		return errors.New("not authorized")
+	}
+	if args.Role == "" || args.Target == "" || strings.ContainsFunc(args.Role, unicode.IsSpace) {
+		return fmt.Errorf("bad role %q or user %q", args.Role, args.Target)
+	}
+	if args.Role == "admin" {
+		return errors.New("the admin role comes with the admin token")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if args.Remove {
+		if !c.roles[args.Role][args.Target] {
+			return fmt.Errorf("%s doesn't have role %s", args.Target, args.Role)
+		}
+		delete(c.roles[args.Role], args.Target)
+		if len(c.roles[args.Role]) == 0 {
+			delete(c.roles, args.Role)
+		}
+		return nil
+	}
+	if c.roles[args.Role] == nil {
+		c.roles[args.Role] = make(map[string]bool)
+	}
+	c.roles[args.Role][args.Target] = true
+	return nil
+}
+
+// Roles: list each role and who holds it
+func (c *ChatServer) Roles(_ struct{}, reply *protocol.RolesReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply.Roles = make(map[string][]string)
+	for role, ids := range c.roles {
+		for id := range ids {
+			reply.Roles[role] = append(reply.Roles[role], id)
+		}
+		sort.Strings(reply.Roles[role])
+	}
+	if admins := c.holdersLocked("admin"); len(admins) > 0 {
+		reply.Roles["admin"] = admins
+	}
+	return nil
+}
+
+// holdersLocked is the IDs online holding role, sorted. c.mu must be held.
+func (c *ChatServer) holdersLocked(role string) []string {
+	var ids []string
+	for id, cl := range c.clients {
+		if role == "admin" && cl.admin || c.roles[role][id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RoleDM: send a private message to everyone online holding args.Role, the
+// sender aside. Admins may message any role; anyone else only a role they
+// hold. Like SendPrivate, it is delivered directly and not kept in history.
+func (c *ChatServer) RoleDM(args protocol.RoleDMArgs, reply *struct{}) error {
+	m := args.Msg
+	if m.Data != nil || m.Table != nil {
+		return errors.New("private messages are text only")
+	}
+	if err := c.checkLength(m.Text); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	if !c.isAdmin(args.Token) && !slices.Contains(c.holdersLocked(args.Role), m.Sender) {
+		c.mu.Unlock()
+		return fmt.Errorf("only admins and holders of role %s may message it", args.Role)
+	}
+	to := slices.DeleteFunc(c.holdersLocked(args.Role), func(id string) bool { return id == m.Sender })
+	if len(to) == 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("no one else online holds role %s", args.Role)
+	}
+	delay, err := c.allowSendLocked(m.Sender)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if delay > 0 {
+		c.mu.Unlock()
+		time.Sleep(delay)
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return errShuttingDown
+		}
+	}
+	if cl, ok := c.clients[m.Sender]; ok {
+		cl.lastActive = time.Now()
+		cl.sent++
+	}
+	c.sentTotal++
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	m.Kind = "private"
+	m.Text = fmt.Sprintf("%s -> @%s (private, %d online): %s", m.Sender, args.Role, len(to), m.Text)
+	c.enqueue(broadcastMsg{MessageArgs: m, group: to})
+	return nil
+}
+
+// Rename: change args.ID's name to args.NewID and tell the room. The client
+// is replaced by a copy under the new name, since a client's id never changes
+// once it is shared with the broadcaster and delivery workers; the copy keeps
+// the connection, room, rate limit and anything still queued.
+func (c *ChatServer) Rename(args protocol.RenameArgs, reply *struct{}) error {
+	if strings.TrimSpace(args.NewID) == "" {
+		return errors.New("empty name")
+	}
+	if args.NewID == args.ID {
+		return nil
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	cl, ok := c.clients[args.ID]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is not registered", args.ID)
+	}
+	if _, taken := c.clients[args.NewID]; taken {
+		c.mu.Unlock()
+		return fmt.Errorf("nickname %s already in use", args.NewID)
+	}
+	if other := c.similarNameLocked(args.NewID, args.ID); other != "" {
+		switch c.nameSimilarity {
+		case "warn":
+			log.Printf("%s renamed to %s, a name confusable with %s", args.ID, args.NewID, other)
+		case "reject":
+			c.mu.Unlock()
+			return fmt.Errorf("name %q is too similar to %q, who is already connected", args.NewID, other)
+		}
+	}
+	renamed := &client{id: args.NewID, addr: cl.addr, nonce: cl.nonce, conn: cl.conn, joined: cl.joined, epoch: cl.epoch,
+		room: cl.room, extra: slices.Clone(cl.extra), lastActive: cl.lastActive, admin: cl.admin, sent: cl.sent, tokens: cl.tokens, refilled: cl.refilled, flood: cl.flood}
+	c.dropLocked(cl)
+	c.clients[renamed.id] = renamed
+	for _, r := range renamed.rooms() {
+		c.roomLocked(r).members[renamed.id] = renamed
+	}
+	c.delivery.migrate(cl, renamed)
+	for _, ids := range c.roles {
+		if ids[args.ID] {
+			delete(ids, args.ID)
+			ids[args.NewID] = true
+		}
+	}
+	text := fmt.Sprintf("%s is now known as %s", args.ID, args.NewID)
+	seq := c.appendLocked(Message{Text: text, Room: renamed.room}).Seq
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	log.Printf("%s renamed to %s", args.ID, args.NewID)
+	c.publishNotice(protocol.MessageArgs{Sender: args.NewID, Text: text, Kind: "rename", Seq: seq, Room: renamed.room})
+	c.pushUsers()
+	return nil
+}
+
+// Echo calls back args.ID's listener directly with a "selftest" message carrying
+// args.Token, so a client can check the callback path. The error, if any, is the
+// one the callback hit; unlike a failed delivery it does not remove the client.
+func (c *ChatServer) Echo(args protocol.EchoArgs, reply *struct{}) error {
+	c.mu.Lock()
+	cl, ok := c.clients[args.ID]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not registered", args.ID)
+	}
+	m := protocol.MessageArgs{Sender: "server", Text: args.Token, Kind: "selftest"}
+	if err := c.receive(cl, m); err != nil {
+		return fmt.Errorf("callback to %s failed: %v", cl.addr, err)
+	}
+	return nil
+}
+
+// ForgetMe: remove every message args.ID sent from history and tell everyone,
+// peers included
+func (c *ChatServer) ForgetMe(args protocol.ForgetArgs, reply *protocol.ForgetReply) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	reply.Removed = c.forgetLocked(args.ID, 0)
+	if reply.Removed == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	c.publishForget(protocol.MessageArgs{Sender: args.ID, Text: fmt.Sprintf("User %s's messages were removed from history (%d)", args.ID, reply.Removed)}, 0)
+	return c.syncRemoval(reply.Removed)
+}
+
+// DeleteMine: remove the args.Count newest messages args.Sender sent, across
+// every room, in one step and tell everyone how many went, peers included.
+func (c *ChatServer) DeleteMine(args protocol.DeleteMineArgs, reply *protocol.ForgetReply) error {
+	if args.Count <= 0 {
+		return fmt.Errorf("count must be positive, got %d", args.Count)
+	}
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errShuttingDown
+	}
+	reply.Removed = c.forgetLocked(args.Sender, args.Count)
+	if reply.Removed == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	c.publishForget(protocol.MessageArgs{Sender: args.Sender, Text: fmt.Sprintf("User %s deleted their last %d messages", args.Sender, reply.Removed)}, reply.Removed)
+	return c.syncRemoval(reply.Removed)
+}
+
+// syncRemoval waits for the history store to drop the n entries just removed,
+// and reports if it could not: they are gone from memory and from what
+// clients are shown, but stay in -store until a later rewrite works.
+func (c *ChatServer) syncRemoval(n int) error {
+	if err := c.history.Sync(); err != nil {
+		return fmt.Errorf("removed %d messages, but the history file still holds them: %v", n, err)
+	}
+	return nil
+}
+
+// forgetLocked removes the count newest history entries sender sent, across
+// every room (0 = all of them), and returns how many went. c.mu must be held.
+func (c *ChatServer) forgetLocked(sender string, count int) int {
+	var theirs []Message
+	for _, room := range c.history.Rooms() {
+		for _, m := range c.history.All(room) {
+			if m.Sender == sender {
+				theirs = append(theirs, m)
+			}
+		}
+	}
+	sortByTime(theirs)
+	if count > 0 && len(theirs) > count {
+		theirs = theirs[len(theirs)-count:]
+	}
+	type entry struct {
+		room string
+		seq  uint64
+	}
+	doomed := make(map[entry]bool, len(theirs))
+	for _, m := range theirs {
+		doomed[entry{m.Room, m.Seq}] = true
+	}
+	removed := 0
+	for _, room := range c.history.Rooms() {
+		msgs := c.history.All(room)
+		kept := make([]Message, 0, len(msgs)) // new slice: ones All handed out may still be read
+		for _, m := range msgs {
+			if m.Sender == sender && doomed[entry{m.Room, m.Seq}] {
+				continue
+			}
+			kept = append(kept, m)
+		}
+		if n := len(msgs) - len(kept); n > 0 {
+			c.history.Replace(room, kept)
+			removed += n
+		}
+	}
+	return removed
+}
+
+// session is the RPC receiver for one client connection. Each connection gets
+// its own rpc.Server with a session registered as "ChatServer", so calls can be
+// checked against the identity that registered on that same connection.
+type session struct {
+	c      *ChatServer
+	remote string // the connection's remote address
+	mu     sync.Mutex
+	id     string // set by a successful Register
+	epoch  uint64 // of that registration
+	peer   bool   // set by a successful Peer
+	secure bool   // the connection is TLS, from the start or after StartTLS
+
+	upgrade *startTLSConn // the plain connection StartTLS switches; nil = not offered
+}
+
+// serveConn serves one connection with its own session. Under -starttls the
+// connection starts plain; after a StartTLS the RPC stream ends, the TLS
+// handshake runs on the same connection, and a fresh stream is served over it.
+func (c *ChatServer) serveConn(conn net.Conn) {
+	sess := &session{c: c, remote: conn.RemoteAddr().String(), secure: c.tlsConfig != nil && c.startTLS == ""}
+	if c.startTLS != "" {
+		sess.upgrade = &startTLSConn{Conn: conn}
+		conn = sess.upgrade
+	}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("ChatServer", sess); err != nil {
+		log.Printf("rpc register: %v", err)
+		conn.Close()
+		return
+	}
+	srv.ServeConn(conn)
+	if sess.upgrade == nil || !sess.upgrade.switched() {
+		return
+	}
+
+	tc := tls.Server(&prefixConn{Conn: sess.upgrade.Conn, head: sess.upgrade.head}, c.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second) // don't wait forever on a stalled handshake
+	err := tc.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("starttls %s: %v", sess.remote, err)
+		sess.upgrade.Conn.Close()
+		return
+	}
+	sess.mu.Lock()
+	sess.secure = true
+	sess.upgrade = nil // one upgrade per connection
+	sess.mu.Unlock()
+	srv.ServeConn(tc)
+}
+
+func (s *session) identity() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// actor names the caller in the audit log.
+func (s *session) actor() string {
+	if id := s.identity(); id != "" {
+		return id
+	}
+	return s.remote
+}
+
+// checkTLS refuses a call on a plain connection when -starttls is require.
+// Calls that need a registration are covered by Register's check.
+func (s *session) checkTLS() error {
+	if s.c.startTLS != "require" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.secure {
+		return errors.New("this server requires TLS: connect with -starttls")
+	}
+	return nil
+}
+
+// checkRegistered refuses a call on a connection that has not registered, so
+// that history and the user list are only read by someone in the chat.
+func (s *session) checkRegistered() error {
+	if s.identity() == "" {
+		return errors.New("not registered")
+	}
+	return nil
+}
+
+// checkSender rejects calls made on behalf of an ID other than the one this
+// connection registered as, and calls from a connection that a newer
+// registration of that ID has replaced.
+func (s *session) checkSender(sender string) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	id, epoch := s.id, s.epoch
+	s.mu.Unlock()
+	if sender != id {
+		return fmt.Errorf("sender %q does not match registered identity %q", sender, id)
+	}
+	s.c.mu.Lock()
+	cl, ok := s.c.clients[id]
+	s.c.mu.Unlock()
+	if ok && cl.epoch != epoch {
+		return fmt.Errorf("%s has registered again on another connection", id)
+	}
+	return nil
+}
+
+// StartTLS: switch this plain connection to TLS. The reply is the last thing
+// sent in plain text; the client's next bytes start the handshake.
+func (s *session) StartTLS(args struct{}, reply *struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upgrade == nil {
+		return errors.New("StartTLS is not offered on this connection")
+	}
+	if s.id != "" || s.peer {
+		return errors.New("StartTLS must come before Register or Peer")
+	}
+	return s.upgrade.begin()
+}
+
+func (s *session) Register(args protocol.RegisterArgs, reply *struct{}) error {
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+	epoch, err := s.c.register(args)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.id = args.ID
+	s.epoch = epoch
+	s.mu.Unlock()
+	s.c.greet(args.ID)
+	return nil
+}
+
+func (s *session) Rename(args protocol.RenameArgs, reply *struct{}) error {
+	if err := s.checkSender(args.ID); err != nil {
+		return err
+	}
+	if err := s.c.Rename(args, reply); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.id = args.NewID
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *session) Unregister(args protocol.RegisterArgs, reply *struct{}) error {
+	if err := s.checkSender(args.ID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	epoch := s.epoch
+	s.mu.Unlock()
+	s.c.unregister(args.ID, epoch)
+	return nil
+}
+
+func (s *session) Send(args protocol.MessageArgs, reply *protocol.HistoryReply) error {
+	if err := s.checkSender(args.Sender); err != nil {
+		return err
+	}
+	return s.c.Send(args, reply)
+}
+
+func (s *session) SendAck(args protocol.MessageArgs, reply *protocol.SendAck) error {
+	if err := s.checkSender(args.Sender); err != nil {
+		return err
+	}
+	return s.c.SendAck(args, reply)
+}
+
+func (s *session) Hello(args struct{}, reply *protocol.HelloReply) error {
+	return s.c.Hello(args, reply)
+}
+
+func (s *session) Stats(args struct{}, reply *protocol.StatsReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.Stats(args, reply)
+}
+
+func (s *session) GetConfig(args struct{}, reply *protocol.ConfigReply) error {
+	return s.c.GetConfig(args, reply)
+}
+
+// HistorySince: return the entries of the caller's room after args.Seq, for a
+// client catching up after a reconnect
+func (s *session) HistorySince(args protocol.SinceArgs, reply *protocol.HistoryReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.roomHistory(s.c.roomOf(s.identity()), args.Seq, reply)
+}
+
+func (s *session) Join(args protocol.JoinArgs, reply *protocol.HistoryReply) error {
+	if err := s.checkSender(args.ID); err != nil {
+		return err
+	}
+	return s.c.Join(args, reply)
+}
+
+func (s *session) Part(args protocol.JoinArgs, reply *struct{}) error {
+	if err := s.checkSender(args.ID); err != nil {
+		return err
+	}
+	return s.c.Part(args, reply)
+}
+
+func (s *session) PostAnnouncement(args protocol.AnnouncementArgs, reply *struct{}) error {
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+	if err := s.c.PostAnnouncement(args, reply); err != nil {
+		return err
+	}
+	detail := args.Text
+	if args.TTL > 0 {
+		detail += fmt.Sprintf(" (for %s)", args.TTL)
+	}
+	s.c.audit.record(s.actor(), "announce", "", detail)
+	return nil
+}
+
+func (s *session) Announcements(args struct{}, reply *protocol.AnnouncementsReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.Announcements(args, reply)
+}
+
+func (s *session) ListUsers(args struct{}, reply *protocol.ListUsersReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.ListUsers(args, reply)
+}
+
+func (s *session) RecentlyLeft(args struct{}, reply *protocol.RecentLeftReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.RecentlyLeft(args, reply)
+}
+
+func (s *session) Inspect(args protocol.InspectArgs, reply *protocol.InspectReply) error {
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+	if err := s.c.Inspect(args, reply); err != nil {
+		return err
+	}
+	s.c.audit.record(s.actor(), "inspect", args.Target, "")
+	return nil
+}
+
+func (s *session) AuditLog(args protocol.AdminArgs, reply *protocol.AuditReply) error {
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+	return s.c.AuditLog(args, reply)
+}
+
+func (s *session) SendPrivate(args protocol.PrivateArgs, reply *struct{}) error {
+	if err := s.checkSender(args.Msg.Sender); err != nil {
+		return err
+	}
+	return s.c.SendPrivate(args, reply)
+}
+
+func (s *session) RoleDM(args protocol.RoleDMArgs, reply *struct{}) error {
+	if err := s.checkSender(args.Msg.Sender); err != nil {
+		return err
+	}
+	return s.c.RoleDM(args, reply)
+}
+
+func (s *session) SetRole(args protocol.RoleArgs, reply *struct{}) error {
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+	if err := s.c.SetRole(args, reply); err != nil {
+		return err
+	}
+	action := "setrole"
+	if args.Remove {
+		action = "removerole"
+	}
+	s.c.audit.record(s.actor(), action, args.Target, args.Role)
+	return nil
+}
+
+func (s *session) Roles(args struct{}, reply *protocol.RolesReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.Roles(args, reply)
+}
+
+func (s *session) Echo(args protocol.EchoArgs, reply *struct{}) error {
+	if err := s.checkSender(args.ID); err != nil {
+		return err
+	}
+	return s.c.Echo(args, reply)
+}
+
+func (s *session) ForgetMe(args protocol.ForgetArgs, reply *protocol.ForgetReply) error {
+	if err := s.checkSender(args.ID); err != nil {
+		return err
+	}
+	if err := s.c.ForgetMe(args, reply); err != nil {
+		return err
+	}
+	s.c.audit.record(s.actor(), "forgetme", args.ID, fmt.Sprintf("%d messages removed", reply.Removed))
+	return nil
+}
+
+func (s *session) DeleteMine(args protocol.DeleteMineArgs, reply *protocol.ForgetReply) error {
+	if err := s.checkSender(args.Sender); err != nil {
+		return err
+	}
+	if err := s.c.DeleteMine(args, reply); err != nil {
+		return err
+	}
+	s.c.audit.record(s.actor(), "deletemine", args.Sender, fmt.Sprintf("%d messages removed", reply.Removed))
+	return nil
+}
+
+func (s *session) Peer(args PeerArgs, reply *struct{}) error {
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+	if err := s.c.Peer(args, reply); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.peer = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *session) Relay(args RelayArgs, reply *struct{}) error {
+	s.mu.Lock()
+	peer := s.peer
+	s.mu.Unlock()
+	if !peer {
+		return errors.New("not a peer")
+	}
+	return s.c.Relay(args, reply)
+}
+
+// History: return the full history of the caller's room
+func (s *session) History(args struct{}, reply *protocol.HistoryReply) error {
+	if err := s.checkRegistered(); err != nil {
+		return err
+	}
+	return s.c.roomHistory(s.c.roomOf(s.identity()), 0, reply)
+}
+
+// RelayArgs carries a message from the server it was sent on to a peer server.
+type RelayArgs struct {
+	Msg    protocol.MessageArgs
+	System bool // join/leave style notice rather than a chat message
+	// Forget asks the peer to remove Msg.Sender's newest Count history entries
+	// (0 = all) rather than store Msg; Msg is the notice to show. Entries are
+	// matched by sender, since sequence numbers differ between servers.
+	Forget bool
+	Count  int
+}
+
+type PeerArgs struct {
+	Token string
+}
+
+// peerLink forwards locally originated messages to one peer server. It
+// dials lazily and redials after errors, so peers can start in any order.
+type peerLink struct {
+	addr  string
+	token string
+	tls   *tls.Config // dial the peer with TLS; nil = plain TCP
+	start bool        // reach TLS through StartTLS on a plain connection
+	queue chan RelayArgs
+	conn  *rpc.Client // owned by run
+}
+
+func newPeerLink(addr, token string, tlsConfig *tls.Config, startTLS bool) *peerLink {
+	p := &peerLink{addr: addr, token: token, tls: tlsConfig, start: startTLS, queue: make(chan RelayArgs, 100)}
+	go p.run()
+	return p
+}
+
+// forward queues r without blocking the broadcaster; if the peer is too far
+// behind the message is dropped for that peer.
+func (p *peerLink) forward(r RelayArgs) {
+	select {
+	case p.queue <- r:
+	default:
+		log.Printf("peer %s: relay queue full, dropping message from %s", p.addr, r.Msg.Sender)
+	}
+}
+
+func (p *peerLink) run() {
+	for r := range p.queue {
+		// one redial per message; if the peer is still down the message is dropped
+		for attempt := 0; attempt < 2; attempt++ {
+			if err := p.relay(r); err != nil {
+				log.Printf("peer %s: %v", p.addr, err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (p *peerLink) relay(r RelayArgs) error {
+	if p.conn == nil {
+		var conn *rpc.Client
+		if p.tls != nil {
+			dial := tls.Dial
+			if p.start {
+				dial = protocol.DialStartTLS
+			}
+			nc, err := dial("tcp", p.addr, p.tls)
+			if err != nil {
+				return err
+			}
+			conn = rpc.NewClient(nc)
+		} else {
+			var err error
+			if conn, err = rpc.Dial("tcp", p.addr); err != nil {
+				return err
+			}
+		}
+		if err := conn.Call("ChatServer.Peer", PeerArgs{Token: p.token}, &struct{}{}); err != nil {
+			conn.Close()
+			return err
+		}
+		p.conn = conn
+	}
+	if err := p.conn.Call("ChatServer.Relay", r, &struct{}{}); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// startTLSConn is a client connection on a -starttls port. Once StartTLS has
+// answered, the first bytes read are the client's TLS handshake: they are kept
+// in head and the RPC stream sees EOF, so serveConn can take over.
+type startTLSConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	pending bool   // StartTLS answered; the next bytes are TLS
+	head    []byte // those bytes, once read
+}
+
+func (u *startTLSConn) begin() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending {
+		return errors.New("StartTLS already in progress")
+	}
+	u.pending = true
+	return nil
+}
+
+func (u *startTLSConn) switched() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.head != nil
+}
+
+func (u *startTLSConn) Read(p []byte) (int, error) {
+	if u.switched() {
+		return 0, io.EOF
+	}
+	n, err := u.Conn.Read(p)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending && n > 0 {
+		u.head = append([]byte(nil), p[:n]...)
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// Close leaves the connection open when the RPC stream ends for the switch.
+func (u *startTLSConn) Close() error {
+	if u.switched() {
+		return nil
+	}
+	return u.Conn.Close()
+}
+
+// prefixConn returns head before reading on from Conn.
+type prefixConn struct {
+	net.Conn
+	head []byte
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) {
+	if len(p.head) > 0 {
+		n := copy(b, p.head)
+		p.head = p.head[n:]
+		return n, nil
+	}
+	return p.Conn.Read(b)
+}
+
+// quotaConn counts the bytes read from and written to a client connection and
+// closes it once the total within the current window exceeds quota. This
+// bounds bandwidth per connection, however few or many messages it carries.
+type quotaConn struct {
+	net.Conn
+	quota  int64
+	window time.Duration
+
+	mu    sync.Mutex
+	start time.Time // start of the current window
+	used  int64     // bytes transferred in the current window
+	over  bool      // quota exceeded; the connection has been closed
+}
+
+var errByteQuota = errors.New("connection byte quota exceeded")
+
+func (q *quotaConn) Read(p []byte) (int, error) {
+	n, err := q.Conn.Read(p)
+	if qerr := q.count(n); qerr != nil {
+		return n, qerr
+	}
+	return n, err
+}
+
+func (q *quotaConn) Write(p []byte) (int, error) {
+	if err := q.count(len(p)); err != nil {
+		return 0, err
+	}
+	return q.Conn.Write(p)
+}
+
+// count adds n bytes to the current window and drops the connection when the
+// quota is exceeded.
+func (q *quotaConn) count(n int) error {
+	q.mu.Lock()
+	now := time.Now()
+	if now.Sub(q.start) >= q.window {
+		q.start, q.used = now, 0
+	}
+	q.used += int64(n)
+	if q.over || q.used <= q.quota {
+		defer q.mu.Unlock()
+		if q.over {
+			return errByteQuota
+		}
+		return nil
+	}
+	q.over = true
+	used := q.used
+	q.mu.Unlock()
+	log.Printf("closing connection from %s: %d bytes in %v exceeds quota of %d", q.RemoteAddr(), used, q.window, q.quota)
+	q.Conn.Close()
+	return errByteQuota
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:1234", "server listen address")
+	drainTimeout := flag.Duration("drain", 5*time.Second, "on shutdown, how long to wait for in-flight deliveries")
+	maxBlob := flag.Int("maxblob", 64<<10, "largest binary payload accepted in a message, in bytes")
+	adminToken := flag.String("admintoken", "", "token required by admin RPCs such as Inspect (empty = admin RPCs disabled)")
+	announceJoins := flag.String("announcejoins", "on", "on: announce joins/leaves in chat; off: only log them")
+	maxRooms := flag.Int("maxrooms", 0, "most rooms at once, the default room included (0 = no limit)")
+	roomCreate := flag.String("roomcreate", "open", "who may create a room by joining it: open (anyone) or admin (only with -admintoken)")
+	everyone := flag.String("everyone", "admin", "who may mention @everyone: admin (registered with -admintoken) or anyone")
+	idleAfter := flag.Duration("idleafter", 10*time.Minute, "@here skips members who haven't sent anything for this long")
+	emptyRoom := flag.String("emptyroom", "retain", "when the last client leaves: retain or clear the history")
+	onPersistError := flag.String("onpersisterror", "warn", "when saving a message to -store fails: warn (log it and alert the admins online) or fail (also tell the sender); the message is delivered either way")
+	macros := flag.Bool("macros", false, "expand server macros (!uptime, !users) in sent messages")
+	leaveGrace := flag.Duration("leavegrace", 0, "hold back leave broadcasts this long so quick reconnects don't announce leave/join (0 = immediate)")
+	byteQuota := flag.Int64("bytequota", 0, "disconnect a connection that transfers more than this many bytes per -bytewindow (0 = no limit)")
+	byteWindow := flag.Duration("bytewindow", time.Minute, "window for -bytequota")
+	slowStart := flag.Duration("slowstart", 0, "pace deliveries to newly joined clients for this long (0 = off)")
+	slowStartGap := flag.Duration("slowstartgap", 200*time.Millisecond, "pause between deliveries right after a client joins, shrinking to 0 over -slowstart")
+	peers := flag.String("peer", "", "comma-separated addresses of peer servers to relay messages to (configure both sides)")
+	authToken := flag.String("token", "", "shared secret clients must present to register (empty = anyone may join)")
+	peerToken := flag.String("peertoken", "", "shared token peers present to each other; required for peering")
+	tlsCert := flag.String("tlscert", "", "TLS certificate file; with -tlskey, serve, call back and peer over TLS (empty = plain TCP)")
+	tlsKey := flag.String("tlskey", "", "TLS private key file for -tlscert")
+	tlsCA := flag.String("tlsca", "", "CA file that peers' certificates must chain to (empty = system roots)")
+	startTLS := flag.String("starttls", "off", "with -tlscert: off (the port is TLS only), allow (plain port, clients may upgrade with StartTLS) or require (plain port, upgrade before anything else)")
+	mode := flag.String("delivery", "fast", "broadcast delivery: fast (concurrent, unordered) or ordered (per-client sequential)")
+	workers := flag.Int("workers", defaultWorkers, "with -delivery fast: how many client calls the delivery pool makes at once")
+	deliverTimeout := flag.Duration("delivertimeout", 5*time.Second, "drop a client that takes longer than this to accept a message (0 = wait forever)")
+	enqueueWait := flag.Duration("enqueuewait", time.Second, "when the broadcast queue is full, wait this long for room before dropping a broadcast (0 = drop at once)")
+	pressureAt := flag.Float64("backpressure", 0.75, "broadcast queue fill (0-1) at which send acknowledgements ask clients to pause before sending more (0 = never)")
+	dialTimeout := flag.Duration("dialtimeout", 3*time.Second, "how long Register may take to dial back a client before failing (0 = no limit)")
+	timeFormat := flag.String("timeformat", "15:04:05", "Go time layout for history timestamps (empty = no timestamps)")
+	nameSimilarity := flag.String("namesimilarity", "off", "names confusable with a connected user (homoglyphs, one typo): off, warn (log) or reject")
+	maxHistory := flag.Int("history", 1000, "most history entries to keep; older ones are dropped (0 = unlimited)")
+	storePath := flag.String("store", "", "file to save history in and reload it from on startup (empty = memory only)")
+	migrate := flag.String("migratehistory", "", "`OLD` history file to convert for -store: -migratehistory OLD NEW writes NEW and exits without serving")
+	retention := flag.Duration("retention", 0, "drop history entries older than this when compacting (0 = keep them)")
+	compactEvery := flag.Duration("compactevery", time.Hour, "how often to compact history: apply -retention and rewrite -store without entries it no longer holds (0 = never)")
+	compactIdle := flag.Duration("compactidle", 5*time.Minute, "skip a scheduled compaction if a message was sent within this long")
+	compactAfter := flag.Int("compactafter", 1000, "also rewrite -store once this many entries in it have been trimmed by -history (0 = only on schedule)")
+	regLimit := flag.Int("reglimit", 5, "registrations one ID may make per -regwindow before further ones are refused (0 = no limit)")
+	regWindow := flag.Duration("regwindow", time.Minute, "window for -reglimit")
+	auditPath := flag.String("auditlog", "", "file to append the audit log of admin actions to (empty = memory only)")
+	sendRate := flag.Float64("sendrate", 10, "messages per second each sender may keep up (0 = unlimited)")
+	sendBurst := flag.Float64("sendburst", 20, "messages a sender may send in a burst before -sendrate applies")
+	sendGrace := flag.Float64("sendgrace", 0, "messages past -sendburst that are delayed (see -gracedelay) instead of refused")
+	graceDelay := flag.Duration("gracedelay", 100*time.Millisecond, "delay for the first message past -sendburst, and how much longer each one after it waits")
+	graceDelayMax := flag.Duration("gracedelaymax", time.Second, "longest delay for a message in the -sendgrace allowance")
+	floodPenalties := flag.String("floodpenalties", "warn,10s,1m,mute=10m", "response to a sender's 1st, 2nd, ... rate limit offense: warn, a cooldown, or mute=DURATION; the last step repeats (off = just refuse)")
+	offenseDecay := flag.Duration("offensedecay", 5*time.Minute, "forgive one rate limit offense per this long without another (0 = never)")
+	maxLen := flag.Int("maxlen", 1024, "longest message accepted, in characters (0 = no limit)")
+	logFormat := flag.String("logformat", "text", "log output: text or json (one structured line per event, for log aggregators)")
+	flag.Parse()
+
+	if *migrate != "" {
+		if flag.NArg() != 1 {
+			log.Fatalf("usage: -migratehistory OLD NEW")
+		}
+		n, format, err := migrateHistory(*migrate, flag.Arg(0))
+		if err != nil {
+			log.Fatalf("migrate history: %v", err)
+		}
+		fmt.Printf("migrated %d records from %s (%s format) to %s\n", n, *migrate, format, flag.Arg(0))
+		return
+	}
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+		slog.SetDefault(jsonLog) // the remaining log.Printf lines come out as JSON too
+	default:
+		log.Fatalf("unknown -logformat %q (want text or json)", *logFormat)
+	}
+
+	server := NewChatServer()
+	server.leaveGrace = *leaveGrace
+	server.macros = *macros
+	server.adminToken = *adminToken
+	server.authToken = *authToken
+	server.peerToken = *peerToken
+	if *tlsCert != "" || *tlsKey != "" {
+		cfg, err := loadTLS(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+		server.tlsConfig = cfg
+	}
+	switch *startTLS {
+	case "off":
+	case "allow", "require":
+		if server.tlsConfig == nil {
+			log.Fatalf("-starttls %s needs -tlscert and -tlskey", *startTLS)
+		}
+		server.startTLS = *startTLS
+	default:
+		log.Fatalf("unknown -starttls %q (want off, allow or require)", *startTLS)
+	}
+	if *peers != "" {
+		if *peerToken == "" {
+			log.Fatalf("-peer needs -peertoken")
+		}
+		for _, p := range strings.Split(*peers, ",") {
+			server.peers = append(server.peers, newPeerLink(strings.TrimSpace(p), *peerToken, server.tlsConfig, server.startTLS != ""))
+		}
+	}
+	switch *announceJoins {
+	case "on":
+	case "off":
+		server.silentJoins = true
+	default:
+		log.Fatalf("unknown -announcejoins %q (want on or off)", *announceJoins)
+	}
+	server.maxRooms = *maxRooms
+	switch *roomCreate {
+	case "open":
+	case "admin":
+		if *adminToken == "" {
+			log.Fatalf("-roomcreate admin needs -admintoken, or no one could create a room")
+		}
+	default:
+		log.Fatalf("unknown -roomcreate %q (want open or admin)", *roomCreate)
+	}
+	server.roomCreate = *roomCreate
+	switch *everyone {
+	case "admin", "anyone":
+		server.everyone = *everyone
+	default:
+		log.Fatalf("unknown -everyone %q (want admin or anyone)", *everyone)
+	}
+	server.idleAfter = *idleAfter
+	switch *emptyRoom {
+	case "retain":
+	case "clear":
+		server.clearWhenEmpty = true
+	default:
+		log.Fatalf("unknown -emptyroom %q (want retain or clear)", *emptyRoom)
+	}
+	if *onPersistError != "warn" && *onPersistError != "fail" {
+		log.Fatalf("unknown -onpersisterror %q (want warn or fail)", *onPersistError)
+	}
+	server.onPersistError = *onPersistError
+	switch *nameSimilarity {
+	case "off", "warn", "reject":
+		server.nameSimilarity = *nameSimilarity
+	default:
+		log.Fatalf("unknown -namesimilarity %q (want off, warn or reject)", *nameSimilarity)
+	}
+	server.maxBlob = *maxBlob
+	server.maxLen = *maxLen
+	server.maxHistory = *maxHistory
+	server.history = newMemoryStore(*maxHistory)
+	if *sendRate > 0 && *sendBurst < 1 {
+		log.Fatalf("-sendburst must be at least 1")
+	}
+	server.sendRate = *sendRate
+	server.sendBurst = *sendBurst
+	if *sendGrace < 0 || *graceDelay < 0 || *graceDelayMax < 0 {
+		log.Fatalf("-sendgrace, -gracedelay and -gracedelaymax can't be negative")
+	}
+	server.sendGrace, server.graceDelay, server.graceDelayMax = *sendGrace, *graceDelay, *graceDelayMax
+	penalties, err := parsePenalties(*floodPenalties)
+	if err != nil {
+		log.Fatalf("-floodpenalties: %v", err)
+	}
+	server.penalties = penalties
+	server.offenseDecay = *offenseDecay
+	server.byteQuota = *byteQuota
+	server.byteWindow = *byteWindow
+	if *regLimit > 0 && *regWindow <= 0 {
+		log.Fatalf("-reglimit needs a positive -regwindow")
+	}
+	server.regLimit = *regLimit
+	server.regWindow = *regWindow
+	if *auditPath != "" {
+		a, err := openAuditLog(*auditPath)
+		if err != nil {
+			log.Fatalf("audit log %s: %v", *auditPath, err) // running without one would lose the record
+		}
+		server.audit = a
+	}
+	if *storePath != "" {
+		server.history, server.seqs = openStore(*storePath, *maxHistory)
+		if fs, ok := server.history.(*fileStore); ok {
+			fs.file.notify(server.persistFailed)
+			fs.compactAfter = *compactAfter
+		}
+		for _, r := range server.history.Rooms() {
+			server.roomLocked(r) // rooms with saved history exist again, whatever -roomcreate says
+		}
+	}
+	server.deliverTimeout = *deliverTimeout
+	server.enqueueWait = *enqueueWait
+	if *pressureAt < 0 || *pressureAt > 1 {
+		log.Fatalf("-backpressure must be between 0 and 1")
+	}
+	server.pressureAt = *pressureAt
+	server.dialTimeout = *dialTimeout
+	server.timeFormat = *timeFormat
+	switch *mode {
+	case "fast":
+		if *workers < 1 {
+			log.Fatalf("-workers must be at least 1")
+		}
+		server.delivery = newFastDelivery(server, *workers)
+	case "ordered":
+		server.delivery = newOrderedDelivery(server)
+	default:
+		log.Fatalf("unknown -delivery %q (want fast or ordered)", *mode)
+	}
+	server.slowStart = *slowStart
+	server.slowStartGap = *slowStartGap
+	server.retention = *retention
+	if *compactEvery > 0 {
+		go server.compactEvery(*compactEvery, *compactIdle)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("listen %s: %v", *addr, err)
+	}
+	if server.tlsConfig != nil && server.startTLS == "" {
+		ln = tls.NewListener(ln, server.tlsConfig)
+	}
+	defer ln.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		ln.Close() // stop accepting; the loop below exits
+	}()
+
+	logEvent(slog.LevelInfo, "server_started", fmt.Sprintf("Chat server %s listening on %s", Version, *addr), "addr", *addr, "version", Version)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if err != nil {
+			log.Printf("accept error: %v", err)
+			continue
+		}
+		if server.byteQuota > 0 {
+			conn = &quotaConn{Conn: conn, quota: server.byteQuota, window: server.byteWindow, start: time.Now()}
+		}
+		go server.serveConn(conn)
+	}
+	logEvent(slog.LevelInfo, "server_stopping", fmt.Sprintf("shutting down, waiting up to %v for deliveries", *drainTimeout), "drain_timeout", drainTimeout.String())
+	if err := server.shutdown(*drainTimeout); err != nil {
+		logEvent(slog.LevelWarn, "server_stopped", fmt.Sprintf("shutdown: %v", err), "error", err.Error())
+		return
+	}
+	logEvent(slog.LevelInfo, "server_stopped", "")
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Abdoelsabagh10/ds_chat_realtime_assignment/protocol"
+)
+
+func TestCallsOnBehalfOfAnotherIDRefused(t *testing.T) {
+	c := newTestServer(t)
+	addr := listen(t, c)
+	bob := newMockClient(t, "bob")
+	bc := dial(t, addr)
+	if err := bc.Call("ChatServer.Register", bob.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Call("ChatServer.Send", protocol.MessageArgs{Sender: "bob", Text: "bob's own"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := newMockClient(t, "alice")
+	ac := dial(t, addr)
+	if err := ac.Call("ChatServer.Send", protocol.MessageArgs{Sender: "alice", Text: "hi"}, &protocol.HistoryReply{}); err == nil {
+		t.Error("Send before Register: accepted")
+	}
+	if err := ac.Call("ChatServer.Register", alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	refused := map[string]error{
+		"Send":        ac.Call("ChatServer.Send", protocol.MessageArgs{Sender: "bob", Text: "spoofed"}, &protocol.HistoryReply{}),
+		"SendAck":     ac.Call("ChatServer.SendAck", protocol.MessageArgs{Sender: "bob", Text: "spoofed"}, &protocol.SendAck{}),
+		"Unregister":  ac.Call("ChatServer.Unregister", protocol.RegisterArgs{ID: "bob"}, &struct{}{}),
+		"ForgetMe":    ac.Call("ChatServer.ForgetMe", protocol.ForgetArgs{ID: "bob"}, &protocol.ForgetReply{}),
+		"DeleteMine":  ac.Call("ChatServer.DeleteMine", protocol.DeleteMineArgs{Sender: "bob", Count: 1}, &protocol.ForgetReply{}),
+		"Echo":        ac.Call("ChatServer.Echo", protocol.EchoArgs{ID: "bob", Token: "t"}, &struct{}{}),
+		"Join":        ac.Call("ChatServer.Join", protocol.JoinArgs{ID: "bob", Room: "elsewhere"}, &protocol.HistoryReply{}),
+		"Rename":      ac.Call("ChatServer.Rename", protocol.RenameArgs{ID: "bob", NewID: "bobby"}, &struct{}{}),
+		"SendPrivate": ac.Call("ChatServer.SendPrivate", protocol.PrivateArgs{Msg: protocol.MessageArgs{Sender: "bob", Text: "spoofed"}, To: "bob"}, &struct{}{}),
+	}
+	for name, err := range refused {
+		if err == nil {
+			t.Errorf("%s as bob on alice's connection: accepted, want refused", name)
+		}
+	}
+
+	c.mu.Lock()
+	_, online := c.clients["bob"]
+	msgs := formatHistory(c.history.All(defaultRoom), "")
+	c.mu.Unlock()
+	if !online {
+		t.Error("bob was unregistered by alice")
+	}
+	if slices.Contains(msgs, "bob: spoofed") || !slices.Contains(msgs, "bob: bob's own") {
+		t.Errorf("history %q has the spoofed message or lost bob's own", msgs)
+	}
+	if err := ac.Call("ChatServer.Send", protocol.MessageArgs{Sender: "alice", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+		t.Errorf("Send as alice: %v", err)
+	}
+}
+
+func TestHelloReportsVersion(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.2.3-test"
+	c := newTestServer(t)
+	conn := dial(t, listen(t, c))
+	var hello protocol.HelloReply
+	if err := conn.Call("ChatServer.Hello", struct{}{}, &hello); err != nil {
+		t.Fatalf("Hello before Register: %v", err)
+	}
+	if hello.Version != Version {
+		t.Errorf("Hello reported %q, want %q", hello.Version, Version)
+	}
+}
+
+func TestRegisterChecksCallbackNonce(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	args := bob.registerArgs()
+	args.Nonce = "someone-else"
+	if err := c.Register(args, &struct{}{}); err == nil {
+		t.Error("Register with the wrong nonce: accepted")
+	}
+	c.mu.Lock()
+	_, registered := c.clients["bob"]
+	c.mu.Unlock()
+	if registered {
+		t.Error("bob is registered after a nonce mismatch")
+	}
+
+	args.Nonce = ""
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Errorf("Register without a nonce, as older clients do: %v", err)
+	}
+	c.Unregister(args, &struct{}{})
+	bob.register(t, c)
+}
+
+func TestNewestRegistrationWins(t *testing.T) {
+	for mode, newDelivery := range map[string]func(*ChatServer) delivery{
+		"ordered": func(c *ChatServer) delivery { return newOrderedDelivery(c) },
+		"fast":    func(c *ChatServer) delivery { return newFastDelivery(c, 1) }, // one worker, so msg1 and msg2 wait in the pool's queue
+	} {
+		t.Run(mode, func(t *testing.T) {
+			c := newTestServer(t)
+			c.delivery = newDelivery(c)
+			addr := listen(t, c)
+			old := newMockClient(t, "bob")
+			old.delay = 200 * time.Millisecond
+			oc := dial(t, addr)
+			if err := oc.Call("ChatServer.Register", old.registerArgs(), &struct{}{}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: fmt.Sprint("msg", i)}, &protocol.HistoryReply{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// bob comes back on a new connection while msg0 is still being delivered
+			time.Sleep(50 * time.Millisecond)
+			nu := newMockClient(t, "bob")
+			nc := dial(t, addr)
+			if err := nc.Call("ChatServer.Register", nu.registerArgs(), &struct{}{}); err != nil {
+				t.Fatal(err)
+			}
+			got := texts(nu.waitFor(t, 2, chat))
+			slices.Sort(got)
+			if !slices.Equal(got, []string{"alice: msg1", "alice: msg2"}) {
+				t.Errorf("new connection received %q, want the messages still queued for the old one", got)
+			}
+
+			// the replaced connection can no longer act as bob
+			if err := oc.Call("ChatServer.Send", protocol.MessageArgs{Sender: "bob", Text: "stale"}, &protocol.HistoryReply{}); err == nil {
+				t.Error("Send on the replaced connection: accepted")
+			}
+			if err := nc.Call("ChatServer.Send", protocol.MessageArgs{Sender: "bob", Text: "fresh"}, &protocol.HistoryReply{}); err != nil {
+				t.Errorf("Send on the new connection: %v", err)
+			}
+			oc.Call("ChatServer.Unregister", old.registerArgs(), &struct{}{})
+			c.mu.Lock()
+			cl, online := c.clients["bob"]
+			msgs := formatHistory(c.history.All(defaultRoom), "")
+			c.mu.Unlock()
+			if !online || cl.addr != nu.addr {
+				t.Errorf("after the old connection unregistered, bob online %v, want on the new connection", online)
+			}
+			joins := 0
+			for _, m := range msgs {
+				if strings.HasSuffix(m, "User bob joined") {
+					joins++
+				}
+				if strings.HasSuffix(m, "User bob left") {
+					t.Errorf("replacing bob's connection announced a leave: %q", msgs)
+				}
+				if strings.HasSuffix(m, "stale") {
+					t.Errorf("history holds a message sent on the replaced connection: %q", msgs)
+				}
+			}
+			if joins != 1 {
+				t.Errorf("history has %d joins for bob, want 1: %q", joins, msgs)
+			}
+		})
+	}
+}
+
+func TestRegisterGivesUpOnSilentCallback(t *testing.T) {
+	c := newTestServer(t)
+	c.dialTimeout = 200 * time.Millisecond
+	// accepts the dial-back but never answers the nonce check
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start := time.Now()
+	err = c.Register(protocol.RegisterArgs{ID: "bob", Addr: ln.Addr().String(), Nonce: "n"}, &struct{}{})
+	if err == nil {
+		t.Fatal("Register against a callback that never answers: no error")
+	}
+	if d := time.Since(start); d > c.dialTimeout+time.Second {
+		t.Errorf("Register took %v, want about -dialtimeout (%v)", d, c.dialTimeout)
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	c := newTestServer(t)
+	c.nameSimilarity = "reject"
+	for _, id := range []string{"alice", "bob", "charlie"} {
+		newMockClient(t, id).register(t, c)
+	}
+	for id, refused := range map[string]bool{
+		"alicе":   true, // Cyrillic е
+		"a1ice":   true,
+		"ALICE":   true,
+		"charlle": true, // one edit in a long name
+		"rob":     false,
+		"alicia":  false,
+		"dave":    false,
+	} {
+		err := c.Register(newMockClient(t, id).registerArgs(), &struct{}{})
+		if refused && err == nil {
+			t.Errorf("%q: accepted, want refused as a lookalike", id)
+		}
+		if !refused && err != nil {
+			t.Errorf("%q: %v", id, err)
+		}
+	}
+
+	c.nameSimilarity = "warn"
+	if err := c.Register(newMockClient(t, "a1ice").registerArgs(), &struct{}{}); err != nil {
+		t.Errorf("a lookalike with -namesimilarity warn: %v", err)
+	}
+}
+
+func TestDuplicateNicknameRefused(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	bob.register(t, c)
+
+	// the imposter's address is never dialed: the name is checked first
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed := make(chan struct{})
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+			close(dialed)
+		}
+	}()
+	err = c.Register(protocol.RegisterArgs{ID: "bob", Addr: ln.Addr().String(), Nonce: "another-process"}, &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("second bob from another process: %v, want nickname already in use", err)
+	}
+	select {
+	case <-dialed:
+		t.Error("the server dialed back a registration it then refused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.mu.Lock()
+	addr := c.clients["bob"].addr
+	c.mu.Unlock()
+	if addr != bob.addr {
+		t.Error("the refused registration replaced bob")
+	}
+
+	// the same process coming back on a new callback address replaces itself
+	again := newMockClient(t, "bob")
+	if err := c.Register(again.registerArgs(), &struct{}{}); err != nil {
+		t.Fatalf("bob re-registering with the same nonce: %v", err)
+	}
+	c.mu.Lock()
+	addr = c.clients["bob"].addr
+	c.mu.Unlock()
+	if addr != again.addr {
+		t.Error("re-registration with the same nonce did not replace the old connection")
+	}
+}
+
+// selfSigned writes a self-signed certificate for 127.0.0.1 and its key to
+// dir, and returns the certificate with the hex SHA-256 of its DER bytes.
+func selfSigned(t *testing.T, dir string) (cert tls.Certificate, hash, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:]), certFile, keyFile
+}
+
+func TestRegisterOverTLSPinsCallbackCert(t *testing.T) {
+	dir := t.TempDir()
+	_, _, certFile, keyFile := selfSigned(t, dir)
+	c := newTestServer(t)
+	cfg, err := loadTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tlsConfig = cfg
+	if _, err := loadTLS(certFile, keyFile, keyFile); err == nil {
+		t.Error("loadTLS with a CA file holding no certificates: no error")
+	}
+
+	// bob's callback listener serves a throwaway certificate, as the client's does
+	cert, hash, _, _ := selfSigned(t, t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := serveMockClient(t, "bob", tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	args := bob.registerArgs()
+	for name, h := range map[string]string{"no": "", "another certificate's": strings.Repeat("0", len(hash))} {
+		args.CertHash = h
+		if err := c.Register(args, &struct{}{}); err == nil {
+			t.Errorf("Register over TLS with %s hash: accepted", name)
+		}
+	}
+	args.CertHash = hash
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Fatalf("Register over TLS with the callback's hash: %v", err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "over tls"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0].Text; got != "alice: over tls" {
+		t.Errorf("bob received %q over the TLS callback", got)
+	}
+}
+
+// newTLSMockClient is newMockClient with a TLS callback listener, registering
+// the hash of its certificate.
+func newTLSMockClient(t *testing.T, id string) *mockClient {
+	t.Helper()
+	cert, hash, _, _ := selfSigned(t, t.TempDir())
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := serveMockClient(t, id, ln)
+	m.certHash = hash
+	return m
+}
+
+func TestTLSRegisterSendReceive(t *testing.T) {
+	cert, _, certFile, keyFile := selfSigned(t, t.TempDir())
+	c := newTestServer(t)
+	cfg, err := loadTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tlsConfig = cfg
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serveConn(conn)
+		}
+	}()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	connect := func(m *mockClient) *rpc.Client {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc := rpc.NewClient(conn)
+		t.Cleanup(func() { rc.Close() })
+		if err := rc.Call("ChatServer.Register", m.registerArgs(), &struct{}{}); err != nil {
+			t.Fatalf("register %s over TLS: %v", m.id, err)
+		}
+		return rc
+	}
+	bob := newTLSMockClient(t, "bob")
+	connect(bob)
+	ac := connect(newTLSMockClient(t, "alice"))
+	if err := ac.Call("ChatServer.SendAck", protocol.MessageArgs{Sender: "alice", Text: "over tls"}, &protocol.SendAck{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0].Text; got != "alice: over tls" {
+		t.Errorf("bob received %q", got)
+	}
+}
+
+func TestRegisterRateLimit(t *testing.T) {
+	c := newTestServer(t)
+	c.regLimit, c.regWindow = 3, 300*time.Millisecond
+	bob := newMockClient(t, "bob")
+	for i := 0; i < 3; i++ {
+		if err := c.Register(bob.registerArgs(), &struct{}{}); err != nil {
+			t.Fatalf("registration %d of 3: %v", i+1, err)
+		}
+	}
+	err := c.Register(bob.registerArgs(), &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "reconnecting too frequently") {
+		t.Errorf("registration 4 of 3 within -regwindow: %v, want refused", err)
+	}
+	newMockClient(t, "alice").register(t, c) // other IDs have their own allowance
+
+	time.Sleep(c.regWindow)
+	if err := c.Register(bob.registerArgs(), &struct{}{}); err != nil {
+		t.Errorf("registration once the window has passed: %v", err)
+	}
+}
+
+func TestRegisterNeedsToken(t *testing.T) {
+	c := newTestServer(t)
+	bob := newMockClient(t, "bob")
+	args := bob.registerArgs()
+	args.Token = "anything"
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Errorf("with no -token set: %v, want anyone let in", err)
+	}
+	c.Unregister(args, &struct{}{})
+
+	c.authToken = "letmein"
+	for _, token := range []string{"", "guess", "letmein!"} {
+		args.Token = token
+		err := c.Register(args, &struct{}{})
+		if err == nil || err.Error() != "authentication failed" {
+			t.Errorf("token %q: %v, want authentication failed", token, err)
+		}
+	}
+	c.mu.Lock()
+	_, registered := c.clients["bob"]
+	c.mu.Unlock()
+	if registered {
+		t.Error("bob is registered after failing authentication")
+	}
+	args.Token = "letmein"
+	if err := c.Register(args, &struct{}{}); err != nil {
+		t.Errorf("the right token: %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	c := newTestServer(t)
+	alice := newMockClient(t, "alice")
+	alice.register(t, c)
+	bob := newMockClient(t, "bob")
+	conn := dial(t, listen(t, c))
+	if err := conn.Call("ChatServer.Register", bob.registerArgs(), &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, newID := range []string{"", " ", "alice"} {
+		if err := conn.Call("ChatServer.Rename", protocol.RenameArgs{ID: "bob", NewID: newID}, &struct{}{}); err == nil {
+			t.Errorf("rename to %q: accepted", newID)
+		}
+	}
+	if err := conn.Call("ChatServer.Rename", protocol.RenameArgs{ID: "bob", NewID: "robert"}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	rename := func(m protocol.MessageArgs) bool { return m.Kind == "rename" }
+	if got := alice.waitFor(t, 1, rename)[0]; got.Text != "bob is now known as robert" || got.Sender != "robert" {
+		t.Errorf("alice saw %+v, want the rename announced", got)
+	}
+	c.mu.Lock()
+	_, old := c.clients["bob"]
+	cl, renamed := c.clients["robert"]
+	member := c.rooms[defaultRoom].members["robert"] == cl
+	c.mu.Unlock()
+	if old || !renamed || !member {
+		t.Errorf("after the rename: bob online %v, robert online %v and in the room %v", old, renamed, member)
+	}
+
+	// the same connection now speaks and is called back as robert
+	if err := conn.Call("ChatServer.Send", protocol.MessageArgs{Sender: "bob", Text: "still bob?"}, &protocol.HistoryReply{}); err == nil {
+		t.Error("Send under the old name after renaming: accepted")
+	}
+	if err := conn.Call("ChatServer.Send", protocol.MessageArgs{Sender: "robert", Text: "hi"}, &protocol.HistoryReply{}); err != nil {
+		t.Errorf("Send under the new name: %v", err)
+	}
+	if got := alice.waitFor(t, 1, chat)[0].Text; got != "robert: hi" {
+		t.Errorf("alice received %q", got)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "alice", Text: "welcome robert"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0].Text; got != "alice: welcome robert" {
+		t.Errorf("the renamed client received %q", got)
+	}
+}
+
+// stallConn is a connection whose Close blocks until release is closed, like
+// one to a peer that has stopped answering.
+type stallConn struct {
+	net.Conn
+	closing, release chan struct{}
+}
+
+func (s *stallConn) Close() error {
+	close(s.closing)
+	<-s.release
+	return s.Conn.Close()
+}
+
+func TestSlowCloseDoesNotHoldLock(t *testing.T) {
+	c := newTestServer(t)
+	newMockClient(t, "bob").register(t, c)
+	end, _ := net.Pipe()
+	stall := &stallConn{Conn: end, closing: make(chan struct{}), release: make(chan struct{})}
+	defer close(stall.release)
+	c.mu.Lock()
+	c.clients["bob"].conn = rpc.NewClient(stall)
+	c.mu.Unlock()
+
+	go c.Unregister(protocol.RegisterArgs{ID: "bob"}, &struct{}{})
+	<-stall.closing
+	locked := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		c.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the server mutex is held while a connection closes")
+	}
+	c.mu.Lock()
+	_, online := c.clients["bob"]
+	c.mu.Unlock()
+	if online {
+		t.Error("bob is still registered while the connection closes")
+	}
+}
+
+// tapConn keeps a copy of everything read from the connection.
+type tapConn struct {
+	net.Conn
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (c tapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.buf.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// listenTapped is listen, also returning what the server has read so far.
+func listenTapped(t *testing.T, c *ChatServer) (addr string, seen func() string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serveConn(tapConn{Conn: conn, mu: &mu, buf: &buf})
+		}
+	}()
+	return ln.Addr().String(), func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.String()
+	}
+}
+
+func TestStartTLSUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	_, _, certFile, keyFile := selfSigned(t, dir)
+	c := newTestServer(t)
+	cfg, err := loadTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tlsConfig, c.startTLS = cfg, "require"
+	addr, seen := listenTapped(t, c)
+
+	// without the upgrade nothing but StartTLS goes through
+	plain := dial(t, addr)
+	carol := newTLSMockClient(t, "carol")
+	if err := plain.Call("ChatServer.Register", carol.registerArgs(), &struct{}{}); err == nil || !strings.Contains(err.Error(), "requires TLS") {
+		t.Errorf("plain Register under -starttls require: %v, want it refused", err)
+	}
+	if err := plain.Call("ChatServer.History", struct{}{}, &protocol.HistoryReply{}); err == nil {
+		t.Error("plain History under -starttls require: accepted")
+	}
+
+	bob := newTLSMockClient(t, "bob")
+	bob.register(t, c)
+	roots, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust := &tls.Config{RootCAs: x509.NewCertPool()}
+	trust.RootCAs.AppendCertsFromPEM(roots)
+	tc, err := protocol.DialStartTLS("tcp", addr, trust)
+	if err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	rc := rpc.NewClient(tc)
+	defer rc.Close()
+	alice := newTLSMockClient(t, "alice")
+	if err := rc.Call("ChatServer.Register", alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatalf("Register after StartTLS: %v", err)
+	}
+	const secret = "upgraded-secret-text"
+	if err := rc.Call("ChatServer.SendAck", protocol.MessageArgs{Sender: "alice", Text: secret}, &protocol.SendAck{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.waitFor(t, 1, chat)[0].Text; got != "alice: "+secret {
+		t.Errorf("bob received %q", got)
+	}
+	raw := seen()
+	if !strings.Contains(raw, "ChatServer.StartTLS") {
+		t.Error("the StartTLS call was not seen in plain text")
+	}
+	if strings.Contains(raw, secret) || strings.Contains(raw, "alice-nonce") {
+		t.Error("calls after StartTLS reached the server in plain text")
+	}
+	if err := rc.Call("ChatServer.StartTLS", struct{}{}, &struct{}{}); err == nil {
+		t.Error("a second StartTLS on an upgraded connection: accepted")
+	}
+}
+
+func TestStartTLSAllowsPlain(t *testing.T) {
+	_, _, certFile, keyFile := selfSigned(t, t.TempDir())
+	c := newTestServer(t)
+	cfg, err := loadTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tlsConfig, c.startTLS = cfg, "allow"
+	alice := newMockClient(t, "alice")
+	ac := dial(t, listen(t, c))
+	if err := ac.Call("ChatServer.Register", alice.registerArgs(), &struct{}{}); err != nil {
+		t.Fatalf("plain Register under -starttls allow: %v", err)
+	}
+	if err := c.Send(protocol.MessageArgs{Sender: "bob", Text: "plain callback"}, &protocol.HistoryReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := alice.waitFor(t, 1, chat)[0].Text; got != "bob: plain callback" {
+		t.Errorf("alice received %q over the plain callback", got)
+	}
+}
+
+func TestReadsNeedRegistration(t *testing.T) {
+	c := NewChatServer()
+	s := &session{c: c, remote: "127.0.0.1:1"}
+	calls := map[string]func() error{
+		"History":       func() error { return s.History(struct{}{}, &protocol.HistoryReply{}) },
+		"HistorySince":  func() error { return s.HistorySince(protocol.SinceArgs{}, &protocol.HistoryReply{}) },
+		"ListUsers":     func() error { return s.ListUsers(struct{}{}, &protocol.ListUsersReply{}) },
+		"RecentlyLeft":  func() error { return s.RecentlyLeft(struct{}{}, &protocol.RecentLeftReply{}) },
+		"Announcements": func() error { return s.Announcements(struct{}{}, &protocol.AnnouncementsReply{}) },
+		"Stats":         func() error { return s.Stats(struct{}{}, &protocol.StatsReply{}) },
+	}
+	for name, call := range calls {
+		if err := call(); err == nil || err.Error() != "not registered" {
+			t.Errorf("%s before Register: got %v, want not registered", name, err)
+		}
+	}
+	s.id = "alice"
+	for name, call := range calls {
+		if err := call(); err != nil {
+			t.Errorf("%s after Register: %v", name, err)
+		}
+	}
+}
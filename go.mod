@@ -0,0 +1,3 @@
+module github.com/Abdoelsabagh10/ds_chat_realtime_assignment
+
+go 1.22
@@ -0,0 +1,305 @@
+// Package protocol holds what the chat server and client share on the wire:
+// the net/rpc argument and reply types, and the StartTLS dial. gob matches
+// fields by name, so both programs use these definitions rather than copies.
+package protocol
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// MessageArgs is one chat message or notice: what Send takes and what
+// Client.Receive is called with.
+type MessageArgs struct {
+	Sender      string
+	Text        string
+	Data        []byte       // optional binary payload; Text is unused when set
+	ContentType string       // MIME type of Data
+	Kind        string       // "join", "leave", "rename", "table", "private", "announcement" or "users"; empty for plain chat
+	Table       *Table       // set with Kind "table"; Text holds a plain fallback
+	Users       *UsersUpdate // set with Kind "users", which goes to Client.UpdateUsers instead of Receive
+	Seq         uint64       // set by the server: the message's sequence number in its room's history, 0 if not kept
+	Room        string       // set by the server: the room it was sent in; empty = every room
+	Mentioned   bool         // set by the server: @everyone or @here in the message includes this recipient
+}
+
+// UsersUpdate is the whole online-user list, pushed with Client.UpdateUsers
+// whenever someone registers, leaves or is renamed.
+type UsersUpdate struct {
+	Users   []string // sorted
+	Version uint64   // grows with each push; an update older than one already seen is stale
+}
+
+// Table is a structured message rendered as aligned columns.
+type Table struct {
+	Headers []string
+	Rows    [][]string
+}
+
+type HistoryReply struct {
+	Messages   []string
+	Seqs       []uint64 // sequence number of each entry in Messages; empty from older servers
+	Recipients int      // set by Send: clients the message was broadcast to
+	Last       uint64   // sequence number of the newest entry in Messages
+}
+
+// SendAck is the reply to ChatServer.SendAck: where the message landed.
+type SendAck struct {
+	Seq        uint64    // the message's history sequence number
+	Time       time.Time // when the server stored it
+	Recipients int       // clients it was broadcast to
+
+	// Backpressure, when set, asks the sender to wait this long before its next
+	// message: the server's broadcast queue is filling up.
+	Backpressure time.Duration
+}
+
+type SinceArgs struct {
+	Seq uint64 // return entries after this one
+}
+
+type RegisterArgs struct {
+	ID    string
+	Addr  string
+	Nonce string // the server checks that Addr answers Client.Nonce with this
+	Room  string // room to join; empty = the server's default room
+	// CertHash is the hex SHA-256 of the certificate Addr serves TLS with. A
+	// server using TLS dials back over TLS and accepts only that certificate.
+	CertHash string
+	Token    string // shared secret; must match -token when the server sets one
+	// AdminToken, when it matches the server's -admintoken, registers the
+	// client as an admin, e.g. to mention @everyone.
+	AdminToken string
+}
+
+type JoinArgs struct {
+	ID    string
+	Room  string
+	Token string // admin token: lets Join create a room when the server has -roomcreate admin
+	Keep  bool   // stay in the rooms already joined: Room is added and becomes the one sent to
+}
+
+type HelloReply struct {
+	Version string
+}
+
+type StatsReply struct {
+	Clients int    // connected now, across rooms
+	Stored  int    // history entries held, across rooms
+	Sent    uint64 // chat and private messages accepted since start
+	// PersistErrors counts failed writes to the server's history file since
+	// start; the messages were delivered all the same.
+	PersistErrors uint64
+	Uptime        time.Duration
+}
+
+type LeftUser struct {
+	ID string
+	At time.Time
+}
+
+type RecentLeftReply struct {
+	Users []LeftUser // oldest first
+}
+
+type ListUsersReply struct {
+	Users []string // sorted
+}
+
+type ConfigReply struct {
+	Version        string
+	Delivery       string // fast or ordered
+	Workers        int    // fast delivery: calls made at once across all clients
+	MaxHistory     int    // 0 = unlimited
+	MaxBlob        int
+	MaxLen         int     // runes; 0 = no limit
+	SendRate       float64 // per sender per second; 0 = unlimited
+	SendBurst      float64
+	SendGrace      float64       // messages past SendBurst that are delayed rather than refused
+	GraceDelay     time.Duration // added per message into the grace allowance
+	GraceDelayMax  time.Duration // longest such delay
+	FloodPenalties string        // the -floodpenalties schedule; empty = flat limit
+	OffenseDecay   time.Duration
+	Persistent     bool // history is saved to disk
+	AnnounceJoins  bool
+	ClearWhenEmpty bool
+	MaxRooms       int    // 0 = no limit
+	RoomCreate     string // "open" or "admin": who may create a room by joining it
+	Everyone       string // "admin" or "anyone": who may mention @everyone
+	IdleAfter      time.Duration
+	Macros         bool
+	NameSimilarity string
+	TimeFormat     string
+	LeaveGrace     time.Duration
+	DeliverTimeout time.Duration
+	EnqueueWait    time.Duration
+	Backpressure   float64 // broadcast queue fill at which SendAck asks senders to wait; 0 = never
+	DialTimeout    time.Duration
+	SlowStart      time.Duration
+	ByteQuota      int64 // per ByteWindow; 0 = no limit
+	ByteWindow     time.Duration
+	RegLimit       int // registrations per ID per RegWindow; 0 = no limit
+	RegWindow      time.Duration
+	Peers          int
+	AdminEnabled   bool   // whether admin RPCs are on; the token itself is never reported
+	AuthRequired   bool   // whether Register needs the shared -token
+	TLS            bool   // connections, dial-backs and peer links use TLS
+	StartTLS       string // "allow" or "require": the port is plain and connections upgrade with StartTLS; "" = none
+}
+
+type AnnouncementArgs struct {
+	Token string // admin token
+	Text  string
+	TTL   time.Duration // 0 = until the server restarts
+}
+
+type Announcement struct {
+	Text    string
+	Posted  time.Time
+	Expires time.Time // zero = never
+}
+
+type AnnouncementsReply struct {
+	Announcements []Announcement // oldest first
+}
+
+type PrivateArgs struct {
+	Msg MessageArgs
+	To  string // recipient ID
+}
+
+// RoleArgs gives Target the role Role, or with Remove takes it away.
+type RoleArgs struct {
+	Token  string // admin token
+	Target string
+	Role   string
+	Remove bool
+}
+
+// RoleDMArgs sends Msg privately to everyone online holding Role; it is not
+// kept in the history. Role "admin" is everyone registered with the admin
+// token.
+type RoleDMArgs struct {
+	Msg   MessageArgs
+	Role  string
+	Token string // admin token: admins may message any role, others only their own
+}
+
+type RolesReply struct {
+	Roles map[string][]string // role → holders, sorted; "admin" lists only those online
+}
+
+type RenameArgs struct {
+	ID    string
+	NewID string
+}
+
+type EchoArgs struct {
+	ID    string
+	Token string // echoed back in the test message
+}
+
+type ForgetArgs struct {
+	ID string
+}
+
+type ForgetReply struct {
+	Removed int
+}
+
+type DeleteMineArgs struct {
+	Sender string
+	Count  int // how many of Sender's newest messages to delete
+}
+
+type InspectArgs struct {
+	Token  string // admin token
+	Target string
+}
+
+type InspectReply struct {
+	ID           string
+	Addr         string // dial-back address
+	Connected    time.Time
+	LastActive   time.Time
+	MessagesSent int
+	QueueLag     int // deliveries queued or in flight to the client
+	Room         string
+}
+
+type AdminArgs struct {
+	Token string // admin token
+}
+
+// AuditEntry is one administrative action. Each entry's Hash covers its fields
+// and the previous entry's Hash, so editing or dropping an entry breaks the chain.
+type AuditEntry struct {
+	Seq    uint64
+	Time   time.Time
+	Actor  string // registered ID of the caller, or its address if it never registered
+	Action string // "announce", "inspect", "forgetme" or "deletemine"
+	Target string
+	Detail string
+	Prev   string // Hash of the entry before; empty for the first
+	Hash   string // hex SHA-256
+}
+
+// Digest is the hash stored in e.Hash.
+func (e AuditEntry) Digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s",
+		e.Seq, e.Time.UTC().Format(time.RFC3339Nano), e.Actor, e.Action, e.Target, e.Detail, e.Prev)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type AuditReply struct {
+	Entries []AuditEntry // oldest first
+	Intact  bool         // every Hash checks out and links to the entry before it
+}
+
+// DialStartTLS is tls.Dial for a server run with -starttls: connect in plain
+// TCP, call ChatServer.StartTLS, then handshake on the same connection. The
+// call is written in net/rpc's gob format by hand, since an rpc.Client would
+// already be reading the connection when the handshake needs it.
+func DialStartTLS(network, addr string, config *tls.Config) (*tls.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	enc := gob.NewEncoder(conn)
+	if err := enc.Encode(rpc.Request{ServiceMethod: "ChatServer.StartTLS"}); err == nil {
+		err = enc.Encode(struct{}{})
+	}
+	var resp rpc.Response
+	if err == nil {
+		dec := gob.NewDecoder(conn)
+		if err = dec.Decode(&resp); err == nil {
+			err = dec.Decode(&struct{}{}) // the reply body, empty whether or not it failed
+		}
+	}
+	if err == nil && resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("starttls: %v", err)
+	}
+	if config.ServerName == "" { // as tls.Dial does
+		host, _, _ := net.SplitHostPort(addr)
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
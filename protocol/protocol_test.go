@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestGobRoundTrip encodes every wire type with all fields set and checks
+// that decoding gives the same value back.
+func TestGobRoundTrip(t *testing.T) {
+	at := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+	values := []any{
+		MessageArgs{Sender: "alice", Text: "hi", Data: []byte{1, 2}, ContentType: "image/png"},
+		MessageArgs{Sender: "bob", Text: "User bob joined", Kind: "join", Seq: 4, Room: "dev"},
+		MessageArgs{Sender: "bob", Text: "[a; 1]", Kind: "table", Table: &Table{Headers: []string{"a"}, Rows: [][]string{{"1"}}}},
+		MessageArgs{Kind: "users", Users: &UsersUpdate{Users: []string{"alice", "bob"}, Version: 3}},
+		HistoryReply{Messages: []string{"alice: hi"}, Seqs: []uint64{7}, Recipients: 2, Last: 7},
+		SendAck{Seq: 7, Time: at, Recipients: 2, Backpressure: time.Second},
+		SinceArgs{Seq: 6},
+		RegisterArgs{ID: "alice", Addr: "127.0.0.1:5000", Nonce: "n", Room: "dev", CertHash: "abc", Token: "t"},
+		JoinArgs{ID: "alice", Room: "dev"},
+		HelloReply{Version: "v1"},
+		StatsReply{Clients: 2, Stored: 5, Sent: 4, Uptime: time.Minute},
+		LeftUser{ID: "bob", At: at},
+		RecentLeftReply{Users: []LeftUser{{ID: "bob", At: at}}},
+		ListUsersReply{Users: []string{"alice", "bob"}},
+		ConfigReply{Version: "v1", Delivery: "fast", Workers: 64, MaxHistory: 10, MaxBlob: 64, MaxLen: 100, SendRate: 2.5, SendBurst: 5, FloodPenalties: "warn,10s", OffenseDecay: time.Minute, Persistent: true, AnnounceJoins: true, ClearWhenEmpty: true,
+			Macros: true, NameSimilarity: "warn", TimeFormat: "15:04", LeaveGrace: time.Second, DeliverTimeout: 2 * time.Second, EnqueueWait: time.Second, Backpressure: 0.75,
+			DialTimeout: 3 * time.Second, SlowStart: 4 * time.Second, ByteQuota: 5, ByteWindow: time.Minute, RegLimit: 5, RegWindow: time.Minute, Peers: 1, AdminEnabled: true, AuthRequired: true, TLS: true, StartTLS: "allow"},
+		AnnouncementArgs{Token: "t", Text: "maintenance", TTL: time.Hour},
+		AnnouncementsReply{Announcements: []Announcement{{Text: "maintenance", Posted: at, Expires: at.Add(time.Hour)}}},
+		PrivateArgs{Msg: MessageArgs{Sender: "alice", Text: "psst", Kind: "private"}, To: "bob"},
+		RenameArgs{ID: "bob", NewID: "robert"},
+		EchoArgs{ID: "alice", Token: "t0k3n"},
+		ForgetArgs{ID: "alice"},
+		ForgetReply{Removed: 3},
+		DeleteMineArgs{Sender: "alice", Count: 2},
+		InspectArgs{Token: "t", Target: "bob"},
+		InspectReply{ID: "bob", Addr: "a", Connected: at, LastActive: at, MessagesSent: 2, QueueLag: 1, Room: "dev"},
+		AdminArgs{Token: "t"},
+		AuditReply{Entries: []AuditEntry{{Seq: 1, Time: at, Actor: "alice", Action: "inspect", Target: "bob", Detail: "d", Prev: "p", Hash: "h"}}, Intact: true},
+	}
+	for _, v := range values {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatalf("%T: encode: %v", v, err)
+		}
+		got := reflect.New(reflect.TypeOf(v))
+		if err := gob.NewDecoder(&buf).Decode(got.Interface()); err != nil {
+			t.Fatalf("%T: decode: %v", v, err)
+		}
+		if !reflect.DeepEqual(got.Elem().Interface(), v) {
+			t.Errorf("%T: got %+v, want %+v", v, got.Elem().Interface(), v)
+		}
+	}
+}
+
+func TestAuditDigestCoversFields(t *testing.T) {
+	e := AuditEntry{Seq: 1, Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Actor: "alice", Action: "announce"}
+	d := e.Digest()
+	e.Detail = "edited"
+	if e.Digest() == d {
+		t.Fatal("changing Detail did not change the digest")
+	}
+}